@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"dexianta/refci/core"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+func runGC(args []string) error {
+	if len(args) == 1 && isHelpArg(args[0]) {
+		printGCUsage(os.Stdout)
+		return nil
+	}
+	if len(args) > 1 {
+		printGCUsage(os.Stderr)
+		return errors.New("gc accepts at most one repo target")
+	}
+
+	db, dbRepo, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var repos []string
+	if len(args) == 1 {
+		repo, _, err := resolveRepoTarget(args[0])
+		if err != nil {
+			return err
+		}
+		repos = []string{repo}
+	} else if repos, err = core.ListMirrors(); err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	var total int64
+	for _, repo := range repos {
+		mirrorPath := filepath.Join(core.Root, "repos", core.ToLocalRepo(repo))
+		if err := fetchMirror(ctx, mirrorPath); err != nil {
+			return fmt.Errorf("fetch mirror %s: %w", repo, err)
+		}
+		report, err := core.GCRepo(ctx, dbRepo, nil, repo)
+		if err != nil {
+			return fmt.Errorf("gc %s: %w", repo, err)
+		}
+		printGCReport(os.Stdout, report)
+		total += report.ReclaimedBytes
+	}
+	if len(repos) > 1 {
+		fmt.Printf("total reclaimed: %s\n", formatBytes(total))
+	}
+	return nil
+}
+
+func printGCReport(w io.Writer, r core.GCReport) {
+	fmt.Fprintf(w, "%s: removed %d worktrees, reclaimed %s\n", r.Repo, len(r.RemovedWorktrees), formatBytes(r.ReclaimedBytes))
+	for _, path := range r.RemovedWorktrees {
+		fmt.Fprintf(w, "  removed %s\n", path)
+	}
+	for _, path := range r.BusyWorktrees {
+		fmt.Fprintf(w, "  in use, kept %s\n", path)
+	}
+	for _, id := range r.CanceledRuns {
+		fmt.Fprintf(w, "  canceled run #%d\n", id)
+	}
+	for _, id := range r.ActiveRuns {
+		fmt.Fprintf(w, "  run #%d on a deleted branch is still active in another refci process\n", id)
+	}
+	if len(r.ActiveRuns) > 0 {
+		fmt.Fprintln(w, "  refci gc can't cancel those; the refci running them does on its next gc (-gc-interval, 1h by default)")
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func printGCUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: refci gc [repo-target]")
+	fmt.Fprintln(w, "Fetch each mirror (or just repo-target) and clean up after branches that")
+	fmt.Fprintln(w, "no longer exist: remove their worktrees, prune worktree metadata in the")
+	fmt.Fprintln(w, "mirror and report the disk space reclaimed.")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "refci gc never cancels runs: pending and running runs on those branches")
+	fmt.Fprintln(w, "are only listed, and their worktrees kept. They are canceled by the refci")
+	fmt.Fprintln(w, "poll loop that owns them, which does this cleanup itself every")
+	fmt.Fprintln(w, "-gc-interval (1h by default), so they may run on for up to that long.")
+}
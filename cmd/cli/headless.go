@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"dexianta/refci/core"
+	"io"
+	"log/slog"
+	"time"
+)
+
+// newHeadlessLogger writes one logfmt line per event, e.g.
+//
+//	time=... level=INFO msg="run ended" run=12 repo=owner/app job=test ref=main sha=1a2b3c4d5e6f status=failed duration=41.2s exit_code=1
+func newHeadlessLogger(w io.Writer) *slog.Logger {
+	return slog.New(slog.NewTextHandler(w, nil))
+}
+
+// logRunEvents is a JobRunner event handler that logs the lifecycle of
+// every run.
+func logRunEvents(logger *slog.Logger) func(core.RunEvent) {
+	return func(ev core.RunEvent) {
+		attrs := []any{
+			"run", ev.Job.ID,
+			"repo", ev.Job.Repo,
+			"job", ev.Job.Name,
+			"ref", ev.Job.Branch,
+			"sha", core.ShortSHA(ev.Job.SHA),
+		}
+		switch ev.Kind {
+		case core.RunQueued:
+			logger.Info("run queued", append(attrs, "attempt", ev.Job.Attempt, "trigger", ev.Job.Trigger)...)
+		case core.RunStarted:
+			logger.Info("run started", append(attrs, "log", ev.Job.LogPath)...)
+		case core.RunEnded:
+			attrs = append(attrs, "status", ev.Job.Status, "duration", ev.Job.Duration.Round(time.Millisecond))
+			if ev.Job.ExitCode >= 0 {
+				attrs = append(attrs, "exit_code", ev.Job.ExitCode)
+			}
+			if ev.Job.Signal != "" {
+				attrs = append(attrs, "signal", ev.Job.Signal)
+			}
+			if ev.Job.Msg != "" {
+				attrs = append(attrs, "msg", ev.Job.Msg)
+			}
+			level := slog.LevelInfo
+			if ev.Job.Status != core.StatusFinished {
+				level = slog.LevelWarn
+				if ev.Job.LogPath != "" {
+					attrs = append(attrs, "log", ev.Job.LogPath)
+				}
+			}
+			logger.Log(context.Background(), level, "run ended", attrs...)
+		}
+	}
+}
+
+// logPollResult logs what changed in a repo's health after a poll: every
+// failure, a recovery from failures, a conf.yml that stops or resumes
+// loading, and jobs that can't be queued or can again.
+func logPollResult(logger *slog.Logger, before, after core.RepoHealth, wait time.Duration) {
+	if logger == nil {
+		return
+	}
+	switch {
+	case after.Failures > 0:
+		logger.Warn("poll failed", "repo", after.Repo, "state", after.State, "failures", after.Failures,
+			"retry_in", wait.Round(time.Second), "err", after.LastError)
+	case before.Failures > 0:
+		logger.Info("poll recovered", "repo", after.Repo, "after_failures", before.Failures)
+	}
+	switch {
+	case after.ConfError != "" && after.ConfError != before.ConfError:
+		logger.Warn("conf.yml failed to load, using the last good one", "repo", after.Repo,
+			"conf_sha", core.ShortSHA(after.ConfSHA), "err", after.ConfError)
+	case after.ConfError == "" && before.ConfError != "":
+		logger.Info("conf.yml loads again", "repo", after.Repo, "conf_sha", core.ShortSHA(after.ConfSHA))
+	}
+	switch {
+	case after.QueueError != "" && after.QueueError != before.QueueError:
+		logger.Warn("jobs not queued", "repo", after.Repo, "err", after.QueueError)
+	case after.QueueError == "" && before.QueueError != "":
+		logger.Info("jobs queue again", "repo", after.Repo)
+	}
+}
+
+// runHeadless stands in for the TUI: it waits for ctx to be canceled (by
+// SIGINT or SIGTERM), then stops the pollers with stopPolling and shuts the
+// runner down.
+func runHeadless(ctx context.Context, logger *slog.Logger, runner *core.JobRunner, stopPolling func(), sd shutdownConfig) error {
+	logger.Info("refci started", "version", appVersion, "root", core.Root)
+	<-ctx.Done()
+
+	logger.Info("shutting down", "mode", sd.mode, "active_runs", runner.Active())
+	stopPolling()
+	if err := sd.run(runner); err != nil {
+		logger.Warn("drain cut short", "err", err)
+	}
+	logger.Info("refci stopped")
+	return nil
+}
@@ -10,9 +10,12 @@ import (
 	"flag"
 	"fmt"
 	"io"
+	"log/slog"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
 	"syscall"
 	"time"
@@ -31,6 +34,10 @@ const appVersion = "0.1"
 // - future direction: parse each repos root/.refci folder, and generate .env file, the bash script file name can match the branch pattern
 func main() {
 	if err := run(os.Args[1:]); err != nil {
+		var exitErr exitCodeError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
 		fmt.Fprintln(os.Stderr, "error:", err)
 		os.Exit(1)
 	}
@@ -51,6 +58,22 @@ func run(args []string) error {
 		return runInit(args[1:])
 	case "clone":
 		return runClone(args[1:])
+	case "migrate":
+		return runMigrate(args[1:])
+	case "run":
+		return runRun(args[1:])
+	case "validate":
+		return runValidate(args[1:])
+	case "gc":
+		return runGC(args[1:])
+	case "prune":
+		return runPrune(args[1:])
+	case "settings":
+		return runSettings(args[1:])
+	case "repo":
+		return runRepo(args[1:])
+	case "serve":
+		return runServe(args[1:])
 	case "version":
 		fmt.Println(appVersion)
 		return nil
@@ -60,21 +83,39 @@ func run(args []string) error {
 }
 
 func runInit(args []string) error {
-	if len(args) == 1 && isHelpArg(args[0]) {
-		printInitUsage(os.Stdout)
-		return nil
+	fs := flag.NewFlagSet("init", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	postgresDSN := fs.String("postgres", "", "postgres dsn")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			printInitUsage(os.Stdout)
+			return nil
+		}
+		printInitUsage(os.Stderr)
+		return err
 	}
-	if len(args) > 1 {
+
+	rest := fs.Args()
+	if len(rest) > 1 {
 		printInitUsage(os.Stderr)
 		return fmt.Errorf("init accepts at most one argument")
 	}
 
 	path := "."
-	if len(args) == 1 {
-		path = args[0]
+	if len(rest) == 1 {
+		path = rest[0]
+	}
+
+	var dbCfg core.DBConfig
+	dsn := strings.TrimSpace(*postgresDSN)
+	if dsn == "" {
+		dsn = strings.TrimSpace(os.Getenv(core.PostgresDSNEnv))
+	}
+	if dsn != "" {
+		dbCfg = core.DBConfig{Kind: core.DBPostgres, PostgresDSN: dsn}
 	}
 
-	if err := core.InitRoot(path); err != nil {
+	if err := core.InitRoot(path, dbCfg); err != nil {
 		return err
 	}
 
@@ -96,22 +137,68 @@ func runClone(args []string) error {
 		return errors.New("clone requires exactly one git URL")
 	}
 
-	repoURL := strings.TrimSpace(args[0])
-	repo := core.ParseGithubUrl(repoURL)
-	if repo == "" {
-		return fmt.Errorf("invalid github URL: %q", repoURL)
+	db, dbRepo, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = cloneRepo(context.Background(), dbRepo, args[0], core.CodeRepo{Enabled: true})
+	return err
+}
+
+func runMigrate(args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	statusOnly := fs.Bool("status", false, "print schema version only")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			printMigrateUsage(os.Stdout)
+			return nil
+		}
+		printMigrateUsage(os.Stderr)
+		return err
+	}
+	if fs.NArg() != 0 {
+		printMigrateUsage(os.Stderr)
+		return errors.New("migrate takes no arguments")
 	}
 
 	if err := ensureRootAtCWD(); err != nil {
 		return err
 	}
+	cfg, err := core.RootDBConfig(core.Root)
+	if err != nil {
+		return err
+	}
+	db, err := core.OpenDB(cfg)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
 
-	mirrorPath := filepath.Join(core.Root, "repos", core.ToLocalRepo(repo))
-	if err := core.CloneMirror(context.Background(), repoURL, mirrorPath); err != nil {
+	current, err := core.SchemaVersion(db)
+	if err != nil {
 		return err
 	}
+	latest := core.LatestSchemaVersion()
+	if *statusOnly {
+		fmt.Printf("schema version %d (latest %d)\n", current, latest)
+		return nil
+	}
 
-	fmt.Printf("cloned %s into %s\n", repo, mirrorPath)
+	applied, err := core.Migrate(db, cfg.Kind)
+	for _, m := range applied {
+		fmt.Printf("applied %s\n", m)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Printf("schema is up to date (version %d)\n", latest)
+		return nil
+	}
+	fmt.Printf("schema migrated from version %d to %d\n", current, latest)
 	return nil
 }
 
@@ -120,6 +207,14 @@ func runPollLoop(args []string) error {
 	fs.SetOutput(io.Discard)
 	envPath := fs.String("e", ".env", "env file path")
 	interval := fs.Duration("interval", 3*time.Second, "poll interval")
+	maxParallel := fs.Int("max-parallel", runtime.NumCPU(), "max jobs running at once, 0 = no limit")
+	maxPerRepo := fs.Int("max-per-repo", 0, "max jobs running at once per repo, 0 = no limit")
+	gcInterval := fs.Duration("gc-interval", time.Hour, "how often to clean up after deleted branches and prune logs, 0 = never")
+	recoverFlag := fs.String("recover", string(core.RecoverAbandon), "what to do with runs left behind by a refci that exited: abandon or requeue")
+	maxBackoff := fs.Duration("max-backoff", defaultMaxBackoff, "longest wait between retries of a failing poll")
+	headless := fs.Bool("headless", false, "log to stderr instead of showing the TUI")
+	shutdownFlag := fs.String("shutdown", string(core.ShutdownCancel), "what to do with running jobs on exit: cancel or drain")
+	shutdownTimeout := fs.Duration("shutdown-timeout", defaultShutdownTimeout, "how long -shutdown drain waits before canceling")
 	if err := fs.Parse(args); err != nil {
 		if errors.Is(err, flag.ErrHelp) {
 			printPollUsage(os.Stdout)
@@ -137,6 +232,23 @@ func runPollLoop(args []string) error {
 	if *interval <= 0 {
 		return errors.New("interval must be > 0")
 	}
+	if *maxParallel < 0 || *maxPerRepo < 0 {
+		return errors.New("max-parallel and max-per-repo must be >= 0")
+	}
+	if *gcInterval < 0 {
+		return errors.New("gc-interval must be >= 0")
+	}
+	if *maxBackoff <= 0 {
+		return errors.New("max-backoff must be > 0")
+	}
+	recoverMode, err := core.ParseRecoverMode(*recoverFlag)
+	if err != nil {
+		return err
+	}
+	sd, err := parseShutdownConfig(*shutdownFlag, *shutdownTimeout)
+	if err != nil {
+		return err
+	}
 
 	db, dbRepo, err := openDB()
 	if err != nil {
@@ -148,7 +260,23 @@ func runPollLoop(args []string) error {
 	if err != nil {
 		return err
 	}
+	if cr, err := dbRepo.GetCodeRepo(repo); err == nil {
+		if !cr.Enabled {
+			return fmt.Errorf("%s is disabled, enable it with: refci repo set %s enabled true", repo, core.ToLocalRepo(repo))
+		}
+		if cr.PollInterval > 0 && !flagPassed(fs, "interval") {
+			*interval = cr.PollInterval
+		}
+	} else if !errors.Is(err, core.ErrRepoNotRegistered) {
+		return err
+	}
 	runner := core.NewJobRunner(dbRepo)
+	runner.SetLimits(core.RunnerLimits{MaxParallel: *maxParallel, PerRepo: *maxPerRepo})
+	var logger *slog.Logger
+	if *headless {
+		logger = newHeadlessLogger(os.Stderr)
+		runner.SetEventHandler(logRunEvents(logger))
+	}
 
 	cfg, err := parseRuntimeConfig(repo, *envPath)
 	if err != nil {
@@ -157,70 +285,59 @@ func runPollLoop(args []string) error {
 
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
-	uiCtx, cancelUI := context.WithCancel(ctx)
-	defer cancelUI()
 
-	fatalErrCh := make(chan error, 1)
-	done := make(chan struct{})
-	reportFatal := func(err error) {
-		if err == nil || ctx.Err() != nil {
-			return
-		}
-		select {
-		case fatalErrCh <- err:
-		default:
-		}
-		cancelUI()
-		stop()
+	if err := recoverRuns(ctx, dbRepo, runner, cfg, recoverMode, os.Stderr, logger); err != nil {
+		return fmt.Errorf("recover runs: %w", err)
+	}
+
+	if _, err := os.Stat(mirrorPath); err != nil {
+		return fmt.Errorf("repo mirror not found (%s), run: refci clone <git-repo>", mirrorPath)
 	}
+	poller := newRepoPoller(dbRepo, runner, repo, mirrorPath, *interval, *maxBackoff)
+	poller.logger = logger
 
+	done := make(chan struct{})
 	go func() {
 		defer close(done)
 
-		ticker := time.NewTicker(*interval)
-		defer ticker.Stop()
+		timer := time.NewTimer(0)
+		defer timer.Stop()
+		var lastGC time.Time
 		for {
-			if err := fetchMirror(ctx, mirrorPath); err != nil {
-				reportFatal(fmt.Errorf("fetch mirror: %w", err))
-				return
-			} else {
-				jobs, err := core.LoadJobConfsFromRepo(ctx, cfg.Repo, "HEAD")
-				if err != nil {
-					reportFatal(fmt.Errorf("load .refci/conf.yml: %w", err))
-					return
-				} else if len(jobs) == 0 {
-					reportFatal(fmt.Errorf("no jobs found in .refci/conf.yml for %s", cfg.Repo))
-					return
-				} else if err := pollOnce(ctx, dbRepo, runner, cfg, jobs); err != nil {
-					reportFatal(fmt.Errorf("poll failed: %w", err))
-					return
-				}
-			}
-
 			select {
 			case <-ctx.Done():
 				return
-			case <-ticker.C:
+			case <-timer.C:
+			}
+
+			// Failures are retried with backoff and shown in the TUI.
+			wait := poller.poll(ctx, cfg)
+			if *gcInterval > 0 && poller.health.Failures == 0 && time.Since(lastGC) >= *gcInterval {
+				// Best effort: a failed pass is retried next time and
+				// shouldn't stop CI.
+				_, _ = core.GCRepo(ctx, dbRepo, runner, cfg.Repo)
+				if setting, err := dbRepo.GetGlobalSetting(); err == nil {
+					_, _ = core.Prune(dbRepo, setting, time.Now(), false)
+				}
+				lastGC = time.Now()
 			}
+			timer.Reset(wait)
 		}
 	}()
 
-	if err := tui.Run(uiCtx, cfg.Repo, dbRepo); err != nil {
-		stop()
-		cancelUI()
-		<-done
-		return err
+	if *headless {
+		return runHeadless(ctx, logger, runner, func() {
+			stop()
+			<-done
+		}, sd)
 	}
+	err = tui.Run(ctx, cfg.Repo, dbRepo)
 	stop()
-	cancelUI()
 	<-done
-
-	select {
-	case err := <-fatalErrCh:
-		return err
-	default:
+	if serr := sd.runAfterTUI(runner, os.Stderr); err == nil {
+		err = serr
 	}
-	return nil
+	return err
 }
 
 func parseRuntimeConfig(repo, envPath string) (runtimeConfig, error) {
@@ -279,19 +396,25 @@ func openDB() (*sql.DB, core.DbRepo, error) {
 		return nil, nil, err
 	}
 
-	db, err := core.OpenDB(core.DBConfig{
-		Kind:       core.DBSQLite,
-		SQLitePath: filepath.Join(core.Root, "refci.db"),
-	})
+	cfg, err := core.RootDBConfig(core.Root)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	dbRepo, err := core.NewSQLiteRepo(db)
+	db, err := core.OpenDB(cfg)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dbRepo, err := core.NewDbRepo(db, cfg.Kind)
 	if err != nil {
 		_ = db.Close()
 		return nil, nil, err
 	}
+	if err := core.MoveLegacyRepoDirs(context.Background(), dbRepo); err != nil {
+		_ = db.Close()
+		return nil, nil, err
+	}
 	return db, dbRepo, nil
 }
 
@@ -302,27 +425,47 @@ func ensureRootAtCWD() error {
 	}
 	core.Root = absRoot
 
+	if strings.TrimSpace(os.Getenv(core.PostgresDSNEnv)) != "" {
+		reposPath := filepath.Join(core.Root, "repos")
+		if _, err := os.Stat(reposPath); err != nil {
+			if os.IsNotExist(err) {
+				return fmt.Errorf("not an refci root (%s missing). run: refci init", reposPath)
+			}
+			return fmt.Errorf("stat repos dir: %w", err)
+		}
+		return nil
+	}
+
 	dbPath := filepath.Join(core.Root, "refci.db")
-	if _, err := os.Stat(dbPath); err != nil {
+	if _, err := os.Stat(dbPath); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("stat db: %w", err)
+	}
+
+	dsnPath := filepath.Join(core.Root, core.PostgresDSNFile)
+	if _, err := os.Stat(dsnPath); err != nil {
 		if os.IsNotExist(err) {
 			return fmt.Errorf("not an refci root (%s missing). run: refci init", dbPath)
 		}
-		return fmt.Errorf("stat db: %w", err)
+		return fmt.Errorf("stat postgres dsn: %w", err)
 	}
 	return nil
 }
 
+// resolveRepoTarget accepts a repo name (owner/repo, host/owner/repo), its
+// directory name under repos/ (owner--repo) or the path of its mirror
+// (repos/owner--repo, ./..., ../... or absolute).
 func resolveRepoTarget(target string) (repo string, mirrorPath string, err error) {
 	input := strings.TrimSpace(target)
 	if input == "" {
 		return "", "", errors.New("repo target is required")
 	}
 
-	base := filepath.Base(filepath.Clean(input))
-
-	if strings.HasPrefix(input, "repos/") || strings.Contains(input, string(os.PathSeparator)) {
-		repo = strings.ReplaceAll(base, "--", "/")
-		if repo == "" {
+	if filepath.IsAbs(input) || strings.HasPrefix(input, "repos/") ||
+		strings.HasPrefix(input, "./") || strings.HasPrefix(input, "../") {
+		repo = core.FromLocalRepo(filepath.Base(filepath.Clean(input)))
+		if repo == "" || repo == "." || repo == "/" {
 			return "", "", fmt.Errorf("cannot infer repo from %q", target)
 		}
 		path := input
@@ -333,41 +476,132 @@ func resolveRepoTarget(target string) (repo string, mirrorPath string, err error
 	}
 
 	repo = input
-	if strings.Contains(repo, "--") && !strings.Contains(repo, "/") {
-		repo = strings.ReplaceAll(repo, "--", "/")
+	if !strings.Contains(repo, "/") {
+		repo = core.FromLocalRepo(repo)
 	}
 	return repo, filepath.Join(core.Root, "repos", core.ToLocalRepo(repo)), nil
 }
 
+// pollOnce queues the jobs that new commits of cfg.Repo trigger. A job that
+// can't be checked or queued on a ref doesn't hold up the others: every such
+// failure is returned, joined, once the rest are queued.
 func pollOnce(ctx context.Context, dbRepo core.DbRepo, runner *core.JobRunner, cfg runtimeConfig, jobs []core.JobConf) error {
+	type target struct {
+		sha   string
+		names []string
+	}
+	triggered := map[string]*target{}
+	var errs []error
+
 	for _, jc := range jobs {
-		branchSHA, err := core.ListBranchHeadsByPattern(ctx, cfg.Repo, jc.BranchPattern)
+		refSHA, err := core.ListJobRefs(ctx, cfg.Repo, jc)
 		if err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("job %s: list refs: %w", jc.Name, err))
+			continue
+		}
+		if err := skipExistingTags(dbRepo, cfg.Repo, jc, refSHA); err != nil {
+			errs = append(errs, fmt.Errorf("job %s: %w", jc.Name, err))
+			continue
 		}
-		for branch, sha := range branchSHA {
+		for branch, sha := range refSHA {
 			latestJob, err := dbRepo.LatestJobByNameBranch(cfg.Repo, jc.Name, branch)
 			if err != nil {
-				return err
+				errs = append(errs, fmt.Errorf("job %s on %s: %w", jc.Name, branch, err))
+				continue
+			}
+			if latestJob.ID != 0 && core.RefTypeOf(branch) == core.RefTag {
+				// A tag runs once, even if it is later moved.
+				continue
 			}
 			prevSHA := latestJob.SHA
 
 			shouldRun, err := core.ShouldRunByPathPatterns(ctx, cfg.Repo, prevSHA, sha, jc.PathPatterns)
 			if err != nil {
-				return err
+				errs = append(errs, fmt.Errorf("job %s on %s: %w", jc.Name, branch, err))
+				continue
 			}
 			if !shouldRun {
 				continue
 			}
 
+			t, ok := triggered[branch]
+			if !ok {
+				t = &target{sha: sha}
+				triggered[branch] = t
+			}
+			t.names = append(t.names, jc.Name)
+		}
+	}
+
+	branches := make([]string, 0, len(triggered))
+	for branch := range triggered {
+		branches = append(branches, branch)
+	}
+	sort.Strings(branches)
+
+	for _, branch := range branches {
+		t := triggered[branch]
+		// Jobs a triggered job needs run on the same sha too, even if they
+		// didn't trigger themselves or their patterns leave this ref out;
+		// QueueJob skips those that already ran.
+		ordered, err := core.WithNeeds(jobs, t.names...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", branch, err))
+			continue
+		}
+		for _, jc := range ordered {
 			jobConf := jc
 			jobConf.Repo = cfg.Repo
-			if err := runner.QueueJob(jobConf, cfg.Env, branch, sha); err != nil {
-				return err
+			if err := runner.QueueJob(jobConf, cfg.Env, branch, t.sha); err != nil {
+				errs = append(errs, fmt.Errorf("job %s on %s: %w", jc.Name, branch, err))
 			}
 		}
 	}
-	return nil
+	return errors.Join(errs...)
+}
+
+// skipExistingTags records the tags in refSHA that jc has no run on as
+// skipped when its tag and ref patterns aren't the ones it was last polled
+// with: a pattern added to conf.yml, or a job polled for the first time,
+// runs on tags pushed from then on, not on every old tag it now matches.
+// Those can still be run with refci run.
+func skipExistingTags(dbRepo core.DbRepo, repo string, jc core.JobConf, refSHA map[string]string) error {
+	patterns := core.TagPatternsKey(jc)
+	seen, err := dbRepo.TagPatterns(repo, jc.Name)
+	if err != nil || seen == patterns {
+		return err
+	}
+	for ref, sha := range refSHA {
+		if core.RefTypeOf(ref) != core.RefTag {
+			continue
+		}
+		latestJob, err := dbRepo.LatestJobByNameBranch(repo, jc.Name, ref)
+		if err != nil {
+			return err
+		}
+		if latestJob.ID != 0 {
+			continue
+		}
+		job, err := dbRepo.CreateJob(core.Job{Repo: repo, Name: jc.Name, Branch: ref, SHA: sha})
+		if err != nil {
+			return err
+		}
+		if err := dbRepo.UpdateJob(job.ID, core.StatusSkipped, "tag existed before the job's tag patterns matched it"); err != nil {
+			return err
+		}
+	}
+	return dbRepo.SetTagPatterns(repo, jc.Name, patterns)
+}
+
+// flagPassed reports whether flag name was set on the command line.
+func flagPassed(fs *flag.FlagSet, name string) bool {
+	passed := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
 }
 
 func isHelpArg(v string) bool {
@@ -383,43 +617,108 @@ func printMainUsage(w io.Writer) {
 	fmt.Fprintf(w, "refci v%s - local CI runner\n", appVersion)
 	fmt.Fprintln(w, "")
 	fmt.Fprintln(w, "Usage:")
-	fmt.Fprintln(w, "  refci init [path]")
+	fmt.Fprintln(w, "  refci init [-postgres <dsn>] [path]")
 	fmt.Fprintln(w, "  refci clone <git-repo-url>")
-	fmt.Fprintln(w, "  refci -e <env_file> [-interval 3s] <repo-target>")
+	fmt.Fprintln(w, "  refci migrate [-status]")
+	fmt.Fprintln(w, "  refci run [-e <env_file>] [--branch b] [--sha s] [--follow] <repo-target> <job>")
+	fmt.Fprintln(w, "  refci validate [path | - | <repo-target>@<ref>]")
+	fmt.Fprintln(w, "  refci gc [repo-target]")
+	fmt.Fprintln(w, "  refci prune [--dry-run] [-v] [--days N] [--keep K] [--compress-after D]")
+	fmt.Fprintln(w, "  refci settings [get <key> | set <key> <value>]")
+	fmt.Fprintln(w, "  refci repo list | add <url> | remove <repo> | set <repo> <key> <value> | get <repo> [key]")
+	fmt.Fprintln(w, "  refci serve [-e <env_file>] [-interval 3s] [-max-parallel N] [-rescan 30s] [--headless] ...")
+	fmt.Fprintln(w, "  refci -e <env_file> [-interval 3s] [-max-parallel N] [-max-per-repo N] [-gc-interval 1h] [-recover abandon|requeue] [--headless] <repo-target>")
 	fmt.Fprintln(w, "")
 	fmt.Fprintln(w, "Repo target:")
-	fmt.Fprintln(w, "  owner/repo | owner--repo | repos/owner--repo | /abs/path/to/repos/owner--repo")
+	fmt.Fprintln(w, "  owner/repo | host/owner/repo | owner--repo | repos/owner--repo | /abs/path/to/repos/owner--repo")
 	fmt.Fprintln(w, "")
 	fmt.Fprintln(w, "Examples:")
 	fmt.Fprintln(w, "  refci init .")
 	fmt.Fprintln(w, "  refci clone git@github.com:owner/repo.git")
 	fmt.Fprintln(w, "  refci -e .env owner/repo")
+	fmt.Fprintln(w, "  refci serve -e .env")
+	fmt.Fprintln(w, "  refci serve --headless 2>>refci.log")
+	fmt.Fprintln(w, "  refci run --follow owner/repo main-test")
 	fmt.Fprintln(w, "")
 	fmt.Fprintln(w, "Help:")
 	fmt.Fprintln(w, "  refci --help")
 	fmt.Fprintln(w, "  refci init --help")
 	fmt.Fprintln(w, "  refci clone --help")
+	fmt.Fprintln(w, "  refci migrate --help")
+	fmt.Fprintln(w, "  refci run --help")
+	fmt.Fprintln(w, "  refci validate --help")
+	fmt.Fprintln(w, "  refci gc --help")
+	fmt.Fprintln(w, "  refci prune --help")
+	fmt.Fprintln(w, "  refci settings --help")
+	fmt.Fprintln(w, "  refci repo --help")
+	fmt.Fprintln(w, "  refci serve --help")
 }
 
 func printInitUsage(w io.Writer) {
-	fmt.Fprintln(w, "Usage: refci init [path]")
+	fmt.Fprintln(w, "Usage: refci init [-postgres <dsn>] [path]")
 	fmt.Fprintln(w, "Create a refci root at path (default: current directory).")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Flags:")
+	fmt.Fprintln(w, "  -postgres string")
+	fmt.Fprintln(w, "      store jobs in postgres instead of <root>/refci.db")
+	fmt.Fprintln(w, "      (also read from $REFCI_POSTGRES_DSN)")
 }
 
 func printCloneUsage(w io.Writer) {
 	fmt.Fprintln(w, "Usage: refci clone <git-repo-url>")
-	fmt.Fprintln(w, "Clone a mirror repo into <root>/repos.")
+	fmt.Fprintln(w, "Clone a mirror repo into <root>/repos and register it (see refci repo).")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Accepted forms and the repo name they get:")
+	fmt.Fprintln(w, "  https://github.com/owner/app.git     owner/app")
+	fmt.Fprintln(w, "  git@github.com:owner/app.git         owner/app")
+	fmt.Fprintln(w, "  https://gitlab.com/group/sub/app     gitlab.com/group/sub/app")
+	fmt.Fprintln(w, "  git@git.internal:team/app.git        git.internal/team/app")
+	fmt.Fprintln(w, "  ssh://git@host:2222/team/app.git     host:2222/team/app")
+	fmt.Fprintln(w, "  file:///srv/git/app.git, /srv/git/app.git, ../app")
+	fmt.Fprintln(w, "                                       local/srv/git/app (by absolute path)")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Web URLs of a page in a repo, like .../app/tree/main or .../app/-/merge_requests/1,")
+	fmt.Fprintln(w, "name the repo. Anything without a colon before its first slash is a local path,")
+	fmt.Fprintln(w, "as for git clone: owner/app is the directory ./owner/app, not a GitHub repo.")
+}
+
+func printMigrateUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: refci migrate [-status]")
+	fmt.Fprintln(w, "Apply pending jobs database migrations. Every command also migrates on open;")
+	fmt.Fprintln(w, "this lets you upgrade the schema explicitly, e.g. right after upgrading refci.")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Flags:")
+	fmt.Fprintln(w, "  -status")
+	fmt.Fprintln(w, "      print the current and latest schema version without migrating")
 }
 
 func printPollUsage(w io.Writer) {
-	fmt.Fprintln(w, "Usage: refci -e <env_file> [-interval 3s] <repo-target>")
+	fmt.Fprintln(w, "Usage: refci -e <env_file> [-interval 3s] [-max-parallel N] [-max-per-repo N] [-gc-interval 1h] [-recover abandon|requeue] [-max-backoff 5m] [-shutdown cancel|drain] [--headless] <repo-target>")
 	fmt.Fprintln(w, "")
 	fmt.Fprintln(w, "Flags:")
 	fmt.Fprintln(w, "  -e string")
 	fmt.Fprintln(w, "      env file path (default \".env\")")
 	fmt.Fprintln(w, "  -interval duration")
-	fmt.Fprintln(w, "      poll interval (default 3s)")
+	fmt.Fprintln(w, "      poll interval (default: the repo's poll_interval, else 3s)")
+	fmt.Fprintln(w, "  -max-parallel int")
+	fmt.Fprintln(w, "      max jobs running at once, 0 = no limit (default: number of CPUs)")
+	fmt.Fprintln(w, "  -max-per-repo int")
+	fmt.Fprintln(w, "      max jobs running at once per repo, 0 = no limit (default 0)")
+	fmt.Fprintln(w, "  -gc-interval duration")
+	fmt.Fprintln(w, "      how often to clean up after deleted branches (see refci gc) and apply")
+	fmt.Fprintln(w, "      log retention (see refci prune), 0 = never (default 1h)")
+	fmt.Fprintln(w, "  -recover string")
+	fmt.Fprintln(w, "      runs left pending/running by a refci that exited are recorded as abandoned;")
+	fmt.Fprintln(w, "      requeue also starts them again (abandon | requeue, default abandon)")
+	fmt.Fprintln(w, "  -max-backoff duration")
+	fmt.Fprintln(w, "      a failing poll is retried after a doubling, jittered delay up to this")
+	fmt.Fprintln(w, "      (default 5m); polling never stops on errors")
+	printShutdownFlags(w)
+	fmt.Fprintln(w, "  --headless")
+	fmt.Fprintln(w, "      no TUI: log run and poll events to stderr as logfmt lines, for systemd,")
+	fmt.Fprintln(w, "      containers or output piped to a file. SIGINT/SIGTERM shuts down as")
+	fmt.Fprintln(w, "      -shutdown says, then exits 0")
 	fmt.Fprintln(w, "")
 	fmt.Fprintln(w, "Repo target:")
-	fmt.Fprintln(w, "  owner/repo | owner--repo | repos/owner--repo | /abs/path/to/repos/owner--repo")
+	fmt.Fprintln(w, "  owner/repo | host/owner/repo | owner--repo | repos/owner--repo | /abs/path/to/repos/owner--repo")
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"dexianta/refci/core"
+)
+
+// git runs git in dir and returns its trimmed output.
+func git(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t",
+		"GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// commit writes files in the work tree dir and commits them.
+func commit(t *testing.T, dir string, files map[string]string) string {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(t, dir, "add", "-A")
+	git(t, dir, "commit", "-q", "-m", "change")
+	return git(t, dir, "rev-parse", "HEAD")
+}
+
+// newTestRoot points core.Root at a fresh root with a sqlite jobs database
+// and a mirror of work as repo.
+func newTestRoot(t *testing.T, work, repo string) core.DbRepo {
+	t.Helper()
+	oldRoot := core.Root
+	core.Root = t.TempDir()
+	t.Cleanup(func() { core.Root = oldRoot })
+
+	if err := core.CloneMirror(context.Background(), work, filepath.Join(core.Root, "repos", core.ToLocalRepo(repo))); err != nil {
+		t.Fatal(err)
+	}
+	db, err := core.OpenDB(core.DBConfig{Kind: core.DBSQLite, SQLitePath: filepath.Join(core.Root, "refci.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	dbRepo, err := core.NewSQLiteRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dbRepo
+}
+
+func TestPruneKeepsWhatPollingNeeds(t *testing.T) {
+	work := filepath.Join(t.TempDir(), "app")
+	git(t, "", "init", "-q", "-b", "stale", work)
+	first := commit(t, work, map[string]string{".refci/build.sh": "echo build\n"})
+	head := commit(t, work, map[string]string{"README": "app\n"})
+	git(t, work, "tag", "v1")
+
+	const repo = "o/app"
+	ctx := context.Background()
+	dbRepo := newTestRoot(t, work, repo)
+	for _, run := range []core.Job{
+		{Repo: repo, Name: "build", Branch: "stale", SHA: first},
+		{Repo: repo, Name: "build", Branch: "stale", SHA: head},
+		{Repo: repo, Name: "release", Branch: "refs/tags/v1", SHA: head},
+	} {
+		job, err := dbRepo.CreateJob(run)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := dbRepo.UpdateJob(job.ID, core.StatusFinished, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every run is long past retention; only the older build run goes.
+	report, err := core.Prune(dbRepo, core.GlobalSetting{LogRetentionDays: 30, KeepRuns: 1}, time.Now().AddDate(0, 0, 60), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.DeletedRuns) != 1 || report.DeletedRuns[0].SHA != first {
+		t.Fatalf("pruned %+v, want only the run of %s", report.DeletedRuns, core.ShortSHA(first))
+	}
+
+	jobs := []core.JobConf{
+		{Name: "build", BranchPatterns: []string{"stale"}, ScriptPath: ".refci/build.sh"},
+		{Name: "release", TagPatterns: []string{"v*"}, ScriptPath: ".refci/build.sh"},
+	}
+	runner := core.NewJobRunner(dbRepo)
+	if err := pollOnce(ctx, dbRepo, runner, runtimeConfig{Repo: repo}, jobs); err != nil {
+		t.Fatal(err)
+	}
+	runs, err := dbRepo.ListJob(core.JobFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 2 {
+		t.Errorf("%d runs after polling, want the 2 kept ones: unchanged refs ran again", len(runs))
+	}
+}
+
+func TestPollQueuesPastBrokenJobs(t *testing.T) {
+	work := filepath.Join(t.TempDir(), "app")
+	git(t, "", "init", "-q", "-b", "main", work)
+	commit(t, work, map[string]string{".refci/build.sh": "echo build\n"})
+
+	const repo = "o/app"
+	dbRepo := newTestRoot(t, work, repo)
+	jobs := []core.JobConf{
+		{Name: "broken", ScriptPath: ".refci/missing.sh"},
+		{Name: "build", ScriptPath: ".refci/build.sh"},
+	}
+	runner := core.NewJobRunner(dbRepo)
+	err := pollOnce(context.Background(), dbRepo, runner, runtimeConfig{Repo: repo}, jobs)
+	if err == nil || !strings.Contains(err.Error(), "job broken on main: script not found") {
+		t.Errorf("pollOnce = %v, want the missing script of broken reported", err)
+	}
+
+	runs, lerr := dbRepo.ListJob(core.JobFilter{})
+	if lerr != nil {
+		t.Fatal(lerr)
+	}
+	if len(runs) != 1 || runs[0].Name != "build" {
+		t.Fatalf("queued %+v, want one run of build", runs)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if code, err := runner.Wait(ctx, runs[0].ID); err != nil || code != 0 {
+		t.Errorf("build run = %d, %v; want exit 0", code, err)
+	}
+}
+
+func TestPollSkipsTagsThatPredateTheirPattern(t *testing.T) {
+	work := filepath.Join(t.TempDir(), "app")
+	git(t, "", "init", "-q", "-b", "main", work)
+	commit(t, work, map[string]string{".refci/release.sh": "echo release\n"})
+	git(t, work, "tag", "v1")
+	git(t, work, "tag", "r1")
+
+	const repo = "o/app"
+	ctx := context.Background()
+	dbRepo := newTestRoot(t, work, repo)
+	runner := core.NewJobRunner(dbRepo)
+	release := core.JobConf{Name: "release", TagPatterns: []string{"v*"}, ScriptPath: ".refci/release.sh"}
+	runsOn := func(ref string) core.Job {
+		t.Helper()
+		runs, err := dbRepo.ListJob(core.JobFilter{Branch: ref})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) != 1 {
+			t.Fatalf("%d runs on %s, want 1", len(runs), ref)
+		}
+		return runs[0]
+	}
+
+	// Tags there before the job is first polled are recorded as skipped.
+	if err := pollOnce(ctx, dbRepo, runner, runtimeConfig{Repo: repo}, []core.JobConf{release}); err != nil {
+		t.Fatal(err)
+	}
+	if run := runsOn("refs/tags/v1"); run.Status != core.StatusSkipped {
+		t.Errorf("run on v1 is %s, want %s", run.Status, core.StatusSkipped)
+	}
+
+	// A tag pushed later runs.
+	git(t, work, "tag", "v2")
+	if err := core.FetchMirror(ctx, filepath.Join(core.Root, "repos", core.ToLocalRepo(repo))); err != nil {
+		t.Fatal(err)
+	}
+	if err := pollOnce(ctx, dbRepo, runner, runtimeConfig{Repo: repo}, []core.JobConf{release}); err != nil {
+		t.Fatal(err)
+	}
+	run := runsOn("refs/tags/v2")
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if code, err := runner.Wait(waitCtx, run.ID); err != nil || code != 0 {
+		t.Errorf("run on v2 = %d, %v; want exit 0", code, err)
+	}
+
+	// So are old tags that a changed pattern now matches.
+	release.TagPatterns = append(release.TagPatterns, "r*")
+	if err := pollOnce(ctx, dbRepo, runner, runtimeConfig{Repo: repo}, []core.JobConf{release}); err != nil {
+		t.Fatal(err)
+	}
+	if run := runsOn("refs/tags/r1"); run.Status != core.StatusSkipped {
+		t.Errorf("run on r1 is %s, want %s", run.Status, core.StatusSkipped)
+	}
+}
+
+func TestPollRunsNeedsTheirPatternsLeaveOut(t *testing.T) {
+	work := filepath.Join(t.TempDir(), "app")
+	git(t, "", "init", "-q", "-b", "main", work)
+	sha := commit(t, work, map[string]string{".refci/build.sh": "echo build\n", "README": "app\n"})
+
+	const repo = "o/app"
+	dbRepo := newTestRoot(t, work, repo)
+	runner := core.NewJobRunner(dbRepo)
+	jobs := []core.JobConf{
+		{Name: "build", BranchPatterns: []string{"release/*"}, PathPatterns: []string{"src/**"}, ScriptPath: ".refci/build.sh"},
+		{Name: "test", Needs: []string{"build"}, ScriptPath: ".refci/build.sh"},
+	}
+	if err := pollOnce(context.Background(), dbRepo, runner, runtimeConfig{Repo: repo}, jobs); err != nil {
+		t.Fatal(err)
+	}
+
+	// build triggers on neither main nor README, but test needs it.
+	for _, name := range []string{"build", "test"} {
+		runs, err := dbRepo.ListJob(core.JobFilter{Name: name, Branch: "main", SHA: sha})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(runs) != 1 {
+			t.Fatalf("%d runs of %s on main, want 1", len(runs), name)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		code, err := runner.Wait(ctx, runs[0].ID)
+		cancel()
+		if err != nil || code != 0 {
+			t.Errorf("%s run = %d, %v; want exit 0", name, code, err)
+		}
+	}
+}
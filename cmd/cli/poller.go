@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"dexianta/refci/core"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// defaultMaxBackoff caps the delay between retries of a failing repo.
+const defaultMaxBackoff = 5 * time.Minute
+
+// repoPoller polls one repo. Failed polls are retried with backoff instead
+// of stopping refci, and a conf.yml that stops loading is replaced by the
+// last one that did. Every outcome is recorded as the repo's health.
+type repoPoller struct {
+	dbRepo     core.DbRepo
+	runner     *core.JobRunner
+	mirrorPath string
+	interval   time.Duration
+	backoff    core.Backoff
+
+	jobs   []core.JobConf // from health.ConfSHA
+	health core.RepoHealth
+	logger *slog.Logger // headless only, see logPollResult
+}
+
+func newRepoPoller(dbRepo core.DbRepo, runner *core.JobRunner, repo, mirrorPath string, interval, maxBackoff time.Duration) *repoPoller {
+	// The stored health only provides the last good conf commit; without
+	// it polling starts from scratch.
+	health, err := dbRepo.GetRepoHealth(repo)
+	if err != nil {
+		health = core.RepoHealth{Repo: repo}
+	}
+	return &repoPoller{
+		dbRepo:     dbRepo,
+		runner:     runner,
+		mirrorPath: mirrorPath,
+		interval:   interval,
+		backoff:    core.Backoff{Base: interval, Max: max(maxBackoff, interval)},
+		health:     health,
+	}
+}
+
+// poll fetches the mirror of cfg.Repo, queues the jobs its new commits
+// trigger and returns how long to wait before polling again. Jobs that
+// couldn't be queued don't fail the poll, which would back off the jobs
+// that could; they are recorded as health.QueueError and tried again on
+// the next poll.
+func (p *repoPoller) poll(ctx context.Context, cfg runtimeConfig) time.Duration {
+	err := fetchMirror(ctx, p.mirrorPath)
+	if err != nil {
+		err = fmt.Errorf("fetch mirror: %w", err)
+	} else if err = p.loadJobs(ctx, cfg.Repo); err == nil {
+		p.health.QueueError = ""
+		if qerr := pollOnce(ctx, p.dbRepo, p.runner, cfg, p.jobs); qerr != nil {
+			p.health.QueueError = strings.ReplaceAll(qerr.Error(), "\n", "; ")
+		}
+	}
+	if ctx.Err() != nil {
+		return 0
+	}
+
+	if err != nil {
+		return p.fail(cfg.Repo, err)
+	}
+	before := p.health
+	p.health.Repo = cfg.Repo
+	p.health.RecordSuccess(time.Now().UTC())
+	// Best effort: health is for display and must not stop polling.
+	_ = p.dbRepo.SaveRepoHealth(p.health)
+	logPollResult(p.logger, before, p.health, p.interval)
+	return p.interval
+}
+
+// fail records a failed poll of repo and returns the backoff before the
+// next attempt.
+func (p *repoPoller) fail(repo string, err error) time.Duration {
+	now := time.Now().UTC()
+	wait := max(p.backoff.Delay(p.health.Failures+1), p.interval)
+	before := p.health
+	p.health.Repo = repo
+	p.health.RecordFailure(err, now, now.Add(wait))
+	_ = p.dbRepo.SaveRepoHealth(p.health)
+	logPollResult(p.logger, before, p.health, wait)
+	return wait
+}
+
+// loadJobs loads .refci/conf.yml at the mirror's HEAD. When that fails, the
+// jobs of the last conf.yml that loaded are kept (after a restart, reloaded
+// from the commit health remembers) and the failure is recorded as
+// health.ConfError; only without any usable conf is it an error.
+func (p *repoPoller) loadJobs(ctx context.Context, repo string) error {
+	sha, err := core.ResolveCommit(ctx, repo, "HEAD")
+	if err != nil {
+		return fmt.Errorf("resolve HEAD: %w", err)
+	}
+	if sha == p.health.ConfSHA && p.jobs != nil {
+		return nil
+	}
+
+	jobs, err := core.LoadJobConfsFromRepo(ctx, repo, sha)
+	if err == nil && len(jobs) == 0 {
+		err = fmt.Errorf("no jobs found in .refci/conf.yml for %s", repo)
+	}
+	if err == nil {
+		p.jobs = jobs
+		p.health.ConfSHA = sha
+		p.health.ConfError = ""
+		return nil
+	}
+	if ctx.Err() != nil {
+		return err
+	}
+
+	if p.jobs == nil && p.health.ConfSHA != "" {
+		good, gerr := core.LoadJobConfsFromRepo(ctx, repo, p.health.ConfSHA)
+		if gerr == nil && len(good) > 0 {
+			p.jobs = good
+		}
+	}
+	if p.jobs == nil {
+		p.health.ConfSHA = ""
+		p.health.ConfError = ""
+		return fmt.Errorf("load .refci/conf.yml: %w", err)
+	}
+	p.health.ConfError = err.Error()
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"dexianta/refci/core"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+func runPrune(args []string) error {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	dryRun := fs.Bool("dry-run", false, "print what would be pruned without changing anything")
+	days := fs.Int("days", -1, "override "+core.SettingLogRetentionDays)
+	keep := fs.Int("keep", -1, "override "+core.SettingKeepRuns)
+	compressAfter := fs.Int("compress-after", -1, "override "+core.SettingCompressAfterDays)
+	verbose := fs.Bool("v", false, "list every run and log")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			printPruneUsage(os.Stdout)
+			return nil
+		}
+		printPruneUsage(os.Stderr)
+		return err
+	}
+	if fs.NArg() != 0 {
+		printPruneUsage(os.Stderr)
+		return errors.New("prune takes no arguments")
+	}
+
+	db, dbRepo, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	setting, err := dbRepo.GetGlobalSetting()
+	if err != nil {
+		return err
+	}
+	if *days >= 0 {
+		setting.LogRetentionDays = *days
+	}
+	if *keep >= 0 {
+		setting.KeepRuns = *keep
+	}
+	if *compressAfter >= 0 {
+		setting.CompressAfterDays = *compressAfter
+	}
+	if setting.LogRetentionDays == 0 && setting.KeepRuns == 0 && setting.CompressAfterDays == 0 {
+		fmt.Println("no retention configured; see refci settings --help")
+		return nil
+	}
+
+	report, err := core.Prune(dbRepo, setting, time.Now(), *dryRun)
+	if err != nil {
+		return err
+	}
+
+	deleted, compressed := "deleted", "compressed"
+	if *dryRun {
+		deleted, compressed = "would delete", "would compress"
+	}
+	if *verbose {
+		for _, j := range report.DeletedRuns {
+			fmt.Printf("%s run #%d %s on %s@%s (%s)\n", deleted, j.ID, j.Name, j.Branch, core.ShortSHA(j.SHA), j.Status)
+		}
+		for _, path := range report.CompressedLogs {
+			fmt.Printf("%s %s\n", compressed, path)
+		}
+	}
+	fmt.Printf("%s %d runs, %s %d logs, %s freed\n",
+		deleted, len(report.DeletedRuns), compressed, len(report.CompressedLogs), formatBytes(report.FreedBytes))
+	return nil
+}
+
+func printPruneUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: refci prune [--dry-run] [-v] [--days N] [--keep K] [--compress-after D]")
+	fmt.Fprintln(w, "Apply log retention to finished runs: delete runs (job rows and logs) that")
+	fmt.Fprintln(w, "ended more than log_retention_days ago or are older than the newest keep_runs")
+	fmt.Fprintln(w, "runs of their repo/job/branch, and gzip logs of runs that ended more than")
+	fmt.Fprintln(w, "compress_after_days ago. Settings come from refci settings; 0 disables each.")
+	fmt.Fprintln(w, "The poll loop also prunes every -gc-interval.")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Flags:")
+	fmt.Fprintln(w, "  --dry-run")
+	fmt.Fprintln(w, "      print what would be pruned without changing anything")
+	fmt.Fprintln(w, "  -v")
+	fmt.Fprintln(w, "      list every run and log")
+	fmt.Fprintln(w, "  --days int, --keep int, --compress-after int")
+	fmt.Fprintln(w, "      override the stored setting for this run")
+}
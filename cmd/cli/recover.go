@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"dexianta/refci/core"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+// recoverRuns reconciles the runs of cfg.Repo left behind by a refci process
+// that exited. With core.RecoverRequeue they also get a new attempt on
+// runner. Each run is reported to logger when it is set (headless), and as
+// text to w otherwise.
+func recoverRuns(ctx context.Context, dbRepo core.DbRepo, runner *core.JobRunner, cfg runtimeConfig, mode core.RecoverMode, w io.Writer, logger *slog.Logger) error {
+	recovered, err := core.RecoverJobs(dbRepo, cfg.Repo)
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range recovered {
+		job := rec.Job
+		if logger != nil {
+			attrs := []any{
+				"run", job.ID,
+				"repo", job.Repo,
+				"job", job.Name,
+				"ref", job.Branch,
+				"sha", core.ShortSHA(job.SHA),
+				"was", job.Status,
+			}
+			if rec.Stopped {
+				attrs = append(attrs, "stopped_pgid", job.PID)
+			}
+			logger.Warn("run abandoned", attrs...)
+		} else {
+			fmt.Fprintf(w, "run #%d %s on %s@%s was %s when its refci exited: abandoned", job.ID, job.Name, job.Branch, core.ShortSHA(job.SHA), job.Status)
+			if rec.Stopped {
+				fmt.Fprintf(w, " (stopped leftover process group %d)", job.PID)
+			}
+			fmt.Fprintln(w)
+		}
+
+		if mode != core.RecoverRequeue {
+			continue
+		}
+		again, err := requeueRun(ctx, runner, cfg, job)
+		switch {
+		case err != nil && logger != nil:
+			logger.Warn("run not requeued", "run", job.ID, "repo", job.Repo, "err", err)
+		case err != nil:
+			fmt.Fprintf(w, "  not requeued: %v\n", err)
+		case logger != nil:
+			logger.Info("run requeued", "run", job.ID, "repo", job.Repo, "as", again.ID)
+		default:
+			fmt.Fprintf(w, "  requeued as run #%d\n", again.ID)
+		}
+	}
+	return nil
+}
+
+// requeueRun starts a new attempt of abandoned run job, with the job's
+// conf.yml at its commit.
+func requeueRun(ctx context.Context, runner *core.JobRunner, cfg runtimeConfig, job core.Job) (core.Job, error) {
+	confs, err := core.LoadJobConfsFromRepo(ctx, cfg.Repo, job.SHA)
+	if err != nil {
+		return core.Job{}, fmt.Errorf("load .refci/conf.yml: %w", err)
+	}
+	jobConf, ok := findJobConf(confs, job.Name)
+	if !ok {
+		return core.Job{}, fmt.Errorf("job %q is no longer in .refci/conf.yml at %s", job.Name, core.ShortSHA(job.SHA))
+	}
+	jobConf.Repo = cfg.Repo
+	return runner.RerunJob(jobConf, cfg.Env, job.Branch, job.SHA, job.Trigger)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+	"testing"
+	"time"
+
+	"dexianta/refci/core"
+)
+
+func TestRecoverRunsReport(t *testing.T) {
+	tests := []struct {
+		name     string
+		job      string
+		mode     core.RecoverMode
+		headless bool
+		requeued bool
+		want     string // with %[1]s for the short sha; time= is dropped from log lines
+	}{
+		{
+			name: "abandon",
+			job:  "build",
+			mode: core.RecoverAbandon,
+			want: "run #1 build on main@%[1]s was pending when its refci exited: abandoned\n",
+		},
+		{
+			name:     "requeue",
+			job:      "build",
+			mode:     core.RecoverRequeue,
+			requeued: true,
+			want: "run #1 build on main@%[1]s was pending when its refci exited: abandoned\n" +
+				"  requeued as run #2\n",
+		},
+		{
+			name: "requeue a job that is gone",
+			job:  "old",
+			mode: core.RecoverRequeue,
+			want: "run #1 old on main@%[1]s was pending when its refci exited: abandoned\n" +
+				"  not requeued: job \"old\" is no longer in .refci/conf.yml at %[1]s\n",
+		},
+		{
+			name:     "headless requeue",
+			job:      "build",
+			mode:     core.RecoverRequeue,
+			headless: true,
+			requeued: true,
+			want: "level=WARN msg=\"run abandoned\" run=1 repo=o/app job=build ref=main sha=%[1]s was=pending\n" +
+				"level=INFO msg=\"run requeued\" run=1 repo=o/app as=2\n",
+		},
+		{
+			name:     "headless requeue a job that is gone",
+			job:      "old",
+			mode:     core.RecoverRequeue,
+			headless: true,
+			want: "level=WARN msg=\"run abandoned\" run=1 repo=o/app job=old ref=main sha=%[1]s was=pending\n" +
+				"level=WARN msg=\"run not requeued\" run=1 repo=o/app err=\"job \\\"old\\\" is no longer in .refci/conf.yml at %[1]s\"\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			work := filepath.Join(t.TempDir(), "app")
+			git(t, "", "init", "-q", "-b", "main", work)
+			sha := commit(t, work, map[string]string{
+				".refci/conf.yml": "build:\n  script: .refci/build.sh\n",
+				".refci/build.sh": "echo build\n",
+			})
+			const repo = "o/app"
+			dbRepo := newTestRoot(t, work, repo)
+			// A run without an owner was left by a refci that is gone.
+			if _, err := dbRepo.CreateJob(core.Job{Repo: repo, Name: tt.job, Branch: "main", SHA: sha}); err != nil {
+				t.Fatal(err)
+			}
+
+			var out bytes.Buffer
+			var logger *slog.Logger
+			if tt.headless {
+				logger = newHeadlessLogger(&out)
+			}
+			runner := core.NewJobRunner(dbRepo)
+			if err := recoverRuns(context.Background(), dbRepo, runner, runtimeConfig{Repo: repo}, tt.mode, &out, logger); err != nil {
+				t.Fatal(err)
+			}
+			got := regexp.MustCompile(`(?m)^time=\S+ `).ReplaceAllString(out.String(), "")
+			if want := fmt.Sprintf(tt.want, core.ShortSHA(sha)); got != want {
+				t.Errorf("reported\n%s\nwant\n%s", got, want)
+			}
+
+			if tt.requeued {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				if code, err := runner.Wait(ctx, 2); err != nil || code != 0 {
+					t.Errorf("requeued run = %d, %v; want exit 0", code, err)
+				}
+			}
+		})
+	}
+}
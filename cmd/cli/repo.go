@@ -0,0 +1,381 @@
+package main
+
+import (
+	"context"
+	"dexianta/refci/core"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func runRepo(args []string) error {
+	if len(args) == 0 || isHelpArg(args[0]) {
+		printRepoUsage(os.Stdout)
+		return nil
+	}
+
+	switch args[0] {
+	case "list":
+		return runRepoList(args[1:])
+	case "add":
+		return runRepoAdd(args[1:])
+	case "remove":
+		return runRepoRemove(args[1:])
+	case "set":
+		return runRepoSet(args[1:])
+	case "get":
+		return runRepoGet(args[1:])
+	default:
+		printRepoUsage(os.Stderr)
+		return fmt.Errorf("unknown repo command %q", args[0])
+	}
+}
+
+func runRepoList(args []string) error {
+	if len(args) != 0 {
+		printRepoUsage(os.Stderr)
+		return errors.New("repo list takes no arguments")
+	}
+
+	db, dbRepo, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	repos, err := dbRepo.ListCodeRepos()
+	if err != nil {
+		return err
+	}
+	registered := map[string]bool{}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "REPO\tENABLED\tINTERVAL\tCLONED\tURL")
+	for _, cr := range repos {
+		registered[cr.Repo] = true
+		interval := "default"
+		if cr.PollInterval > 0 {
+			interval = cr.PollInterval.String()
+		}
+		cloned := "-"
+		if !cr.ClonedAt.IsZero() {
+			cloned = cr.ClonedAt.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(tw, "%s\t%t\t%s\t%s\t%s\n", cr.Repo, cr.Enabled, interval, cloned, cr.URL)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	// Mirrors cloned before repos were registered still work in poll mode;
+	// point them out so they can be added.
+	mirrors, err := core.ListMirrors()
+	if err != nil {
+		return err
+	}
+	for _, repo := range mirrors {
+		if !registered[repo] {
+			fmt.Printf("%s: mirror not registered, run: refci repo add %s\n", repo, core.ToLocalRepo(repo))
+		}
+	}
+	return nil
+}
+
+func runRepoAdd(args []string) error {
+	fs := flag.NewFlagSet("repo add", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	interval := fs.Duration("interval", 0, "poll interval, 0 = the poller's -interval")
+	disabled := fs.Bool("disabled", false, "register the repo without polling it")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			printRepoUsage(os.Stdout)
+			return nil
+		}
+		printRepoUsage(os.Stderr)
+		return err
+	}
+	if fs.NArg() != 1 {
+		printRepoUsage(os.Stderr)
+		return errors.New("repo add requires exactly one git URL or repo target")
+	}
+	if *interval < 0 {
+		return errors.New("interval must be >= 0")
+	}
+
+	db, dbRepo, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	arg := strings.TrimSpace(fs.Arg(0))
+	cr := core.CodeRepo{PollInterval: *interval, Enabled: !*disabled}
+	if !looksLikeRemote(arg) {
+		return registerMirror(ctx, dbRepo, arg, cr)
+	}
+	_, err = cloneRepo(ctx, dbRepo, arg, cr)
+	return err
+}
+
+// looksLikeRemote reports whether arg is a URL or local repository path for
+// refci repo add rather than a repo target: every remote form except a
+// plain host/owner/repo, which is read as a registered mirror's name.
+func looksLikeRemote(arg string) bool {
+	if strings.Contains(arg, "://") || strings.Contains(arg, "@") {
+		return true
+	}
+	if abs, err := filepath.Abs(arg); err == nil && strings.HasPrefix(abs, filepath.Join(core.Root, "repos")+string(filepath.Separator)) {
+		return false // a mirror under repos/
+	}
+	if info, err := os.Stat(arg); err == nil && info.IsDir() {
+		return true // a local repository
+	}
+	colon, slash := strings.Index(arg, ":"), strings.Index(arg, "/")
+	return colon >= 0 && (slash < 0 || colon < slash)
+}
+
+// cloneRepo clones rawURL into the mirror directory of its repo name and
+// registers it, keeping the settings of a repo registered before; cr holds
+// those of a new one.
+func cloneRepo(ctx context.Context, dbRepo core.DbRepo, rawURL string, cr core.CodeRepo) (core.CodeRepo, error) {
+	remote, err := core.ParseRemoteURL(rawURL)
+	if err != nil {
+		return core.CodeRepo{}, err
+	}
+	url, err := core.AbsRemoteURL(rawURL)
+	if err != nil {
+		return core.CodeRepo{}, err
+	}
+	repo := remote.String()
+	mirrorPath := filepath.Join(core.Root, "repos", core.ToLocalRepo(repo))
+	if _, err := os.Stat(mirrorPath); err == nil {
+		existing, _ := core.MirrorURL(ctx, mirrorPath)
+		return core.CodeRepo{}, fmt.Errorf("%s is already cloned into %s from %s", repo, mirrorPath, existing)
+	}
+
+	if registered, err := dbRepo.GetCodeRepo(repo); err == nil {
+		cr = registered
+	} else if !errors.Is(err, core.ErrRepoNotRegistered) {
+		return core.CodeRepo{}, err
+	}
+	if err := core.CloneMirror(ctx, url, mirrorPath); err != nil {
+		return core.CodeRepo{}, err
+	}
+	fmt.Printf("cloned %s into %s\n", repo, mirrorPath)
+
+	cr.Repo = repo
+	cr.URL = url
+	cr.ClonedAt = time.Now().UTC()
+	if err := dbRepo.SaveCodeRepo(cr); err != nil {
+		return core.CodeRepo{}, err
+	}
+	fmt.Printf("registered %s\n", repo)
+	return cr, nil
+}
+
+// registerMirror registers the existing mirror of target, cloned before
+// repos were tracked.
+func registerMirror(ctx context.Context, dbRepo core.DbRepo, target string, cr core.CodeRepo) error {
+	repo, mirrorPath, err := resolveRepoTarget(target)
+	if err != nil {
+		return err
+	}
+	if _, err := dbRepo.GetCodeRepo(repo); err == nil {
+		return fmt.Errorf("%s is already registered, change it with: refci repo set", repo)
+	} else if !errors.Is(err, core.ErrRepoNotRegistered) {
+		return err
+	}
+	if _, err := os.Stat(mirrorPath); err != nil {
+		return fmt.Errorf("repo mirror not found (%s), pass its git URL to clone it", mirrorPath)
+	}
+	if cr.URL, err = core.MirrorURL(ctx, mirrorPath); err != nil {
+		return err
+	}
+	cr.Repo = repo
+	if err := dbRepo.SaveCodeRepo(cr); err != nil {
+		return err
+	}
+	fmt.Printf("registered %s\n", repo)
+	return nil
+}
+
+func runRepoRemove(args []string) error {
+	if len(args) != 1 {
+		printRepoUsage(os.Stderr)
+		return errors.New("repo remove requires exactly one repo target")
+	}
+
+	db, dbRepo, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	repo, _, err := resolveRepoTarget(args[0])
+	if err != nil {
+		return err
+	}
+	report, err := core.RemoveRepo(dbRepo, repo)
+	if err != nil {
+		return err
+	}
+	for _, path := range report.RemovedPaths {
+		fmt.Printf("  removed %s\n", path)
+	}
+	fmt.Printf("removed %s: %d runs deleted, %s freed\n", repo, report.DeletedRuns, formatBytes(report.FreedBytes))
+	return nil
+}
+
+func runRepoSet(args []string) error {
+	if len(args) != 3 {
+		printRepoUsage(os.Stderr)
+		return errors.New("usage: refci repo set <repo-target> <key> <value>")
+	}
+
+	db, dbRepo, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	cr, err := registeredRepo(dbRepo, args[0])
+	if err != nil {
+		return err
+	}
+	key, value := args[1], args[2]
+	if key == core.RepoKeyURL {
+		return setRepoURL(dbRepo, cr, value)
+	}
+	ok, err := cr.Set(key, value)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return dbRepo.SaveCodeRepo(cr)
+	}
+	if err := core.ValidateRepoSettingKey(key); err != nil {
+		return err
+	}
+	return dbRepo.SetRepoSetting(core.RepoSetting{Repo: cr.Repo, Key: key, Value: value})
+}
+
+// setRepoURL changes the URL repo cr fetches from, in its mirror as well as
+// the jobs database: fetches use the mirror's origin.
+func setRepoURL(dbRepo core.DbRepo, cr core.CodeRepo, rawURL string) error {
+	if _, err := cr.Set(core.RepoKeyURL, rawURL); err != nil {
+		return err
+	}
+	if _, err := core.ParseRemoteURL(cr.URL); err != nil {
+		return err
+	}
+	url, err := core.AbsRemoteURL(cr.URL)
+	if err != nil {
+		return err
+	}
+	cr.URL = url
+
+	mirrorPath := filepath.Join(core.Root, "repos", core.ToLocalRepo(cr.Repo))
+	if _, err := os.Stat(mirrorPath); err == nil {
+		if err := core.SetMirrorURL(context.Background(), mirrorPath, url); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return fmt.Errorf("stat mirror path: %w", err)
+	}
+	return dbRepo.SaveCodeRepo(cr)
+}
+
+func runRepoGet(args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		printRepoUsage(os.Stderr)
+		return errors.New("usage: refci repo get <repo-target> [key]")
+	}
+
+	db, dbRepo, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	cr, err := registeredRepo(dbRepo, args[0])
+	if err != nil {
+		return err
+	}
+	settings, err := dbRepo.ListRepoSettings(cr.Repo)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 1 {
+		for _, key := range core.RepoKeys {
+			value, _ := cr.Get(key)
+			fmt.Printf("%s=%s\n", key, value)
+		}
+		for _, s := range settings {
+			fmt.Printf("%s=%s\n", s.Key, s.Value)
+		}
+		return nil
+	}
+
+	key := args[1]
+	if value, ok := cr.Get(key); ok {
+		fmt.Println(value)
+		return nil
+	}
+	for _, s := range settings {
+		if s.Key == key {
+			fmt.Println(s.Value)
+			return nil
+		}
+	}
+	return fmt.Errorf("%s has no setting %q", cr.Repo, key)
+}
+
+// registeredRepo resolves target and loads its repos table entry.
+func registeredRepo(dbRepo core.DbRepo, target string) (core.CodeRepo, error) {
+	repo, _, err := resolveRepoTarget(target)
+	if err != nil {
+		return core.CodeRepo{}, err
+	}
+	cr, err := dbRepo.GetCodeRepo(repo)
+	if errors.Is(err, core.ErrRepoNotRegistered) {
+		return core.CodeRepo{}, fmt.Errorf("%w, run: refci repo add %s", err, core.ToLocalRepo(repo))
+	}
+	return cr, err
+}
+
+func printRepoUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage:")
+	fmt.Fprintln(w, "  refci repo list")
+	fmt.Fprintln(w, "  refci repo add [-interval d] [-disabled] <git-url | local-path | repo-target>")
+	fmt.Fprintln(w, "  refci repo remove <repo-target>")
+	fmt.Fprintln(w, "  refci repo set <repo-target> <key> <value>")
+	fmt.Fprintln(w, "  refci repo get <repo-target> [key]")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Manage the repos registered in the jobs database. add clones a git URL or local")
+	fmt.Fprintln(w, "repository into <root>/repos (see refci clone --help for the forms and the repo")
+	fmt.Fprintln(w, "names they get), or registers a mirror that is already there. remove deletes the")
+	fmt.Fprintln(w, "repo's runs, settings, mirror, worktrees and logs; it refuses while runs of the")
+	fmt.Fprintln(w, "repo are pending or running.")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Keys:")
+	fmt.Fprintln(w, "  url            git URL the mirror fetches from; setting it also points the")
+	fmt.Fprintln(w, "                 mirror's origin there")
+	fmt.Fprintln(w, "  poll_interval  how often to poll, e.g. 30s; 0s = the poller's -interval")
+	fmt.Fprintln(w, "  enabled        false stops the repo from being polled")
+	fmt.Fprintln(w, "  cloned_at      when refci cloned the mirror (read-only)")
+	fmt.Fprintln(w, "  env_file       env file refci serve loads for the repo instead of -e")
+	fmt.Fprintln(w, "  any other key  a free-form setting; set it to \"\" to delete it")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Flags (add):")
+	fmt.Fprintln(w, "  -interval duration")
+	fmt.Fprintln(w, "      poll interval, 0 = the poller's -interval (default 0)")
+	fmt.Fprintln(w, "  -disabled")
+	fmt.Fprintln(w, "      register the repo without polling it")
+}
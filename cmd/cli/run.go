@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"dexianta/refci/core"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// exitCodeError makes refci exit with code without printing an error; the
+// command has already reported what happened.
+type exitCodeError struct {
+	code int
+}
+
+func (e exitCodeError) Error() string {
+	return fmt.Sprintf("exit status %d", e.code)
+}
+
+// envDetachedRun marks the background refci started by `refci run
+// --detach`; it reports the run it queued, or why it couldn't, on fd 3.
+const envDetachedRun = "REFCI_DETACHED_RUN"
+
+func runRun(args []string) (err error) {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	envPath := fs.String("e", ".env", "env file path")
+	branchFlag := fs.String("branch", "", "branch to run on")
+	shaFlag := fs.String("sha", "", "commit to run")
+	follow := fs.Bool("follow", false, "stream the job log to stdout")
+	detach := fs.Bool("detach", false, "queue the run, print its ID and return")
+	rest, err := parseInterspersed(fs, args)
+	if err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			printRunUsage(os.Stdout)
+			return nil
+		}
+		printRunUsage(os.Stderr)
+		return err
+	}
+	if len(rest) != 2 {
+		printRunUsage(os.Stderr)
+		return errors.New("run requires a repo target and a job name")
+	}
+	if *detach && *follow {
+		return errors.New("--detach and --follow can't be used together")
+	}
+	var report *os.File
+	if *detach {
+		if os.Getenv(envDetachedRun) == "" {
+			return runDetached(args)
+		}
+		// Job scripts inherit the environment; a refci run --detach in one
+		// must detach too.
+		_ = os.Unsetenv(envDetachedRun)
+		// Keep the job's script from holding the pipe open.
+		syscall.CloseOnExec(3)
+		report = os.NewFile(3, "detach-report")
+		defer func() {
+			if report != nil {
+				fmt.Fprintf(report, "error: %v\n", err)
+				_ = report.Close()
+			}
+		}()
+	}
+
+	db, dbRepo, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	repo, mirrorPath, err := resolveRepoTarget(rest[0])
+	if err != nil {
+		return err
+	}
+	cfg, err := parseRuntimeConfig(repo, *envPath)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := fetchMirror(ctx, mirrorPath); err != nil {
+		return fmt.Errorf("fetch mirror: %w", err)
+	}
+
+	// Branches are recorded by name, tags and other refs by full ref.
+	branch := strings.TrimPrefix(strings.TrimSpace(*branchFlag), "refs/heads/")
+	if branch == "" {
+		branch, err = core.DefaultBranch(ctx, repo)
+		if err != nil {
+			return fmt.Errorf("resolve default branch: %w", err)
+		}
+	}
+	rev := strings.TrimSpace(*shaFlag)
+	if rev == "" {
+		rev = branch
+	}
+	sha, err := core.ResolveCommit(ctx, repo, rev)
+	if err != nil {
+		return err
+	}
+
+	confs, err := core.LoadJobConfsFromRepo(ctx, repo, sha)
+	if err != nil {
+		return fmt.Errorf("load .refci/conf.yml: %w", err)
+	}
+	jobConf, ok := findJobConf(confs, rest[1])
+	if !ok {
+		if combos := matrixJobNames(confs, rest[1]); len(combos) > 0 {
+			return fmt.Errorf("job %q is a matrix; run one of: %s", rest[1], strings.Join(combos, ", "))
+		}
+		return fmt.Errorf("job %q not found in .refci/conf.yml at %s (jobs: %s)", rest[1], core.ShortSHA(sha), strings.Join(jobConfNames(confs), ", "))
+	}
+
+	ordered, err := core.WithNeeds(confs, jobConf.Name)
+	if err != nil {
+		return err
+	}
+
+	runner := core.NewJobRunner(dbRepo)
+	// Whatever this process queued ends with it: needs still running when
+	// the job was skipped, or everything on an error or interrupt.
+	defer func() { _ = runner.Shutdown(context.Background(), core.ShutdownCancel) }()
+	// Needs that haven't run on this sha yet run first, as they would when
+	// polling; the job itself then waits for them.
+	for _, up := range ordered[:len(ordered)-1] {
+		if err := runner.QueueJob(up, cfg.Env, branch, sha); err != nil {
+			return fmt.Errorf("queue %s (needed by %s): %w", up.Name, jobConf.Name, err)
+		}
+	}
+	job, err := runner.RerunJob(jobConf, cfg.Env, branch, sha, core.TriggerManual)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "run #%d: %s on %s@%s (attempt %d)\n", job.ID, job.Name, branch, core.ShortSHA(sha), job.Attempt)
+	logPath := core.JobLogPath(job)
+	fmt.Fprintf(os.Stderr, "log: %s\n", logPath)
+	if report != nil {
+		fmt.Fprintf(report, "run #%d: %s on %s@%s (attempt %d)\nlog: %s\n", job.ID, job.Name, branch, core.ShortSHA(sha), job.Attempt, logPath)
+		_ = report.Close()
+		report = nil
+	}
+
+	type waitResult struct {
+		code int
+		err  error
+	}
+	waitCh := make(chan waitResult, 1)
+	done := make(chan struct{})
+	go func() {
+		code, err := runner.Wait(context.Background(), job.ID)
+		waitCh <- waitResult{code: code, err: err}
+		close(done)
+	}()
+
+	followErrCh := make(chan error, 1)
+	if *follow {
+		go func() { followErrCh <- followLog(logPath, os.Stdout, done) }()
+	} else {
+		followErrCh <- nil
+	}
+
+	interrupted := false
+	var res waitResult
+	select {
+	case res = <-waitCh:
+	case <-ctx.Done():
+		interrupted = true
+		fmt.Fprintf(os.Stderr, "canceling run #%d and the runs it needs\n", job.ID)
+		if err := runner.Shutdown(context.Background(), core.ShutdownCancel); err != nil {
+			return err
+		}
+		res = <-waitCh
+	}
+	if err := <-followErrCh; err != nil {
+		return err
+	}
+	if res.err != nil {
+		return res.err
+	}
+
+	final, err := dbRepo.GetJob(job.ID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case final.Signal != "":
+		fmt.Fprintf(os.Stderr, "run #%d %s (signal %s after %s)\n", final.ID, final.Status, final.Signal, final.Duration.Round(time.Millisecond))
+	case final.ExitCode >= 0:
+		fmt.Fprintf(os.Stderr, "run #%d %s (exit %d after %s)\n", final.ID, final.Status, final.ExitCode, final.Duration.Round(time.Millisecond))
+	default:
+		fmt.Fprintf(os.Stderr, "run #%d %s\n", final.ID, final.Status)
+	}
+
+	switch {
+	case interrupted:
+		return exitCodeError{code: 130}
+	case res.code > 0:
+		return exitCodeError{code: res.code}
+	case res.code < 0 || final.Status != core.StatusFinished:
+		return exitCodeError{code: 1}
+	}
+	return nil
+}
+
+// runDetached starts `refci run args` again in the background, in its own
+// session and with no output, and returns once it has queued the run.
+func runDetached(args []string) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("find refci executable: %w", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("detach: %w", err)
+	}
+	defer r.Close()
+
+	cmd := exec.Command(exe, append([]string{"run"}, args...)...)
+	cmd.Env = append(os.Environ(), envDetachedRun+"=1")
+	cmd.ExtraFiles = []*os.File{w}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	_ = w.Close()
+	if err != nil {
+		return fmt.Errorf("detach: %w", err)
+	}
+	pid := cmd.Process.Pid
+	// Not waited on: it keeps running the job after refci returns.
+	_ = cmd.Process.Release()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("detach: %w", err)
+	}
+	out := strings.TrimSpace(string(b))
+	switch {
+	case out == "":
+		return errors.New("detached refci exited without queuing the run")
+	case strings.HasPrefix(out, "error: "):
+		return errors.New(strings.TrimPrefix(out, "error: "))
+	}
+	fmt.Fprintln(os.Stderr, out)
+	fmt.Fprintf(os.Stderr, "running in refci pid %d (SIGTERM cancels the run)\n", pid)
+	return nil
+}
+
+// followLog copies the log at path to w as it grows, until done is closed.
+// The log may not exist yet while the run is pending.
+func followLog(path string, w io.Writer, done <-chan struct{}) error {
+	var f *os.File
+	for f == nil {
+		var err error
+		f, err = os.Open(path)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) {
+			return fmt.Errorf("open log: %w", err)
+		}
+		select {
+		case <-done:
+			return nil
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+	defer f.Close()
+
+	for {
+		if _, err := io.Copy(w, f); err != nil {
+			return fmt.Errorf("read log: %w", err)
+		}
+		select {
+		case <-done:
+			_, err := io.Copy(w, f)
+			return err
+		case <-time.After(200 * time.Millisecond):
+		}
+	}
+}
+
+func findJobConf(confs []core.JobConf, name string) (core.JobConf, bool) {
+	for _, c := range confs {
+		if c.Name == strings.TrimSpace(name) {
+			return c, true
+		}
+	}
+	return core.JobConf{}, false
+}
+
+func jobConfNames(confs []core.JobConf) []string {
+	names := make([]string, 0, len(confs))
+	for _, c := range confs {
+		names = append(names, c.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// matrixJobNames returns the expanded names of matrix job base.
+func matrixJobNames(confs []core.JobConf, base string) []string {
+	var names []string
+	for _, c := range confs {
+		if b, combo := core.SplitMatrixJobName(c.Name); combo != "" && b == strings.TrimSpace(base) {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// parseInterspersed parses fs allowing flags after positional args, so
+// `refci run repo job --branch b` works like `refci run --branch b repo job`.
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+func printRunUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: refci run [-e <env_file>] [--branch <branch>] [--sha <sha>] [--follow | --detach] <repo-target> <job>")
+	fmt.Fprintln(w, "Run one job from .refci/conf.yml now, recorded with a \"manual\" trigger.")
+	fmt.Fprintln(w, "The command stays in the foreground until the job ends and exits with the")
+	fmt.Fprintln(w, "job's exit code. CTRL+C cancels the job. With --detach it returns as soon")
+	fmt.Fprintln(w, "as the run is queued, leaving a background refci to run it.")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Flags:")
+	fmt.Fprintln(w, "  -e string")
+	fmt.Fprintln(w, "      env file path (default \".env\")")
+	fmt.Fprintln(w, "  --branch string")
+	fmt.Fprintln(w, "      branch to run on, or a full ref such as refs/tags/v1.0 (default: the")
+	fmt.Fprintln(w, "      mirror's HEAD branch)")
+	fmt.Fprintln(w, "  --sha string")
+	fmt.Fprintln(w, "      commit to run (default: the branch or ref head)")
+	fmt.Fprintln(w, "  --follow")
+	fmt.Fprintln(w, "      stream the job log to stdout")
+	fmt.Fprintln(w, "  --detach")
+	fmt.Fprintln(w, "      print the run ID, log path and background refci pid once queued, and")
+	fmt.Fprintln(w, "      return; SIGTERM to that pid cancels the run")
+}
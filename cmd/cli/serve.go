@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"dexianta/refci/core"
+	"dexianta/refci/tui"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// repoSettingEnvFile is the repo setting naming the env file refci serve
+// loads for that repo instead of -e.
+const repoSettingEnvFile = "env_file"
+
+// serveTarget is one repo refci serve polls, and how.
+type serveTarget struct {
+	repo       string
+	mirrorPath string
+	interval   time.Duration
+	envPath    string // "" = no env file
+}
+
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	envPath := fs.String("e", "", "env file for repos without an env_file setting")
+	interval := fs.Duration("interval", 3*time.Second, "poll interval for repos without a poll_interval")
+	maxParallel := fs.Int("max-parallel", runtime.NumCPU(), "max jobs running at once, 0 = no limit")
+	maxPerRepo := fs.Int("max-per-repo", 0, "max jobs running at once per repo, 0 = no limit")
+	gcInterval := fs.Duration("gc-interval", time.Hour, "how often to clean up after deleted branches and prune logs, 0 = never")
+	recoverFlag := fs.String("recover", string(core.RecoverAbandon), "what to do with runs left behind by a refci that exited: abandon or requeue")
+	rescan := fs.Duration("rescan", 30*time.Second, "how often to pick up added, removed and changed repos")
+	maxBackoff := fs.Duration("max-backoff", defaultMaxBackoff, "longest wait between retries of a failing poll")
+	headless := fs.Bool("headless", false, "log to stderr instead of showing the TUI")
+	shutdownFlag := fs.String("shutdown", string(core.ShutdownCancel), "what to do with running jobs on exit: cancel or drain")
+	shutdownTimeout := fs.Duration("shutdown-timeout", defaultShutdownTimeout, "how long -shutdown drain waits before canceling")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			printServeUsage(os.Stdout)
+			return nil
+		}
+		printServeUsage(os.Stderr)
+		return err
+	}
+	if fs.NArg() != 0 {
+		printServeUsage(os.Stderr)
+		return errors.New("serve takes no arguments; it polls every registered repo")
+	}
+	if *interval <= 0 || *rescan <= 0 || *maxBackoff <= 0 {
+		return errors.New("interval, rescan and max-backoff must be > 0")
+	}
+	if *maxParallel < 0 || *maxPerRepo < 0 {
+		return errors.New("max-parallel and max-per-repo must be >= 0")
+	}
+	if *gcInterval < 0 {
+		return errors.New("gc-interval must be >= 0")
+	}
+	recoverMode, err := core.ParseRecoverMode(*recoverFlag)
+	if err != nil {
+		return err
+	}
+	sd, err := parseShutdownConfig(*shutdownFlag, *shutdownTimeout)
+	if err != nil {
+		return err
+	}
+
+	db, dbRepo, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	runner := core.NewJobRunner(dbRepo)
+	runner.SetLimits(core.RunnerLimits{MaxParallel: *maxParallel, PerRepo: *maxPerRepo})
+	var logger *slog.Logger
+	if *headless {
+		logger = newHeadlessLogger(os.Stderr)
+		runner.SetEventHandler(logRunEvents(logger))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s := &server{
+		dbRepo:      dbRepo,
+		runner:      runner,
+		interval:    *interval,
+		envPath:     *envPath,
+		gcInterval:  *gcInterval,
+		maxBackoff:  *maxBackoff,
+		recoverMode: recoverMode,
+		logger:      logger,
+		watched:     map[string]bool{},
+		watchers:    map[string]*repoWatcher{},
+	}
+	targets, err := s.targets()
+	if err != nil {
+		return err
+	}
+	// Report recovered runs before the TUI takes over the terminal; runs
+	// of repos added later are reported as they are found, see sync.
+	for _, t := range targets {
+		if err := s.recover(ctx, t, os.Stderr); err != nil {
+			return fmt.Errorf("recover runs of %s: %w", t.repo, err)
+		}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.supervise(ctx, targets, *rescan)
+	}()
+
+	if *headless {
+		return runHeadless(ctx, logger, runner, func() {
+			stop()
+			<-done
+		}, sd)
+	}
+	err = tui.RunServe(ctx, dbRepo, s.snapshot)
+	stop()
+	<-done
+	if serr := sd.runAfterTUI(runner, os.Stderr); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// server polls every watched repo with its own repoWatcher.
+type server struct {
+	dbRepo      core.DbRepo
+	runner      *core.JobRunner
+	interval    time.Duration
+	envPath     string
+	gcInterval  time.Duration
+	maxBackoff  time.Duration
+	recoverMode core.RecoverMode
+	logger      *slog.Logger // headless only
+
+	mu       sync.Mutex
+	watched  map[string]bool
+	watchers map[string]*repoWatcher // only touched by supervise
+}
+
+type repoWatcher struct {
+	target serveTarget
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// targets lists the repos to poll: every enabled registered repo, and every
+// mirror under repos/ that was never registered.
+func (s *server) targets() ([]serveTarget, error) {
+	repos, err := s.dbRepo.ListCodeRepos()
+	if err != nil {
+		return nil, err
+	}
+	mirrors, err := core.ListMirrors()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []serveTarget
+	known := map[string]bool{}
+	for _, cr := range repos {
+		known[cr.Repo] = true
+		if !cr.Enabled {
+			continue
+		}
+		t := s.defaultTarget(cr.Repo)
+		if cr.PollInterval > 0 {
+			t.interval = cr.PollInterval
+		}
+		settings, err := s.dbRepo.ListRepoSettings(cr.Repo)
+		if err != nil {
+			return nil, err
+		}
+		for _, st := range settings {
+			if st.Key == repoSettingEnvFile {
+				t.envPath = st.Value
+			}
+		}
+		out = append(out, t)
+	}
+	for _, repo := range mirrors {
+		if !known[repo] {
+			out = append(out, s.defaultTarget(repo))
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].repo < out[j].repo })
+	return out, nil
+}
+
+func (s *server) defaultTarget(repo string) serveTarget {
+	return serveTarget{
+		repo:       repo,
+		mirrorPath: filepath.Join(core.Root, "repos", core.ToLocalRepo(repo)),
+		interval:   s.interval,
+		envPath:    s.envPath,
+	}
+}
+
+// supervise runs a watcher per target and, every rescan, starts, stops or
+// restarts watchers to match the current targets. It returns once ctx is
+// done and every watcher has stopped.
+func (s *server) supervise(ctx context.Context, initial []serveTarget, rescan time.Duration) {
+	s.sync(ctx, initial, nil)
+
+	ticker := time.NewTicker(rescan)
+	defer ticker.Stop()
+	var lastPrune time.Time
+	for {
+		if s.gcInterval > 0 && time.Since(lastPrune) >= s.gcInterval {
+			// Best effort, like the rest of gc.
+			if setting, err := s.dbRepo.GetGlobalSetting(); err == nil {
+				_, _ = core.Prune(s.dbRepo, setting, time.Now(), false)
+			}
+			lastPrune = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			for repo, w := range s.watchers {
+				w.cancel()
+				<-w.done
+				delete(s.watchers, repo)
+			}
+			return
+		case <-ticker.C:
+		}
+
+		// A failed listing keeps the current watchers running.
+		if targets, err := s.targets(); err == nil {
+			s.sync(ctx, targets, os.Stderr)
+		}
+	}
+}
+
+// sync makes the running watchers match targets. Runs orphaned in repos that
+// are new to this server are recovered and reported (see recover) to
+// recoverOut, unless it is nil.
+func (s *server) sync(ctx context.Context, targets []serveTarget, recoverOut io.Writer) {
+	want := make(map[string]serveTarget, len(targets))
+	for _, t := range targets {
+		want[t.repo] = t
+	}
+
+	for repo, w := range s.watchers {
+		if t, ok := want[repo]; ok && t == w.target {
+			continue
+		}
+		w.cancel()
+		<-w.done
+		delete(s.watchers, repo)
+		if _, ok := want[repo]; !ok {
+			s.mu.Lock()
+			delete(s.watched, repo)
+			s.mu.Unlock()
+			if s.logger != nil {
+				s.logger.Info("stopped watching", "repo", repo)
+			}
+		}
+	}
+
+	for _, t := range targets {
+		if _, ok := s.watchers[t.repo]; ok {
+			continue
+		}
+		s.mu.Lock()
+		seen := s.watched[t.repo]
+		s.watched[t.repo] = true
+		s.mu.Unlock()
+
+		wctx, cancel := context.WithCancel(ctx)
+		w := &repoWatcher{target: t, cancel: cancel, done: make(chan struct{})}
+		s.watchers[t.repo] = w
+		if s.logger != nil {
+			s.logger.Info("watching", "repo", t.repo, "interval", t.interval, "env_file", t.envPath)
+		}
+		go func() {
+			defer close(w.done)
+			if !seen && recoverOut != nil {
+				// Best effort: recovery is retried when refci restarts.
+				_ = s.recover(wctx, t, recoverOut)
+			}
+			s.watch(wctx, t)
+		}()
+	}
+}
+
+// watch polls t until ctx is done. A failed poll is retried with backoff
+// and shown as the repo's health; it never stops other repos.
+func (s *server) watch(ctx context.Context, t serveTarget) {
+	poller := newRepoPoller(s.dbRepo, s.runner, t.repo, t.mirrorPath, t.interval, s.maxBackoff)
+	poller.logger = s.logger
+
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	var lastGC time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		cfg, err := loadServeConfig(t)
+		var wait time.Duration
+		if err != nil {
+			// A broken env file is retried like any failed poll.
+			wait = poller.fail(cfg.Repo, err)
+		} else {
+			wait = poller.poll(ctx, cfg)
+		}
+		if poller.health.Failures == 0 && s.gcInterval > 0 && time.Since(lastGC) >= s.gcInterval {
+			_, _ = core.GCRepo(ctx, s.dbRepo, s.runner, t.repo)
+			lastGC = time.Now()
+		}
+		timer.Reset(wait)
+	}
+}
+
+// recover reconciles runs of t left behind by a refci process that exited,
+// reporting them to the server's logger when headless and to w otherwise.
+func (s *server) recover(ctx context.Context, t serveTarget, w io.Writer) error {
+	mode := s.recoverMode
+	cfg, err := loadServeConfig(t)
+	if err != nil {
+		// Without its env a requeued run would fail anyway.
+		cfg, mode = runtimeConfig{Repo: t.repo}, core.RecoverAbandon
+	}
+	return recoverRuns(ctx, s.dbRepo, s.runner, cfg, mode, w, s.logger)
+}
+
+// snapshot is the tui.RepoSource of the server.
+func (s *server) snapshot() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]string, 0, len(s.watched))
+	for repo := range s.watched {
+		out = append(out, repo)
+	}
+	sort.Strings(out)
+	return out
+}
+
+func loadServeConfig(t serveTarget) (runtimeConfig, error) {
+	if t.envPath == "" {
+		return runtimeConfig{Repo: t.repo}, nil
+	}
+	cfg, err := parseRuntimeConfig(t.repo, t.envPath)
+	if err != nil {
+		return runtimeConfig{Repo: t.repo}, err
+	}
+	return cfg, nil
+}
+
+func printServeUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: refci serve [-e <env_file>] [-interval 3s] [-max-parallel N] [-max-per-repo N] [-gc-interval 1h] [-recover abandon|requeue] [-rescan 30s] [-max-backoff 5m] [-shutdown cancel|drain] [--headless]")
+	fmt.Fprintln(w, "Poll every enabled registered repo, and every unregistered mirror under")
+	fmt.Fprintln(w, "<root>/repos, concurrently in one process, sharing one job queue and its")
+	fmt.Fprintln(w, "limits. A repo whose poll fails is retried with backoff without affecting")
+	fmt.Fprintln(w, "the others, and its health is shown in the TUI. Repos added, removed or")
+	fmt.Fprintln(w, "changed with refci repo are picked up every -rescan.")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Per-repo settings (refci repo set):")
+	fmt.Fprintln(w, "  poll_interval  overrides -interval")
+	fmt.Fprintln(w, "  enabled        false skips the repo")
+	fmt.Fprintln(w, "  env_file       env file to load instead of -e")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Flags:")
+	fmt.Fprintln(w, "  -e string")
+	fmt.Fprintln(w, "      env file for repos without an env_file setting (default: none)")
+	fmt.Fprintln(w, "  -interval duration")
+	fmt.Fprintln(w, "      poll interval for repos without a poll_interval (default 3s)")
+	fmt.Fprintln(w, "  -max-parallel int")
+	fmt.Fprintln(w, "      max jobs running at once across all repos, 0 = no limit (default: number of CPUs)")
+	fmt.Fprintln(w, "  -max-per-repo int")
+	fmt.Fprintln(w, "      max jobs running at once per repo, 0 = no limit (default 0)")
+	fmt.Fprintln(w, "  -gc-interval duration")
+	fmt.Fprintln(w, "      how often to clean up after deleted branches (see refci gc) and apply")
+	fmt.Fprintln(w, "      log retention (see refci prune), 0 = never (default 1h)")
+	fmt.Fprintln(w, "  -recover string")
+	fmt.Fprintln(w, "      runs left pending/running by a refci that exited are recorded as abandoned;")
+	fmt.Fprintln(w, "      requeue also starts them again (abandon | requeue, default abandon)")
+	fmt.Fprintln(w, "  -rescan duration")
+	fmt.Fprintln(w, "      how often to pick up added, removed and changed repos (default 30s)")
+	fmt.Fprintln(w, "  -max-backoff duration")
+	fmt.Fprintln(w, "      longest wait between retries of a failing poll (default 5m)")
+	printShutdownFlags(w)
+	fmt.Fprintln(w, "  --headless")
+	fmt.Fprintln(w, "      no TUI: log run, poll and repo events to stderr as logfmt lines.")
+	fmt.Fprintln(w, "      SIGINT/SIGTERM shuts down as -shutdown says, then exits 0")
+}
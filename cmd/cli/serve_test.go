@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"dexianta/refci/core"
+)
+
+func TestServerTargets(t *testing.T) {
+	// o/app has a mirror but was never registered.
+	dbRepo := newTestRoot(t, initWork(t), "o/app")
+
+	for _, cr := range []core.CodeRepo{
+		{Repo: "o/lib", Enabled: true},
+		{Repo: "o/slow", Enabled: true, PollInterval: time.Minute},
+		{Repo: "o/off", Enabled: false},
+	} {
+		if err := dbRepo.SaveCodeRepo(cr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := dbRepo.SetRepoSetting(core.RepoSetting{Repo: "o/lib", Key: repoSettingEnvFile, Value: "/etc/lib.env"}); err != nil {
+		t.Fatal(err)
+	}
+	// A disabled repo isn't polled even if it has a mirror.
+	if err := os.MkdirAll(filepath.Join(core.Root, "repos", core.ToLocalRepo("o/off")), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{dbRepo: dbRepo, interval: 3 * time.Second, envPath: "/etc/default.env"}
+	got, err := s.targets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirror := func(repo string) string { return filepath.Join(core.Root, "repos", core.ToLocalRepo(repo)) }
+	want := []serveTarget{
+		{repo: "o/app", mirrorPath: mirror("o/app"), interval: 3 * time.Second, envPath: "/etc/default.env"},
+		{repo: "o/lib", mirrorPath: mirror("o/lib"), interval: 3 * time.Second, envPath: "/etc/lib.env"},
+		{repo: "o/slow", mirrorPath: mirror("o/slow"), interval: time.Minute, envPath: "/etc/default.env"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("targets =\n%+v\nwant\n%+v", got, want)
+	}
+}
+
+func TestServerSync(t *testing.T) {
+	oldRoot := core.Root
+	core.Root = t.TempDir()
+	t.Cleanup(func() { core.Root = oldRoot })
+	db, err := core.OpenDB(core.DBConfig{Kind: core.DBSQLite, SQLitePath: filepath.Join(core.Root, "refci.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	dbRepo, err := core.NewSQLiteRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &server{
+		dbRepo:     dbRepo,
+		runner:     core.NewJobRunner(dbRepo),
+		interval:   time.Hour,
+		maxBackoff: time.Hour,
+		watched:    map[string]bool{},
+		watchers:   map[string]*repoWatcher{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	target := func(repo string, interval time.Duration) serveTarget {
+		t := s.defaultTarget(repo)
+		t.interval = interval
+		return t
+	}
+
+	steps := []struct {
+		name    string
+		targets []serveTarget
+		want    []string
+		kept    []string // watchers that must not be restarted
+	}{
+		{"start", []serveTarget{target("o/a", time.Hour), target("o/b", time.Hour)}, []string{"o/a", "o/b"}, nil},
+		{"unchanged", []serveTarget{target("o/a", time.Hour), target("o/b", time.Hour)}, []string{"o/a", "o/b"}, []string{"o/a", "o/b"}},
+		{"removed and added", []serveTarget{target("o/b", time.Hour), target("o/c", time.Hour)}, []string{"o/b", "o/c"}, []string{"o/b"}},
+		{"changed", []serveTarget{target("o/b", time.Minute), target("o/c", time.Hour)}, []string{"o/b", "o/c"}, []string{"o/c"}},
+		{"none", nil, []string{}, nil},
+	}
+	for _, step := range steps {
+		before := map[string]*repoWatcher{}
+		for repo, w := range s.watchers {
+			before[repo] = w
+		}
+		s.sync(ctx, step.targets, nil)
+
+		if got := s.snapshot(); !reflect.DeepEqual(got, step.want) {
+			t.Errorf("%s: watching %q, want %q", step.name, got, step.want)
+		}
+		if len(s.watchers) != len(step.want) {
+			t.Errorf("%s: %d watchers, want %d", step.name, len(s.watchers), len(step.want))
+		}
+		for _, tt := range step.targets {
+			if w := s.watchers[tt.repo]; w == nil || w.target != tt {
+				t.Errorf("%s: watcher of %s = %+v, want target %+v", step.name, tt.repo, w, tt)
+			}
+		}
+		for _, repo := range step.kept {
+			if s.watchers[repo] != before[repo] {
+				t.Errorf("%s: watcher of %s was restarted", step.name, repo)
+			}
+		}
+		for repo, w := range before {
+			if s.watchers[repo] == w {
+				continue
+			}
+			select {
+			case <-w.done:
+			default:
+				t.Errorf("%s: replaced watcher of %s still running", step.name, repo)
+			}
+		}
+	}
+}
+
+func TestRepoPollerKeepsLastGoodConf(t *testing.T) {
+	work := filepath.Join(t.TempDir(), "app")
+	git(t, "", "init", "-q", "-b", "main", work)
+	good := commit(t, work, map[string]string{
+		".refci/conf.yml": "build:\n  script: .refci/build.sh\n",
+		".refci/build.sh": "echo build\n",
+	})
+
+	const repo = "o/app"
+	ctx := context.Background()
+	dbRepo := newTestRoot(t, work, repo)
+	mirror := filepath.Join(core.Root, "repos", core.ToLocalRepo(repo))
+	runner := core.NewJobRunner(dbRepo)
+	cfg := runtimeConfig{Repo: repo}
+
+	steps := []struct {
+		name      string
+		files     map[string]string // committed before the poll
+		remove    bool              // remove the mirror before the poll
+		wantState string
+		wantConf  string
+		wantJobs  []string
+	}{
+		{name: "good conf", wantState: core.HealthOK, wantConf: good, wantJobs: []string{"build"}},
+		{name: "broken conf", files: map[string]string{".refci/conf.yml": "build: [\n"}, wantState: core.HealthStaleConf, wantConf: good, wantJobs: []string{"build"}},
+		{name: "missing mirror", remove: true, wantState: core.HealthRetrying, wantConf: good, wantJobs: []string{"build"}},
+	}
+	poller := newRepoPoller(dbRepo, runner, repo, mirror, time.Second, time.Minute)
+	for _, step := range steps {
+		if step.files != nil {
+			commit(t, work, step.files)
+		}
+		if step.remove {
+			if err := os.RemoveAll(mirror); err != nil {
+				t.Fatal(err)
+			}
+		}
+		wait := poller.poll(ctx, cfg)
+
+		health, err := dbRepo.GetRepoHealth(repo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if health.State != step.wantState || health.ConfSHA != step.wantConf {
+			t.Errorf("%s: health %s at %s, want %s at %s (%s)", step.name, health.State, core.ShortSHA(health.ConfSHA), step.wantState, core.ShortSHA(step.wantConf), health.LastError)
+		}
+		var names []string
+		for _, jc := range poller.jobs {
+			names = append(names, jc.Name)
+		}
+		if !reflect.DeepEqual(names, step.wantJobs) {
+			t.Errorf("%s: polling jobs %q, want %q", step.name, names, step.wantJobs)
+		}
+		if wait < time.Second {
+			t.Errorf("%s: next poll in %s, want at least the interval", step.name, wait)
+		}
+	}
+
+	// A restarted poller picks the last good conf up from the stored health.
+	if err := core.CloneMirror(ctx, work, mirror); err != nil {
+		t.Fatal(err)
+	}
+	restarted := newRepoPoller(dbRepo, runner, repo, mirror, time.Second, time.Minute)
+	restarted.poll(ctx, cfg)
+	if len(restarted.jobs) != 1 || restarted.health.State != core.HealthStaleConf {
+		t.Errorf("restarted poller has jobs %+v in state %s, want build from %s", restarted.jobs, restarted.health.State, core.ShortSHA(good))
+	}
+}
+
+func TestRepoPollerBacksOff(t *testing.T) {
+	dbRepo := newTestRoot(t, initWork(t), "o/app")
+	poller := newRepoPoller(dbRepo, core.NewJobRunner(dbRepo), "o/app", "", time.Second, 10*time.Second)
+
+	tests := []struct {
+		failures  int
+		min, max  time.Duration
+		wantState string
+	}{
+		{1, time.Second, time.Second, core.HealthRetrying},
+		{2, time.Second, 2 * time.Second, core.HealthRetrying},
+		{3, 2 * time.Second, 4 * time.Second, core.HealthFailing},
+		{4, 4 * time.Second, 8 * time.Second, core.HealthFailing},
+		{5, 5 * time.Second, 10 * time.Second, core.HealthFailing},
+		{6, 5 * time.Second, 10 * time.Second, core.HealthFailing},
+	}
+	for _, tt := range tests {
+		wait := poller.fail("o/app", os.ErrNotExist)
+		if wait < tt.min || wait > tt.max {
+			t.Errorf("after %d failures waits %s, want %s to %s", tt.failures, wait, tt.min, tt.max)
+		}
+		if poller.health.Failures != tt.failures || poller.health.State != tt.wantState {
+			t.Errorf("after %d failures health is %d failures, %s; want %s", tt.failures, poller.health.Failures, poller.health.State, tt.wantState)
+		}
+	}
+}
+
+// initWork creates a work tree with one commit.
+func initWork(t *testing.T) string {
+	t.Helper()
+	work := filepath.Join(t.TempDir(), "app")
+	git(t, "", "init", "-q", "-b", "main", work)
+	commit(t, work, map[string]string{"README": "app\n"})
+	return work
+}
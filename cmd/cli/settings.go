@@ -0,0 +1,61 @@
+package main
+
+import (
+	"dexianta/refci/core"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+func runSettings(args []string) error {
+	if len(args) == 1 && isHelpArg(args[0]) {
+		printSettingsUsage(os.Stdout)
+		return nil
+	}
+
+	db, dbRepo, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	setting, err := dbRepo.GetGlobalSetting()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case len(args) == 0:
+		for _, key := range core.GlobalSettingKeys {
+			value, _ := setting.Get(key)
+			fmt.Printf("%s=%s\n", key, value)
+		}
+		return nil
+	case args[0] == "get" && len(args) == 2:
+		value, err := setting.Get(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Println(value)
+		return nil
+	case args[0] == "set" && len(args) == 3:
+		if err := setting.Set(args[1], args[2]); err != nil {
+			return err
+		}
+		return dbRepo.SetGlobalSetting(setting)
+	default:
+		printSettingsUsage(os.Stderr)
+		return errors.New("usage: refci settings [get <key> | set <key> <value>]")
+	}
+}
+
+func printSettingsUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: refci settings [get <key> | set <key> <value>]")
+	fmt.Fprintln(w, "Show or change refci-wide settings, stored in the jobs database.")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Settings (0 = disabled, the default):")
+	fmt.Fprintln(w, "  log_retention_days   delete finished runs and their logs after N days")
+	fmt.Fprintln(w, "  keep_runs            keep only the newest N finished runs per repo/job/branch")
+	fmt.Fprintln(w, "  compress_after_days  gzip logs of finished runs after N days")
+}
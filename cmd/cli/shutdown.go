@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"dexianta/refci/core"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const defaultShutdownTimeout = 5 * time.Minute
+
+// shutdownConfig is what the poll loop and refci serve do with their runs
+// when they exit.
+type shutdownConfig struct {
+	mode    core.ShutdownMode
+	timeout time.Duration // how long to drain
+}
+
+func parseShutdownConfig(mode string, timeout time.Duration) (shutdownConfig, error) {
+	m, err := core.ParseShutdownMode(mode)
+	if err != nil {
+		return shutdownConfig{}, err
+	}
+	if timeout <= 0 {
+		return shutdownConfig{}, errors.New("shutdown-timeout must be > 0")
+	}
+	return shutdownConfig{mode: m, timeout: timeout}, nil
+}
+
+// run shuts runner down. A SIGINT or SIGTERM while draining cancels the
+// runs still going instead of waiting for them.
+func (sd shutdownConfig) run(runner *core.JobRunner) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sd.timeout)
+	defer cancel()
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return runner.Shutdown(ctx, sd.mode)
+}
+
+// runAfterTUI shuts runner down once the TUI has exited, telling w what it
+// waits for.
+func (sd shutdownConfig) runAfterTUI(runner *core.JobRunner, w io.Writer) error {
+	if n := runner.Active(); n > 0 {
+		noun := "runs"
+		if n == 1 {
+			noun = "run"
+		}
+		if sd.mode == core.ShutdownDrain {
+			fmt.Fprintf(w, "waiting up to %s for %d %s to finish (CTRL+C cancels)\n", sd.timeout, n, noun)
+		} else {
+			fmt.Fprintf(w, "canceling %d %s\n", n, noun)
+		}
+	}
+	return sd.run(runner)
+}
+
+func printShutdownFlags(w io.Writer) {
+	fmt.Fprintln(w, "  -shutdown string")
+	fmt.Fprintln(w, "      on exit, pending runs are canceled and running ones are canceled (cancel)")
+	fmt.Fprintln(w, "      or waited for up to -shutdown-timeout (drain); either way refci exits")
+	fmt.Fprintln(w, "      only once they are recorded (default cancel)")
+	fmt.Fprintln(w, "  -shutdown-timeout duration")
+	fmt.Fprintln(w, "      how long drain waits before canceling what is left; a second")
+	fmt.Fprintln(w, "      CTRL+C/SIGTERM cancels right away (default 5m)")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"dexianta/refci/core"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func runValidate(args []string) error {
+	if len(args) == 1 && isHelpArg(args[0]) {
+		printValidateUsage(os.Stdout)
+		return nil
+	}
+	if len(args) > 1 {
+		printValidateUsage(os.Stderr)
+		return errors.New("validate accepts at most one argument")
+	}
+
+	target := ""
+	if len(args) == 1 {
+		target = strings.TrimSpace(args[0])
+	}
+
+	file, confs, err := loadConfsForValidate(target)
+	var errs core.ConfErrors
+	if errors.As(err, &errs) {
+		for _, e := range errs {
+			fmt.Fprintln(os.Stderr, e)
+		}
+		noun := "problems"
+		if len(errs) == 1 {
+			noun = "problem"
+		}
+		fmt.Fprintf(os.Stderr, "%d %s\n", len(errs), noun)
+		return exitCodeError{code: 1}
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s: ok (%d jobs)\n", file, len(confs))
+	return nil
+}
+
+// loadConfsForValidate reads the conf named by target: a conf.yml, a checkout
+// containing .refci/conf.yml, - for stdin, or repo@ref for a mirror.
+func loadConfsForValidate(target string) (string, []core.JobConf, error) {
+	switch {
+	case target == "":
+		path := filepath.Join(".refci", "conf.yml")
+		confs, err := core.LoadJobConfs(path)
+		return path, confs, err
+	case target == "-":
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", nil, fmt.Errorf("read stdin: %w", err)
+		}
+		confs, err := core.ParseJobConfs(string(data))
+		var errs core.ConfErrors
+		if errors.As(err, &errs) {
+			for _, e := range errs {
+				e.File = "<stdin>"
+			}
+		}
+		return "<stdin>", confs, err
+	}
+
+	if info, err := os.Stat(target); err == nil {
+		path := target
+		if info.IsDir() {
+			path = filepath.Join(target, ".refci", "conf.yml")
+		}
+		confs, err := core.LoadJobConfs(path)
+		return path, confs, err
+	}
+
+	at := strings.LastIndex(target, "@")
+	if at <= 0 || at == len(target)-1 {
+		return "", nil, fmt.Errorf("%s: no such file, and not a <repo>@<ref>", target)
+	}
+	if err := ensureRootAtCWD(); err != nil {
+		return "", nil, err
+	}
+	repo, mirrorPath, err := resolveRepoTarget(target[:at])
+	if err != nil {
+		return "", nil, err
+	}
+	if err := fetchMirror(context.Background(), mirrorPath); err != nil {
+		return "", nil, fmt.Errorf("fetch mirror: %w", err)
+	}
+	ref := target[at+1:]
+	confs, err := core.LoadJobConfsFromRepo(context.Background(), repo, ref)
+	return repo + "@" + ref, confs, err
+}
+
+func printValidateUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: refci validate [path | - | <repo-target>@<ref>]")
+	fmt.Fprintln(w, "Check a .refci/conf.yml and print every problem found. Exits 1 if there")
+	fmt.Fprintln(w, "are any, so it can run as a pre-commit hook.")
+	fmt.Fprintln(w, "")
+	fmt.Fprintln(w, "Target:")
+	fmt.Fprintln(w, "  (none)              .refci/conf.yml in the current directory")
+	fmt.Fprintln(w, "  path                a conf.yml, or a checkout containing .refci/conf.yml")
+	fmt.Fprintln(w, "  -                   read the conf from stdin")
+	fmt.Fprintln(w, "  <repo-target>@<ref> the conf at ref in a mirror (run from the refci root)")
+}
@@ -0,0 +1,116 @@
+package core
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ValidateJobConfs checks the needs graph: every need must name another job
+// in confs and the graph must be acyclic.
+func ValidateJobConfs(confs []JobConf) error {
+	byName := make(map[string]JobConf, len(confs))
+	for _, c := range confs {
+		byName[c.Name] = c
+	}
+
+	for _, c := range confs {
+		for _, need := range c.Needs {
+			if need == c.Name {
+				return fmt.Errorf("job %q needs itself", c.Name)
+			}
+			if _, ok := byName[need]; !ok {
+				return fmt.Errorf("job %q needs unknown job %q", c.Name, need)
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(confs))
+	var stack []string
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			start := 0
+			for i, n := range stack {
+				if n == name {
+					start = i
+					break
+				}
+			}
+			cycle := append(append([]string{}, stack[start:]...), name)
+			return fmt.Errorf("needs cycle: %s", strings.Join(cycle, " -> "))
+		case visited:
+			return nil
+		}
+
+		state[name] = visiting
+		stack = append(stack, name)
+		for _, need := range byName[name].Needs {
+			if err := visit(need); err != nil {
+				return err
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+		return nil
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WithNeeds returns the jobs called names plus every job they transitively
+// need, ordered so each job comes after all of its needs. Needed jobs are
+// included whatever their patterns are. confs must have passed
+// ValidateJobConfs.
+func WithNeeds(confs []JobConf, names ...string) ([]JobConf, error) {
+	byName := make(map[string]JobConf, len(confs))
+	for _, c := range confs {
+		byName[c.Name] = c
+	}
+
+	var (
+		out  []JobConf
+		seen = map[string]bool{}
+	)
+	var add func(name string) error
+	add = func(name string) error {
+		if seen[name] {
+			return nil
+		}
+		c, ok := byName[name]
+		if !ok {
+			return fmt.Errorf("unknown job %q", name)
+		}
+		seen[name] = true
+		for _, need := range c.Needs {
+			if err := add(need); err != nil {
+				return err
+			}
+		}
+		out = append(out, c)
+		return nil
+	}
+
+	for _, name := range names {
+		if err := add(name); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
@@ -16,6 +16,13 @@ const (
 	DBPostgres DBKind = "postgres"
 )
 
+const (
+	// PostgresDSNEnv selects postgres for any root when set.
+	PostgresDSNEnv = "REFCI_POSTGRES_DSN"
+	// PostgresDSNFile is written at the root by `refci init -postgres`.
+	PostgresDSNFile = "postgres.dsn"
+)
+
 type DBConfig struct {
 	Kind DBKind
 
@@ -46,6 +53,19 @@ func OpenDB(cfg DBConfig) (*sql.DB, error) {
 	return db, nil
 }
 
+// NewDbRepo opens the DbRepo implementation matching kind, creating the
+// schema when needed.
+func NewDbRepo(db *sql.DB, kind DBKind) (DbRepo, error) {
+	switch kind {
+	case DBSQLite:
+		return NewSQLiteRepo(db)
+	case DBPostgres:
+		return NewPostgresRepo(db)
+	default:
+		return nil, fmt.Errorf("unsupported db kind: %q", kind)
+	}
+}
+
 func resolveDriver(cfg DBConfig) (driverName string, dsn string, err error) {
 	switch cfg.Kind {
 	case DBSQLite:
@@ -53,7 +73,9 @@ func resolveDriver(cfg DBConfig) (driverName string, dsn string, err error) {
 		if path == "" {
 			path = "refci.db"
 		}
-		return "sqlite", path, nil
+		// The runner writes from several goroutines; wait for the lock
+		// instead of failing with SQLITE_BUSY.
+		return "sqlite", "file:" + path + "?_pragma=busy_timeout(5000)", nil
 	case DBPostgres:
 		dsn := strings.TrimSpace(cfg.PostgresDSN)
 		if dsn == "" {
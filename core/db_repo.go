@@ -1,51 +1,287 @@
 package core
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
 
+// CodeRepo is a repository registered in the repos table.
 type CodeRepo struct {
-	Repo string
-	URL  string // should we distinguish ssh or https
+	Repo         string
+	URL          string        // should we distinguish ssh or https
+	ClonedAt     time.Time     // zero when registered from an existing mirror
+	PollInterval time.Duration // 0 = the poller's -interval
+	Enabled      bool
 }
 
+// RepoSetting is a free-form key/value setting of a registered repo, kept
+// in the repo_settings table.
 type RepoSetting struct {
 	Repo  string
 	Key   string
 	Value string
 }
 
+// Keys of CodeRepo fields for refci repo get/set; any other key is a
+// RepoSetting.
+const (
+	RepoKeyURL          = "url"
+	RepoKeyPollInterval = "poll_interval"
+	RepoKeyEnabled      = "enabled"
+	RepoKeyClonedAt     = "cloned_at"
+)
+
+// RepoKeys lists the CodeRepo keys in display order.
+var RepoKeys = []string{RepoKeyURL, RepoKeyPollInterval, RepoKeyEnabled, RepoKeyClonedAt}
+
+// Get returns the value of CodeRepo field key; ok is false for keys that
+// aren't fields.
+func (r CodeRepo) Get(key string) (value string, ok bool) {
+	switch key {
+	case RepoKeyURL:
+		return r.URL, true
+	case RepoKeyPollInterval:
+		return r.PollInterval.String(), true
+	case RepoKeyEnabled:
+		return strconv.FormatBool(r.Enabled), true
+	case RepoKeyClonedAt:
+		if r.ClonedAt.IsZero() {
+			return "", true
+		}
+		return r.ClonedAt.Format(time.RFC3339), true
+	default:
+		return "", false
+	}
+}
+
+// Set parses value into CodeRepo field key; ok is false for keys that
+// aren't fields.
+func (r *CodeRepo) Set(key, value string) (ok bool, err error) {
+	value = strings.TrimSpace(value)
+	switch key {
+	case RepoKeyURL:
+		if value == "" {
+			return true, fmt.Errorf("%s must not be empty", key)
+		}
+		r.URL = value
+	case RepoKeyPollInterval:
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return true, fmt.Errorf("%s must be a duration >= 0, like 30s or 5m: %q", key, value)
+		}
+		r.PollInterval = d
+	case RepoKeyEnabled:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return true, fmt.Errorf("%s must be true or false: %q", key, value)
+		}
+		r.Enabled = b
+	case RepoKeyClonedAt:
+		return true, fmt.Errorf("%s is read-only", key)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// ValidateRepoSettingKey checks a free-form repo setting key.
+func ValidateRepoSettingKey(key string) error {
+	if key == "" {
+		return fmt.Errorf("setting key must not be empty")
+	}
+	if strings.ContainsAny(key, " \t\n=") {
+		return fmt.Errorf("setting key must not contain whitespace or '=': %q", key)
+	}
+	return nil
+}
+
+// GlobalSetting is refci-wide configuration stored in the settings table.
+// Zero values disable the feature.
 type GlobalSetting struct {
-	LogRetentionDays int
+	LogRetentionDays  int // delete finished runs and their logs after this many days
+	KeepRuns          int // keep only the newest K finished runs per repo/job/branch
+	CompressAfterDays int // gzip logs of finished runs older than this many days
+}
+
+// Keys of GlobalSetting fields in the settings table.
+const (
+	SettingLogRetentionDays  = "log_retention_days"
+	SettingKeepRuns          = "keep_runs"
+	SettingCompressAfterDays = "compress_after_days"
+)
+
+// GlobalSettingKeys lists the settings table keys in display order.
+var GlobalSettingKeys = []string{SettingLogRetentionDays, SettingKeepRuns, SettingCompressAfterDays}
+
+// Get returns the value of setting key.
+func (s GlobalSetting) Get(key string) (string, error) {
+	switch key {
+	case SettingLogRetentionDays:
+		return strconv.Itoa(s.LogRetentionDays), nil
+	case SettingKeepRuns:
+		return strconv.Itoa(s.KeepRuns), nil
+	case SettingCompressAfterDays:
+		return strconv.Itoa(s.CompressAfterDays), nil
+	default:
+		return "", fmt.Errorf("unknown setting %q (settings: %s)", key, strings.Join(GlobalSettingKeys, ", "))
+	}
+}
+
+// Set parses value into setting key.
+func (s *GlobalSetting) Set(key, value string) error {
+	var field *int
+	switch key {
+	case SettingLogRetentionDays:
+		field = &s.LogRetentionDays
+	case SettingKeepRuns:
+		field = &s.KeepRuns
+	case SettingCompressAfterDays:
+		field = &s.CompressAfterDays
+	default:
+		return fmt.Errorf("unknown setting %q (settings: %s)", key, strings.Join(GlobalSettingKeys, ", "))
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil || n < 0 {
+		return fmt.Errorf("%s must be a whole number >= 0: %q", key, value)
+	}
+	*field = n
+	return nil
 }
 
 type Job struct {
-	Repo   string
-	Name   string
-	Branch string
-	SHA    string
-	Start  time.Time
-	End    time.Time
-	Status string
-	Msg    string
+	ID      int64 // run id, unique per execution
+	Repo    string
+	Name    string
+	Branch  string // branch name, or the full ref of a tag or other ref run
+	RefType string // RefBranch, RefTag or RefOther
+	SHA     string
+	Attempt int // 1 for the first run of name/branch/sha, 2 for its first re-run, ...
+	Start   time.Time
+	End     time.Time
+	Status  string
+	Msg     string // why the run is in Status, e.g. "exit status 1"; empty if nothing to say
+	LogPath string // log of the run, recorded when it is created; empty for runs from before it was
+	Trigger string // TriggerPoll or TriggerManual
+	Owner   string // host:pid:instance of the refci process that runs it, see ProcessOwner
+	PID     int    // pid (and process group) of the script once started
+	// PIDStart tells the script's process from a later one reusing PID;
+	// empty where that can't be told.
+	PIDStart string
+	JobExit  // how the script exited; ExitCode is -1 until it did
+}
+
+// JobExit is how a run's script exited, taken from its process state once
+// it was waited on.
+type JobExit struct {
+	ExitCode int           // -1 if it was killed by Signal
+	Signal   string        // signal that killed it, e.g. "killed"; empty if it exited
+	Duration time.Duration // wall time from start to exit
+	UserCPU  time.Duration // user CPU time of the script and the processes it waited for
+	SysCPU   time.Duration // system CPU time, likewise
+	MaxRSS   int64         // peak resident set size in bytes of the largest of them
 }
 
 var (
-	StatusRunning  = "running"
-	StatusPending  = "pending"
-	StatusCanceled = "canceled"
-	StatusFailed   = "failed"
-	StatusFinished = "finished"
+	StatusRunning   = "running"
+	StatusPending   = "pending"
+	StatusCanceled  = "canceled"
+	StatusFailed    = "failed"
+	StatusFinished  = "finished"
+	StatusTimedOut  = "timed_out"
+	StatusSkipped   = "skipped"   // a job it needs did not finish successfully
+	StatusAbandoned = "abandoned" // its refci process exited before it finished
 )
 
+// IsTerminalStatus reports whether a run in status has ended.
+func IsTerminalStatus(status string) bool {
+	switch status {
+	case StatusFinished, StatusFailed, StatusCanceled, StatusTimedOut, StatusSkipped, StatusAbandoned:
+		return true
+	default:
+		return false
+	}
+}
+
+var (
+	TriggerPoll   = "poll"
+	TriggerManual = "manual"
+)
+
+// Kinds of ref a run is for, recorded as Job.RefType.
+var (
+	RefBranch = "branch" // Job.Branch is a branch name, e.g. main
+	RefTag    = "tag"    // Job.Branch is refs/tags/<tag>
+	RefOther  = "ref"    // Job.Branch is any other full ref, e.g. refs/pull/7/head
+)
+
+// RefTypeOf returns the RefType of a run's Branch: branches are recorded by
+// name, tags and other refs by their full ref.
+func RefTypeOf(ref string) string {
+	switch {
+	case strings.HasPrefix(ref, "refs/tags/"):
+		return RefTag
+	case strings.HasPrefix(ref, "refs/heads/"), !strings.HasPrefix(ref, "refs/"):
+		return RefBranch
+	default:
+		return RefOther
+	}
+}
+
+// ErrRepoNotRegistered is returned by GetCodeRepo for unknown repos.
+var ErrRepoNotRegistered = errors.New("repo not registered")
+
 type JobFilter struct {
-	Repo   string
-	Name   string
-	Branch string
-	Status string
+	ID      int64
+	Repo    string
+	Name    string
+	Branch  string
+	RefType string
+	SHA     string
+	Status  string
+	Trigger string
+	// Filters on JobExit, for runs whose script exited; zero values match
+	// any run.
+	ExitCode    *int          // -1 matches runs killed by a signal
+	Signal      string        // e.g. "killed"
+	MinDuration time.Duration // ran at least this long
+	MinMaxRSS   int64         // peaked at least this many bytes
 }
 
 type DbRepo interface {
 	LatestJobByNameBranch(repo, name, branch string) (Job, error)
-	CreateJob(repo, name, branch, sha string) error
-	UpdateJob(repo, name, branch, sha, status, msg string) error // for cancel, or finish etc
+	// CreateJob records a new pending run of job.Repo/Name/Branch/SHA and
+	// returns it with ID and Attempt filled in.
+	CreateJob(job Job) (Job, error)
+	GetJob(id int64) (Job, error)
+	UpdateJob(id int64, status, msg string) error // for cancel, or finish etc
+	// SetJobPID records the pid of a run's script and its processStart.
+	SetJobPID(id int64, pid int, pidStart string) error
+	SetJobLogPath(id int64, path string) error
+	// SetJobExit records how the script of run id exited.
+	SetJobExit(id int64, exit JobExit) error
+	DeleteJob(id int64) error
+	GetGlobalSetting() (GlobalSetting, error)
+	SetGlobalSetting(setting GlobalSetting) error
+	ListCodeRepos() ([]CodeRepo, error)
+	GetCodeRepo(repo string) (CodeRepo, error) // ErrRepoNotRegistered if missing
+	// SaveCodeRepo inserts repo or updates the registered one.
+	SaveCodeRepo(repo CodeRepo) error
+	// DeleteCodeRepo unregisters repo along with its settings, health and runs.
+	DeleteCodeRepo(repo string) error
+	ListRepoSettings(repo string) ([]RepoSetting, error)
+	// SetRepoSetting stores setting, or deletes it when Value is empty.
+	SetRepoSetting(setting RepoSetting) error
+	// GetRepoHealth returns the health of repo, with an empty State if it
+	// was never polled.
+	GetRepoHealth(repo string) (RepoHealth, error)
+	ListRepoHealth() ([]RepoHealth, error)
+	SaveRepoHealth(health RepoHealth) error
+	// TagPatterns returns the TagPatternsKey a job of repo was last polled
+	// with, "" if it never was.
+	TagPatterns(repo, name string) (string, error)
+	SetTagPatterns(repo, name, patterns string) error
 	ListJob(filter JobFilter) ([]Job, error)
 }
@@ -0,0 +1,407 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPostgresDSNEnv points the repo tests at a postgres to run against as
+// well as sqlite. Each test gets a schema of its own there.
+const testPostgresDSNEnv = "REFCI_TEST_POSTGRES_DSN"
+
+// forEachDbRepo runs test against a fresh sqlite repo, and a fresh
+// postgres one when testPostgresDSNEnv is set.
+func forEachDbRepo(t *testing.T, test func(t *testing.T, repo DbRepo)) {
+	t.Run("sqlite", func(t *testing.T) {
+		test(t, newTestRepo(t))
+	})
+	t.Run("postgres", func(t *testing.T) {
+		dsn := os.Getenv(testPostgresDSNEnv)
+		if dsn == "" {
+			t.Skip(testPostgresDSNEnv + " not set")
+		}
+		test(t, newTestPostgresRepo(t, dsn))
+	})
+}
+
+func newTestPostgresRepo(t *testing.T, dsn string) PostgresRepo {
+	t.Helper()
+	repo, err := NewPostgresRepo(newTestPostgresDB(t, dsn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *repo
+}
+
+// newTestPostgresDB opens dsn on a fresh, unmigrated schema of its own.
+func newTestPostgresDB(t *testing.T, dsn string) *sql.DB {
+	t.Helper()
+	admin, err := OpenDB(DBConfig{Kind: DBPostgres, PostgresDSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = admin.Close() })
+	schema := fmt.Sprintf("refci_test_%d", time.Now().UnixNano())
+	if _, err := admin.Exec(`CREATE SCHEMA ` + schema); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _, _ = admin.Exec(`DROP SCHEMA ` + schema + ` CASCADE`) })
+
+	if strings.Contains(dsn, "://") {
+		sep := "?"
+		if strings.Contains(dsn, "?") {
+			sep = "&"
+		}
+		dsn += sep + "search_path=" + schema
+	} else {
+		dsn += " search_path=" + schema
+	}
+	db, err := OpenDB(DBConfig{Kind: DBPostgres, PostgresDSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestDialectBind(t *testing.T) {
+	const query = `SELECT id FROM jobs WHERE repo = ? AND name = ? LIMIT 1`
+	if got := dialect(DBSQLite).bind(query); got != query {
+		t.Errorf("sqlite bind = %q, want it unchanged", got)
+	}
+	if got, want := dialect(DBPostgres).bind(query), `SELECT id FROM jobs WHERE repo = $1 AND name = $2 LIMIT 1`; got != want {
+		t.Errorf("postgres bind = %q, want %q", got, want)
+	}
+}
+
+func TestDbRepoJobs(t *testing.T) {
+	forEachDbRepo(t, func(t *testing.T, repo DbRepo) {
+		first, err := repo.CreateJob(Job{Repo: "o/app", Name: "build", Branch: "main", SHA: "abc"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if first.Attempt != 1 || first.Status != StatusPending || first.Trigger != TriggerPoll || first.RefType != RefBranch {
+			t.Fatalf("created %+v, want a pending first attempt of a polled branch", first)
+		}
+		if err := repo.UpdateJob(first.ID, StatusRunning, ""); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SetJobPID(first.ID, 42, "start"); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SetJobLogPath(first.ID, "logs/1.log"); err != nil {
+			t.Fatal(err)
+		}
+		running, err := repo.GetJob(first.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if running.Status != StatusRunning || !running.End.IsZero() || running.PID != 42 || running.PIDStart != "start" || running.LogPath != "logs/1.log" || running.ExitCode != -1 {
+			t.Fatalf("running job is %+v", running)
+		}
+		if running.Start.Sub(first.Start).Abs() > time.Millisecond {
+			t.Errorf("start read back as %v, want %v", running.Start, first.Start)
+		}
+
+		exit := JobExit{ExitCode: 3, Signal: "", Duration: 1500 * time.Millisecond, UserCPU: time.Second, SysCPU: 20 * time.Millisecond, MaxRSS: 1 << 20}
+		if err := repo.SetJobExit(first.ID, exit); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.UpdateJob(first.ID, StatusFailed, "exit 3"); err != nil {
+			t.Fatal(err)
+		}
+		failed, err := repo.GetJob(first.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if failed.Status != StatusFailed || failed.Msg != "exit 3" || failed.End.IsZero() || failed.JobExit != exit {
+			t.Fatalf("failed job is %+v, want it ended with %+v", failed, exit)
+		}
+
+		second, err := repo.CreateJob(Job{Repo: "o/app", Name: "build", Branch: "main", SHA: "abc", Trigger: TriggerManual})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if second.Attempt != 2 {
+			t.Errorf("second run of the same sha is attempt %d, want 2", second.Attempt)
+		}
+		latest, err := repo.LatestJobByNameBranch("o/app", "build", "main")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if latest.ID != second.ID {
+			t.Errorf("latest run is #%d, want #%d", latest.ID, second.ID)
+		}
+		if none, err := repo.LatestJobByNameBranch("o/app", "build", "dev"); err != nil || none.ID != 0 {
+			t.Errorf("latest run on dev = %+v, %v; want none", none, err)
+		}
+
+		if err := repo.DeleteJob(first.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.GetJob(first.ID); err == nil {
+			t.Error("got a deleted job")
+		}
+	})
+}
+
+func TestDbRepoListJob(t *testing.T) {
+	forEachDbRepo(t, func(t *testing.T, repo DbRepo) {
+		type seed struct {
+			job    Job
+			status string
+			exit   JobExit
+		}
+		ids := map[string]int64{}
+		for key, s := range map[string]seed{
+			"build main": {job: Job{Repo: "o/app", Name: "build", Branch: "main", SHA: "a1"}, status: StatusFinished,
+				exit: JobExit{ExitCode: 0, Duration: time.Second, MaxRSS: 100}},
+			"build tag": {job: Job{Repo: "o/app", Name: "build", Branch: "refs/tags/v1", SHA: "a1", Trigger: TriggerManual}, status: StatusFailed,
+				exit: JobExit{ExitCode: 2, Duration: time.Minute, MaxRSS: 5000}},
+			"test dev": {job: Job{Repo: "o/app", Name: "test", Branch: "dev", SHA: "b2"}, status: StatusCanceled,
+				exit: JobExit{ExitCode: -1, Signal: "killed", Duration: 10 * time.Second}},
+			"lint lib": {job: Job{Repo: "o/lib", Name: "lint", Branch: "main", SHA: "c3"}, status: StatusPending,
+				exit: JobExit{ExitCode: -1}},
+		} {
+			job, err := repo.CreateJob(s.job)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := repo.SetJobExit(job.ID, s.exit); err != nil {
+				t.Fatal(err)
+			}
+			if err := repo.UpdateJob(job.ID, s.status, ""); err != nil {
+				t.Fatal(err)
+			}
+			ids[key] = job.ID
+		}
+
+		two := 2
+		tests := []struct {
+			name   string
+			filter JobFilter
+			want   []string
+		}{
+			{"everything", JobFilter{}, []string{"build main", "build tag", "test dev", "lint lib"}},
+			{"id", JobFilter{ID: ids["test dev"]}, []string{"test dev"}},
+			{"repo", JobFilter{Repo: "o/lib"}, []string{"lint lib"}},
+			{"name", JobFilter{Name: "build"}, []string{"build main", "build tag"}},
+			{"branch", JobFilter{Branch: "main"}, []string{"build main", "lint lib"}},
+			{"ref type", JobFilter{RefType: RefTag}, []string{"build tag"}},
+			{"sha", JobFilter{SHA: "a1"}, []string{"build main", "build tag"}},
+			{"status", JobFilter{Status: StatusCanceled}, []string{"test dev"}},
+			{"trigger", JobFilter{Trigger: TriggerManual}, []string{"build tag"}},
+			{"exit code", JobFilter{ExitCode: &two}, []string{"build tag"}},
+			{"signal", JobFilter{Signal: "killed"}, []string{"test dev"}},
+			{"min duration", JobFilter{MinDuration: 10 * time.Second}, []string{"build tag", "test dev"}},
+			{"min max rss", JobFilter{MinMaxRSS: 1000}, []string{"build tag"}},
+			{"several", JobFilter{Repo: "o/app", Name: "build", Branch: "main"}, []string{"build main"}},
+			{"none", JobFilter{Repo: "o/none"}, nil},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				jobs, err := repo.ListJob(tt.filter)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var got, want []int64
+				for i, job := range jobs {
+					if i > 0 && job.ID > jobs[i-1].ID {
+						t.Errorf("runs not newest first: %d after %d", job.ID, jobs[i-1].ID)
+					}
+					got = append(got, job.ID)
+				}
+				for _, key := range tt.want {
+					want = append(want, ids[key])
+				}
+				sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+				sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+				if !reflect.DeepEqual(got, want) {
+					t.Errorf("ListJob(%+v) = %v, want %v", tt.filter, got, want)
+				}
+			})
+		}
+	})
+}
+
+// Hosts sharing a database that queue the same run at once each get an
+// attempt of their own.
+func TestDbRepoCreateJobRace(t *testing.T) {
+	forEachDbRepo(t, func(t *testing.T, repo DbRepo) {
+		const n = 8
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			attempts []int
+			errs     []error
+		)
+		for range n {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				job, err := repo.CreateJob(Job{Repo: "o/app", Name: "build", Branch: "main", SHA: "abc"})
+				mu.Lock()
+				defer mu.Unlock()
+				if err != nil {
+					errs = append(errs, err)
+					return
+				}
+				attempts = append(attempts, job.Attempt)
+			}()
+		}
+		wg.Wait()
+		if err := errors.Join(errs...); err != nil {
+			t.Fatal(err)
+		}
+		sort.Ints(attempts)
+		for i, attempt := range attempts {
+			if attempt != i+1 {
+				t.Fatalf("attempts %v, want 1 to %d", attempts, n)
+			}
+		}
+	})
+}
+
+func TestDbRepoSettings(t *testing.T) {
+	forEachDbRepo(t, func(t *testing.T, repo DbRepo) {
+		if setting, err := repo.GetGlobalSetting(); err != nil || setting != (GlobalSetting{}) {
+			t.Fatalf("fresh settings = %+v, %v; want the zero setting", setting, err)
+		}
+		want := GlobalSetting{LogRetentionDays: 30, KeepRuns: 5}
+		if err := repo.SetGlobalSetting(want); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := repo.GetGlobalSetting(); err != nil || got != want {
+			t.Errorf("settings = %+v, %v; want %+v", got, err, want)
+		}
+
+		for _, rs := range []RepoSetting{
+			{Repo: "o/app", Key: "b", Value: "2"},
+			{Repo: "o/app", Key: "a", Value: "1"},
+			{Repo: "o/app", Key: "a", Value: "3"},
+			{Repo: "o/lib", Key: "a", Value: "4"},
+			{Repo: "o/app", Key: "b", Value: ""},
+		} {
+			if err := repo.SetRepoSetting(rs); err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := repo.ListRepoSettings("o/app")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []RepoSetting{{Repo: "o/app", Key: "a", Value: "3"}}; !reflect.DeepEqual(got, want) {
+			t.Errorf("settings of o/app = %+v, want %+v", got, want)
+		}
+
+		if patterns, err := repo.TagPatterns("o/app", "release"); err != nil || patterns != "" {
+			t.Errorf("fresh tag patterns = %q, %v; want none", patterns, err)
+		}
+		for _, patterns := range []string{"v*", "v*\nr*"} {
+			if err := repo.SetTagPatterns("o/app", "release", patterns); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := repo.TagPatterns("o/app", "release"); err != nil || got != patterns {
+				t.Errorf("tag patterns = %q, %v; want %q", got, err, patterns)
+			}
+		}
+	})
+}
+
+func TestDbRepoCodeRepos(t *testing.T) {
+	forEachDbRepo(t, func(t *testing.T, repo DbRepo) {
+		if _, err := repo.GetCodeRepo("o/app"); !errors.Is(err, ErrRepoNotRegistered) {
+			t.Fatalf("GetCodeRepo of an unknown repo = %v, want ErrRepoNotRegistered", err)
+		}
+		cloned := time.Date(2026, 1, 2, 3, 4, 5, 6000, time.UTC)
+		app := CodeRepo{Repo: "o/app", URL: "https://github.com/o/app", ClonedAt: cloned, PollInterval: time.Minute, Enabled: true}
+		lib := CodeRepo{Repo: "o/lib", URL: "/srv/lib"}
+		for _, cr := range []CodeRepo{lib, {Repo: "o/app", URL: "old"}, app} {
+			if err := repo.SaveCodeRepo(cr); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got, err := repo.GetCodeRepo("o/app"); err != nil || !reflect.DeepEqual(got, app) {
+			t.Errorf("GetCodeRepo = %+v, %v; want %+v", got, err, app)
+		}
+		if got, err := repo.ListCodeRepos(); err != nil || !reflect.DeepEqual(got, []CodeRepo{app, lib}) {
+			t.Errorf("ListCodeRepos = %+v, %v; want %+v", got, err, []CodeRepo{app, lib})
+		}
+
+		if h, err := repo.GetRepoHealth("o/app"); err != nil || !reflect.DeepEqual(h, RepoHealth{Repo: "o/app"}) {
+			t.Errorf("fresh health = %+v, %v; want empty", h, err)
+		}
+		health := RepoHealth{
+			Repo: "o/app", State: "failing", Failures: 2, LastError: "fetch: timeout",
+			LastPoll: cloned, LastFailure: cloned.Add(time.Second), NextPoll: cloned.Add(time.Minute),
+			ConfSHA: "abc", ConfError: "bad conf", QueueError: "bad job",
+		}
+		if err := repo.SaveRepoHealth(RepoHealth{Repo: "o/app", State: "ok"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SaveRepoHealth(health); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := repo.ListRepoHealth(); err != nil || !reflect.DeepEqual(got, []RepoHealth{health}) {
+			t.Errorf("ListRepoHealth = %+v, %v; want %+v", got, err, []RepoHealth{health})
+		}
+
+		// Deleting a repo deletes all it has.
+		if _, err := repo.CreateJob(Job{Repo: "o/app", Name: "build", Branch: "main", SHA: "abc"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SetRepoSetting(RepoSetting{Repo: "o/app", Key: "a", Value: "1"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.SetTagPatterns("o/app", "release", "v*"); err != nil {
+			t.Fatal(err)
+		}
+		if err := repo.DeleteCodeRepo("o/app"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.GetCodeRepo("o/app"); !errors.Is(err, ErrRepoNotRegistered) {
+			t.Errorf("GetCodeRepo after deleting = %v, want ErrRepoNotRegistered", err)
+		}
+		if jobs, err := repo.ListJob(JobFilter{Repo: "o/app"}); err != nil || len(jobs) != 0 {
+			t.Errorf("runs after deleting = %d, %v; want none", len(jobs), err)
+		}
+		if settings, err := repo.ListRepoSettings("o/app"); err != nil || len(settings) != 0 {
+			t.Errorf("settings after deleting = %+v, %v; want none", settings, err)
+		}
+		if patterns, err := repo.TagPatterns("o/app", "release"); err != nil || patterns != "" {
+			t.Errorf("tag patterns after deleting = %q, %v; want none", patterns, err)
+		}
+		if h, err := repo.GetRepoHealth("o/app"); err != nil || h.State != "" {
+			t.Errorf("health after deleting = %+v, %v; want none", h, err)
+		}
+		if got, err := repo.ListCodeRepos(); err != nil || !reflect.DeepEqual(got, []CodeRepo{lib}) {
+			t.Errorf("repos after deleting = %+v, %v; want %+v", got, err, []CodeRepo{lib})
+		}
+	})
+}
+
+func TestDialectIsUniqueViolation(t *testing.T) {
+	repo := newTestRepo(t)
+	job, err := repo.CreateJob(Job{Repo: "o/app", Name: "build", Branch: "main", SHA: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// What a host numbering the same attempt at once runs into.
+	_, err = repo.exec(`INSERT INTO jobs (repo, name, branch, sha, attempt, start_at, status, msg, trigger, owner, ref_type)
+		VALUES (?, ?, ?, ?, ?, ?, ?, '', ?, '', ?)`,
+		job.Repo, job.Name, job.Branch, job.SHA, job.Attempt, repo.d.timeArg(time.Now()), StatusPending, TriggerPoll, RefBranch)
+	if !repo.d.isUniqueViolation(err) {
+		t.Errorf("isUniqueViolation(%v) = false, want true", err)
+	}
+	if repo.d.isUniqueViolation(errors.New("database is locked")) {
+		t.Error("isUniqueViolation of another error = true")
+	}
+}
@@ -1,13 +1,17 @@
 package core
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strings"
 )
 
-func InitRoot(path string) error {
+// InitRoot creates the root layout and the jobs schema. An empty dbCfg.Kind
+// means the sqlite database at <root>/refci.db.
+func InitRoot(path string, dbCfg DBConfig) error {
 	root, err := resolveRootPath(path)
 	if err != nil {
 		return err
@@ -24,23 +28,59 @@ func InitRoot(path string) error {
 		}
 	}
 
-	dbPath := filepath.Join(root, "refci.db")
-	db, err := OpenDB(DBConfig{
-		Kind:       DBSQLite,
-		SQLitePath: dbPath,
-	})
+	cfg := dbCfg
+	if cfg.Kind == "" {
+		cfg.Kind = DBSQLite
+	}
+	if cfg.Kind == DBSQLite && strings.TrimSpace(cfg.SQLitePath) == "" {
+		cfg.SQLitePath = filepath.Join(root, "refci.db")
+	}
+
+	db, err := OpenDB(cfg)
 	if err != nil {
-		return fmt.Errorf("open sqlite db %q: %w", dbPath, err)
+		return fmt.Errorf("open %s db: %w", cfg.Kind, err)
 	}
 	defer db.Close()
 
-	if _, err := NewSQLiteRepo(db); err != nil {
-		return fmt.Errorf("init sqlite schema: %w", err)
+	if _, err := NewDbRepo(db, cfg.Kind); err != nil {
+		return fmt.Errorf("init %s schema: %w", cfg.Kind, err)
+	}
+
+	if cfg.Kind == DBPostgres {
+		// The dsn file marks the root and lets later commands find the db.
+		dsnPath := filepath.Join(root, PostgresDSNFile)
+		if err := os.WriteFile(dsnPath, []byte(strings.TrimSpace(cfg.PostgresDSN)+"\n"), 0o600); err != nil {
+			return fmt.Errorf("write %s: %w", dsnPath, err)
+		}
 	}
 
 	return nil
 }
 
+// RootDBConfig resolves the database for an initialized root. The
+// REFCI_POSTGRES_DSN env var wins, then <root>/postgres.dsn, then the
+// sqlite database at <root>/refci.db.
+func RootDBConfig(root string) (DBConfig, error) {
+	if dsn := strings.TrimSpace(os.Getenv(PostgresDSNEnv)); dsn != "" {
+		return DBConfig{Kind: DBPostgres, PostgresDSN: dsn}, nil
+	}
+
+	dsnPath := filepath.Join(root, PostgresDSNFile)
+	b, err := os.ReadFile(dsnPath)
+	if err == nil {
+		dsn := strings.TrimSpace(string(b))
+		if dsn == "" {
+			return DBConfig{}, fmt.Errorf("empty postgres dsn in %s", dsnPath)
+		}
+		return DBConfig{Kind: DBPostgres, PostgresDSN: dsn}, nil
+	}
+	if !os.IsNotExist(err) {
+		return DBConfig{}, fmt.Errorf("read %s: %w", dsnPath, err)
+	}
+
+	return DBConfig{Kind: DBSQLite, SQLitePath: filepath.Join(root, "refci.db")}, nil
+}
+
 func resolveRootPath(path string) (string, error) {
 	p := strings.TrimSpace(path)
 	if p == "" {
@@ -60,3 +100,109 @@ func resolveRootPath(path string) (string, error) {
 
 	return p, nil
 }
+
+// legacyLocalRepo is the directory name older refci versions gave repo
+// under repos/, worktrees/ and logs/, before ToLocalRepo escaped anything.
+func legacyLocalRepo(repo string) string {
+	return strings.ReplaceAll(repo, "/", "--")
+}
+
+// MoveLegacyRepoDirs moves the mirrors and logs of repos still under their
+// legacyLocalRepo name to their ToLocalRepo one, along with the log paths
+// of their runs. Their worktrees are removed instead; the pool adds them
+// again. Repos are the registered ones and those with a mirror.
+func MoveLegacyRepoDirs(ctx context.Context, dbRepo DbRepo) error {
+	codeRepos, err := dbRepo.ListCodeRepos()
+	if err != nil {
+		return err
+	}
+	registered := map[string]bool{}
+	for _, cr := range codeRepos {
+		registered[cr.Repo] = true
+	}
+	repos := map[string]bool{}
+	for repo := range registered {
+		repos[repo] = true
+	}
+	if mirrors, err := ListMirrors(); err == nil {
+		for _, repo := range mirrors {
+			repos[repo] = true
+		}
+	}
+
+	var errs []error
+	for repo := range repos {
+		legacy := legacyLocalRepo(repo)
+		if legacy == ToLocalRepo(repo) {
+			continue
+		}
+		if other := FromLocalRepo(legacy); other != repo && registered[other] {
+			// That is the dir of another repo now, e.g. o/my/app's and
+			// not o/my--app's.
+			continue
+		}
+		if err := moveLegacyRepoDir(ctx, dbRepo, repo); err != nil {
+			errs = append(errs, fmt.Errorf("move dirs of %s: %w", repo, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func moveLegacyRepoDir(ctx context.Context, dbRepo DbRepo, repo string) error {
+	legacy, dir := legacyLocalRepo(repo), ToLocalRepo(repo)
+
+	// Worktrees first: their .git files point into the mirror.
+	if err := os.RemoveAll(filepath.Join(Root, "worktrees", legacy)); err != nil {
+		return err
+	}
+	_ = os.Remove(filepath.Join(Root, "worktrees", legacy+".lock"))
+
+	mirrorPath := filepath.Join(Root, "repos", dir)
+	moved, err := moveDir(filepath.Join(Root, "repos", legacy), mirrorPath)
+	if err != nil {
+		return err
+	}
+	if moved {
+		if err := runGit(ctx, mirrorPath, "worktree", "prune"); err != nil {
+			return err
+		}
+	}
+
+	oldLogs, newLogs := filepath.Join(Root, "logs", legacy), filepath.Join(Root, "logs", dir)
+	moved, err = moveDir(oldLogs, newLogs)
+	if err != nil || !moved {
+		return err
+	}
+	jobs, err := dbRepo.ListJob(JobFilter{Repo: repo})
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		rest, ok := strings.CutPrefix(job.LogPath, oldLogs+string(filepath.Separator))
+		if !ok {
+			continue
+		}
+		if err := dbRepo.SetJobLogPath(job.ID, filepath.Join(newLogs, rest)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveDir renames from to to unless to already exists, and reports whether
+// it did.
+func moveDir(from, to string) (bool, error) {
+	if _, err := os.Stat(from); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	if _, err := os.Stat(to); err == nil {
+		return false, nil
+	}
+	if err := os.Rename(from, to); err != nil {
+		return false, fmt.Errorf("move %s: %w", from, err)
+	}
+	return true, nil
+}
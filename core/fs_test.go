@@ -0,0 +1,85 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMoveLegacyRepoDirs(t *testing.T) {
+	oldRoot := Root
+	Root = t.TempDir()
+	t.Cleanup(func() { Root = oldRoot })
+	ctx := context.Background()
+	dbRepo := newTestRepo(t)
+
+	// o/my--app, registered, with a mirror, a worktree and a log under the
+	// names older versions gave them; host:2222/team/app only has a mirror.
+	legacyMirror := filepath.Join(Root, "repos", "o--my--app")
+	testGit(t, "", "init", "-q", legacyMirror)
+	testGit(t, legacyMirror, "commit", "-q", "--allow-empty", "-m", "first")
+	legacyWorktree := filepath.Join(Root, "worktrees", "o--my--app", "main", "1")
+	testGit(t, legacyMirror, "worktree", "add", "-q", "--detach", legacyWorktree)
+	legacyLog := filepath.Join(Root, "logs", "o--my--app", "build.log")
+	if err := os.MkdirAll(filepath.Dir(legacyLog), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacyLog, []byte("ok\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := dbRepo.SaveCodeRepo(CodeRepo{Repo: "o/my--app", URL: "https://github.com/o/my--app"}); err != nil {
+		t.Fatal(err)
+	}
+	job, err := dbRepo.CreateJob(Job{Repo: "o/my--app", Name: "build", Branch: "main", SHA: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dbRepo.SetJobLogPath(job.ID, legacyLog); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, "", "init", "-q", filepath.Join(Root, "repos", "host:2222--team--app"))
+
+	if err := MoveLegacyRepoDirs(ctx, dbRepo); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{legacyMirror, legacyWorktree, filepath.Dir(legacyLog), filepath.Join(Root, "repos", "host:2222--team--app")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s is still there", path)
+		}
+	}
+	mirror := filepath.Join(Root, "repos", ToLocalRepo("o/my--app"))
+	if worktrees := testGit(t, mirror, "worktree", "list"); strings.Count(worktrees, "\n") != 0 {
+		t.Errorf("mirror still has worktrees:\n%s", worktrees)
+	}
+	if _, err := os.Stat(filepath.Join(Root, "repos", ToLocalRepo("host:2222/team/app"))); err != nil {
+		t.Error(err)
+	}
+	got, err := dbRepo.GetJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(Root, "logs", ToLocalRepo("o/my--app"), "build.log"); got.LogPath != want {
+		t.Errorf("log path = %q, want %q", got.LogPath, want)
+	}
+	if b, err := os.ReadFile(got.LogPath); err != nil || string(b) != "ok\n" {
+		t.Errorf("log = %q, %v", b, err)
+	}
+
+	// A dir that is another registered repo's now stays where it is.
+	if err := dbRepo.SaveCodeRepo(CodeRepo{Repo: "o/my/app", URL: "/srv/o/my/app"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.RemoveAll(mirror); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, "", "init", "-q", legacyMirror)
+	if err := MoveLegacyRepoDirs(ctx, dbRepo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(legacyMirror); err != nil {
+		t.Errorf("mirror of o/my/app moved: %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// GCReport is what one GC pass over a repo did.
+type GCReport struct {
+	Repo             string
+	CanceledRuns     []int64  // active runs on deleted branches, canceled
+	ActiveRuns       []int64  // active runs on deleted branches owned by another refci process
+	RemovedWorktrees []string // worktree paths removed
+	BusyWorktrees    []string // worktrees of deleted branches still in use, left for a later pass
+	ReclaimedBytes   int64
+}
+
+// GCRepo cleans up after branches and other refs that no longer exist in
+// repo's mirror, so fetch the mirror first. Pending and running runs on
+// those refs are canceled if runner owns them (runner may be nil), their
+// worktrees are removed, and stale worktree metadata is pruned from the
+// mirror. Tags run once, so their idle worktrees are removed too.
+func GCRepo(ctx context.Context, dbRepo DbRepo, runner *JobRunner, repo string) (GCReport, error) {
+	report := GCReport{Repo: repo}
+	repoPart := ToLocalRepo(strings.TrimSpace(repo))
+	mirrorPath := filepath.Join(Root, "repos", repoPart)
+
+	refs, err := ListRefHeads(ctx, mirrorPath, "refs")
+	if err != nil {
+		return report, err
+	}
+	live := make(map[string]bool, len(refs))     // as recorded in Job.Branch
+	liveDirs := make(map[string]bool, len(refs)) // worktree pools to keep
+	for ref := range refs {
+		if branch, ok := strings.CutPrefix(ref, "refs/heads/"); ok {
+			ref = branch
+		}
+		live[ref] = true
+		if RefTypeOf(ref) != RefTag {
+			liveDirs[toLocalBranch(ref)] = true
+		}
+	}
+
+	for _, status := range []string{StatusPending, StatusRunning} {
+		jobs, err := dbRepo.ListJob(JobFilter{Repo: repo, Status: status})
+		if err != nil {
+			return report, err
+		}
+		for _, job := range jobs {
+			if live[job.Branch] {
+				continue
+			}
+			if runner == nil || !runner.IsRunning(job.ID) {
+				report.ActiveRuns = append(report.ActiveRuns, job.ID)
+				continue
+			}
+			if err := runner.Cancel(job.ID); err != nil {
+				return report, fmt.Errorf("cancel run %d: %w", job.ID, err)
+			}
+			// Let it exit and give back its worktree before removing it.
+			if _, err := runner.Wait(ctx, job.ID); err != nil {
+				return report, err
+			}
+			if final, err := dbRepo.GetJob(job.ID); err == nil && final.Status == StatusCanceled {
+				_ = dbRepo.UpdateJob(job.ID, StatusCanceled, job.RefType+" deleted")
+			}
+			report.CanceledRuns = append(report.CanceledRuns, job.ID)
+		}
+	}
+
+	// Keep AcquireWorktree from handing out slots while they are removed.
+	repoLock, err := lockFile(filepath.Join(Root, "worktrees", repoPart+".lock"), true)
+	if err != nil {
+		return report, err
+	}
+	defer func() {
+		_ = syscall.Flock(int(repoLock.Fd()), syscall.LOCK_UN)
+		_ = repoLock.Close()
+	}()
+
+	repoDir := filepath.Join(Root, "worktrees", repoPart)
+	entries, err := os.ReadDir(repoDir)
+	if err != nil && !os.IsNotExist(err) {
+		return report, fmt.Errorf("read worktrees: %w", err)
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() || liveDirs[e.Name()] {
+			continue
+		}
+		if err := gcBranchDir(ctx, mirrorPath, filepath.Join(repoDir, e.Name()), &report); err != nil {
+			return report, err
+		}
+	}
+
+	if err := runGit(ctx, mirrorPath, "worktree", "prune"); err != nil {
+		return report, err
+	}
+	return report, nil
+}
+
+// gcBranchDir removes the worktree pool of one deleted branch. Slots still
+// leased are left alone.
+func gcBranchDir(ctx context.Context, mirrorPath, branchDir string, report *GCReport) error {
+	if _, err := os.Stat(filepath.Join(branchDir, ".git")); err == nil {
+		// Shared worktree of an older refci version.
+		return gcRemove(ctx, mirrorPath, branchDir, report)
+	}
+
+	entries, err := os.ReadDir(branchDir)
+	if err != nil {
+		return fmt.Errorf("read worktrees: %w", err)
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		slot := filepath.Join(branchDir, e.Name())
+		lock, err := lockFile(slot+".lock", false)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			report.BusyWorktrees = append(report.BusyWorktrees, slot)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		err = gcRemove(ctx, mirrorPath, slot, report)
+		if err == nil {
+			_ = os.Remove(slot + ".lock")
+		}
+		_ = syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+		_ = lock.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Fails, as it should, while busy slots are left.
+	_ = os.Remove(branchDir)
+	return nil
+}
+
+func gcRemove(ctx context.Context, mirrorPath, path string, report *GCReport) error {
+	size := dirSize(path)
+	if err := removeWorktree(ctx, mirrorPath, path); err != nil {
+		return err
+	}
+	report.RemovedWorktrees = append(report.RemovedWorktrees, path)
+	report.ReclaimedBytes += size
+	return nil
+}
+
+// dirSize is the total size of the regular files under path.
+func dirSize(path string) int64 {
+	var total int64
+	_ = filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	return total
+}
+
+// ListMirrors returns the repos with a mirror under <root>/repos.
+func ListMirrors() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(Root, "repos"))
+	if err != nil {
+		return nil, fmt.Errorf("read repos: %w", err)
+	}
+	var repos []string
+	for _, e := range entries {
+		if e.IsDir() {
+			repos = append(repos, FromLocalRepo(e.Name()))
+		}
+	}
+	sort.Strings(repos)
+	return repos, nil
+}
@@ -0,0 +1,115 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestGCRepo(t *testing.T) {
+	sha := testMirror(t, "o/app", map[string]string{"a.txt": "a\n"})
+	mirror := filepath.Join(Root, "repos", ToLocalRepo("o/app"))
+	testGit(t, mirror, "branch", "-M", "main")
+	testGit(t, mirror, "branch", "gone")
+	testGit(t, mirror, "tag", "v1")
+	ctx := context.Background()
+
+	acquire := func(branch string) *Worktree {
+		t.Helper()
+		wt, err := AcquireWorktree(ctx, "o/app", branch, sha, CleanAll)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wt
+	}
+	mainWT := acquire("main")
+	mainWT.Release()
+	goneIdle := acquire("gone")
+	goneBusy := acquire("gone")
+	defer goneBusy.Release()
+	goneIdle.Release()
+	tagWT := acquire("refs/tags/v1")
+	tagWT.Release()
+
+	dbRepo := newTestRepo(t)
+	runner := NewJobRunner(dbRepo)
+	work := t.TempDir()
+	if err := os.WriteFile(filepath.Join(work, "slow.sh"), []byte("sleep 30\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	mine, err := runner.Start(ctx, RunJobRequest{Repo: "o/app", Name: "slow", Branch: "gone", SHA: sha, ScriptPath: "slow.sh", WorkDir: work})
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := dbRepo.CreateJob(Job{Repo: "o/app", Name: "other", Branch: "gone", SHA: sha})
+	if err != nil {
+		t.Fatal(err)
+	}
+	onMain, err := dbRepo.CreateJob(Job{Repo: "o/app", Name: "other", Branch: "main", SHA: sha})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, mirror, "branch", "-D", "gone")
+
+	gcCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	report, err := GCRepo(gcCtx, dbRepo, runner, "o/app")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(report.CanceledRuns, []int64{mine.ID}) {
+		t.Errorf("canceled %v, want #%d", report.CanceledRuns, mine.ID)
+	}
+	if !reflect.DeepEqual(report.ActiveRuns, []int64{theirs.ID}) {
+		t.Errorf("left %v to their owner, want #%d", report.ActiveRuns, theirs.ID)
+	}
+	if run, err := dbRepo.GetJob(mine.ID); err != nil || run.Status != StatusCanceled || run.Msg != "branch deleted" {
+		t.Errorf("canceled run = %+v, %v; want canceled, branch deleted", run, err)
+	}
+	if run, err := dbRepo.GetJob(onMain.ID); err != nil || run.Status != StatusPending {
+		t.Errorf("run on main = %+v, %v; want it left pending", run, err)
+	}
+
+	removed := append([]string{}, report.RemovedWorktrees...)
+	sort.Strings(removed)
+	if want := []string{goneIdle.Path, tagWT.Path}; !reflect.DeepEqual(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+	if !reflect.DeepEqual(report.BusyWorktrees, []string{goneBusy.Path}) {
+		t.Errorf("busy %v, want %v", report.BusyWorktrees, goneBusy.Path)
+	}
+	if report.ReclaimedBytes <= 0 {
+		t.Errorf("reclaimed %d bytes", report.ReclaimedBytes)
+	}
+	for path, want := range map[string]bool{mainWT.Path: true, goneBusy.Path: true, goneIdle.Path: false, tagWT.Path: false} {
+		if _, err := os.Stat(path); (err == nil) != want {
+			t.Errorf("%s exists = %v, want %v", path, err == nil, want)
+		}
+	}
+}
+
+func TestListMirrors(t *testing.T) {
+	oldRoot := Root
+	Root = t.TempDir()
+	t.Cleanup(func() { Root = oldRoot })
+	for _, repo := range []string{"o/app", "gitlab.com/g/sub/app", "o/my--app"} {
+		if err := os.MkdirAll(filepath.Join(Root, "repos", ToLocalRepo(repo)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(Root, "repos", "stray"), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ListMirrors()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"gitlab.com/g/sub/app", "o/app", "o/my--app"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ListMirrors = %q, want %q", got, want)
+	}
+}
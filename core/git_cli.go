@@ -2,6 +2,7 @@ package core
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -44,96 +45,155 @@ func FetchMirror(ctx context.Context, mirrorPath string) error {
 	return runGit(ctx, path, "fetch", "--prune", "origin")
 }
 
-func EnsureWorktree(ctx context.Context, repo, branch, sha string) (string, error) {
-	repoPart := ToLocalRepo(strings.TrimSpace(repo))
-	mirrorPath := filepath.Join(Root, "repos", repoPart)
-	branchPart := toLocalBranch(branch)
-	worktreePath := filepath.Join(Root, "worktrees", repoPart, branchPart)
-	if err := os.MkdirAll(filepath.Dir(worktreePath), 0o755); err != nil {
-		return "", fmt.Errorf("create worktree parent dir: %w", err)
+// MirrorURL returns the origin URL a mirror was cloned from.
+func MirrorURL(ctx context.Context, mirrorPath string) (string, error) {
+	out, err := runGitOutput(ctx, mirrorPath, "config", "--get", "remote.origin.url")
+	if err != nil {
+		return "", fmt.Errorf("read mirror url: %w", err)
 	}
+	return strings.TrimSpace(out), nil
+}
 
-	shaValue := strings.TrimSpace(sha)
-	if _, err := os.Stat(worktreePath); os.IsNotExist(err) {
-		if err := runGit(ctx, mirrorPath, "worktree", "add", "--detach", worktreePath, shaValue); err != nil {
-			return "", err
-		}
-		return worktreePath, nil
-	} else if err != nil {
-		return "", fmt.Errorf("stat worktree path: %w", err)
+// SetMirrorURL points the origin a mirror fetches from at url.
+func SetMirrorURL(ctx context.Context, mirrorPath, url string) error {
+	if err := runGit(ctx, mirrorPath, "remote", "set-url", "origin", url); err != nil {
+		return fmt.Errorf("set mirror url: %w", err)
+	}
+	return nil
+}
+
+// FileExistsAtCommit reports whether path (repo-relative) is in the tree of sha.
+func FileExistsAtCommit(ctx context.Context, repo, sha, path string) (bool, error) {
+	if repo == "" {
+		return false, fmt.Errorf("repo is required")
 	}
 
-	if err := runGit(ctx, worktreePath, "reset", "--hard", shaValue); err != nil {
-		return "", err
+	mirrorPath := filepath.Join(Root, "repos", ToLocalRepo(repo))
+	rel := strings.TrimPrefix(filepath.ToSlash(filepath.Clean(path)), "./")
+	cmd := exec.CommandContext(ctx, "git", "cat-file", "-e", sha+":"+rel)
+	cmd.Dir = mirrorPath
+	if err := cmd.Run(); err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return false, nil
+		}
+		return false, fmt.Errorf("git cat-file: %w", err)
 	}
-	return worktreePath, nil
+	return true, nil
 }
 
+// ListBranchHeads returns the head sha of every branch in the mirror, keyed
+// by branch name.
 func ListBranchHeads(ctx context.Context, mirrorPath string) (map[string]string, error) {
+	refs, err := ListRefHeads(ctx, mirrorPath, "refs/heads")
+	if err != nil {
+		return nil, err
+	}
+	heads := make(map[string]string, len(refs))
+	for ref, sha := range refs {
+		heads[strings.TrimPrefix(ref, "refs/heads/")] = sha
+	}
+	return heads, nil
+}
+
+// ListRefHeads returns the commit every ref under namespace (e.g. refs/tags
+// or refs/pull) points at, keyed by full ref. Annotated tags are peeled to
+// their commit; refs to anything but a commit are left out.
+func ListRefHeads(ctx context.Context, mirrorPath, namespace string) (map[string]string, error) {
 	path := strings.TrimSpace(mirrorPath)
 	if path == "" {
 		return nil, fmt.Errorf("mirror path is required")
 	}
+	ns := strings.TrimSuffix(strings.TrimSpace(namespace), "/")
+	if ns != "refs" && !strings.HasPrefix(ns, "refs/") {
+		return nil, fmt.Errorf("ref namespace must start with refs/: %q", namespace)
+	}
 
 	out, err := runGitOutput(
 		ctx,
 		path,
 		"for-each-ref",
-		"refs/heads",
-		"--format=%(refname:short)\t%(objectname)",
+		ns+"/",
+		"--format=%(refname)\t%(objecttype)\t%(objectname)\t%(*objecttype)\t%(*objectname)",
 	)
 	if err != nil {
 		return nil, err
 	}
 
 	heads := map[string]string{}
-	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
-		row := strings.TrimSpace(line)
-		if row == "" {
+	for _, row := range strings.Split(out, "\n") {
+		// Not trimmed: the peeled fields are empty for anything but a tag.
+		if strings.TrimSpace(row) == "" {
 			continue
 		}
-		parts := strings.SplitN(row, "\t", 2)
-		if len(parts) != 2 {
+		parts := strings.Split(row, "\t")
+		if len(parts) != 5 || parts[0] == "" {
 			return nil, fmt.Errorf("invalid git ref row: %q", row)
 		}
 
-		branch := strings.TrimSpace(parts[0])
-		sha := strings.TrimSpace(parts[1])
-		if branch == "" || sha == "" {
-			return nil, fmt.Errorf("invalid git ref row: %q", row)
+		ref := parts[0]
+		switch {
+		case parts[1] == "commit" && parts[2] != "":
+			heads[ref] = parts[2]
+		case parts[1] == "tag" && parts[3] == "commit" && parts[4] != "":
+			heads[ref] = parts[4]
 		}
-		heads[branch] = sha
 	}
 
 	return heads, nil
 }
 
-func ListBranchHeadsByPattern(ctx context.Context, repo, branchPattern string) (map[string]string, error) {
+// ListJobRefs returns the refs jc triggers on with the commit each points at,
+// keyed the way runs record them (see Job.Branch): branches matching
+// BranchPatterns by name, tags matching TagPatterns and refs matching
+// RefPatterns by full ref. A job with none of the patterns runs on every
+// branch; one with only tag or ref patterns runs on no branch.
+func ListJobRefs(ctx context.Context, repo string, jc JobConf) (map[string]string, error) {
 	repoName := strings.TrimSpace(repo)
 	if repoName == "" {
 		return nil, fmt.Errorf("repo is required")
 	}
 
-	pattern := normalizeBranchPattern(branchPattern)
-	if strings.Contains(pattern, "*") && !strings.HasSuffix(pattern, "*") {
-		return nil, fmt.Errorf("only trailing wildcard is supported: %q", branchPattern)
-	}
-
 	mirrorPath := filepath.Join(Root, "repos", ToLocalRepo(repoName))
-	heads, err := ListBranchHeads(ctx, mirrorPath)
+	refs, err := ListRefHeads(ctx, mirrorPath, "refs")
 	if err != nil {
 		return nil, err
 	}
 
+	onBranches := len(jc.BranchPatterns) > 0 || (len(jc.TagPatterns) == 0 && len(jc.RefPatterns) == 0)
 	out := map[string]string{}
-	for branch, sha := range heads {
-		if branchMatchesPattern(branch, pattern) {
-			out[branch] = sha
+	for ref, sha := range refs {
+		name := ref
+		matched := false
+		if branch, ok := strings.CutPrefix(ref, "refs/heads/"); ok {
+			name = branch
+			matched = onBranches && matchBranchPatterns(jc.BranchPatterns, branch)
+		} else if tag, ok := strings.CutPrefix(ref, "refs/tags/"); ok {
+			matched = len(jc.TagPatterns) > 0 && matchPatterns(jc.TagPatterns, tag)
+		}
+		if !matched && len(jc.RefPatterns) > 0 {
+			matched = matchPatterns(jc.RefPatterns, ref)
+		}
+		if matched {
+			out[name] = sha
 		}
 	}
 	return out, nil
 }
 
+// TagPatternsKey is the tag_pattern and ref_pattern of jc, which decide the
+// tags it runs on, as one string; "" when it has neither.
+func TagPatternsKey(jc JobConf) string {
+	var keys []string
+	for _, p := range jc.TagPatterns {
+		keys = append(keys, "tag:"+p)
+	}
+	for _, p := range jc.RefPatterns {
+		keys = append(keys, "ref:"+p)
+	}
+	return strings.Join(keys, "\n")
+}
+
 func ShouldRunByPathPatterns(ctx context.Context, repo, prevSHA, newSHA string, patterns []string) (bool, error) {
 	if len(patterns) == 0 {
 		return true, nil
@@ -178,13 +238,50 @@ func LoadJobConfsFromRepo(ctx context.Context, repo, ref string) ([]JobConf, err
 		return nil, err
 	}
 
-	confs := ParseJobConfs(content)
+	confs, err := ParseJobConfs(content)
+	if errs, ok := err.(ConfErrors); ok {
+		return nil, errs.inFile(repoName + "@" + rev + ":.refci/conf.yml")
+	} else if err != nil {
+		return nil, err
+	}
 	for i := range confs {
 		confs[i].Repo = repoName
 	}
 	return confs, nil
 }
 
+// ResolveCommit expands rev (a branch, tag or possibly short sha) to the full
+// commit sha in repo's mirror.
+func ResolveCommit(ctx context.Context, repo, rev string) (string, error) {
+	if repo == "" {
+		return "", fmt.Errorf("repo is required")
+	}
+	if strings.TrimSpace(rev) == "" {
+		return "", fmt.Errorf("rev is required")
+	}
+
+	mirrorPath := filepath.Join(Root, "repos", ToLocalRepo(repo))
+	out, err := runGitOutput(ctx, mirrorPath, "rev-parse", "--verify", "--quiet", strings.TrimSpace(rev)+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("unknown commit %q in %s", rev, repo)
+	}
+	return strings.TrimSpace(out), nil
+}
+
+// DefaultBranch returns the branch the mirror's HEAD points at.
+func DefaultBranch(ctx context.Context, repo string) (string, error) {
+	if repo == "" {
+		return "", fmt.Errorf("repo is required")
+	}
+
+	mirrorPath := filepath.Join(Root, "repos", ToLocalRepo(repo))
+	out, err := runGitOutput(ctx, mirrorPath, "symbolic-ref", "--short", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
 func ListChangedFiles(ctx context.Context, repo, oldSHA, newSHA string) ([]string, error) {
 	if repo == "" {
 		return nil, fmt.Errorf("repo is required")
@@ -211,34 +308,143 @@ func ListChangedFiles(ctx context.Context, repo, oldSHA, newSHA string) ([]strin
 	return files, nil
 }
 
+// ListFiles lists every file tracked at sha.
+func ListFiles(ctx context.Context, repo, sha string) ([]string, error) {
+	if repo == "" {
+		return nil, fmt.Errorf("repo is required")
+	}
+
+	mirrorPath := filepath.Join(Root, "repos", ToLocalRepo(repo))
+	out, err := runGitOutput(ctx, mirrorPath, "ls-tree", "-r", "--name-only", sha)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, line := range strings.Split(out, "\n") {
+		if line != "" {
+			files = append(files, line)
+		}
+	}
+	return files, nil
+}
+
+// normalizeBranchPattern trims pattern and the refs/heads/ prefix of a full
+// branch ref, keeping a leading ! in place.
 func normalizeBranchPattern(pattern string) string {
+	return normalizePattern(pattern, "refs/heads/")
+}
+
+// normalizeTagPattern is normalizeBranchPattern for tags.
+func normalizeTagPattern(pattern string) string {
+	return normalizePattern(pattern, "refs/tags/")
+}
+
+func normalizePattern(pattern, refPrefix string) string {
 	p := strings.TrimSpace(pattern)
-	p = strings.TrimPrefix(p, "refs/heads/")
-	if p == "" {
-		return "*"
+	p, neg := strings.CutPrefix(p, "!")
+	p = strings.TrimPrefix(p, refPrefix)
+	if neg {
+		return "!" + p
 	}
 	return p
 }
 
-func branchMatchesPattern(branch, pattern string) bool {
-	if pattern == "*" {
+// ValidateBranchPattern reports whether pattern can match branch names. A
+// pattern is matched one /-separated segment at a time: * and ? stay within
+// a segment, [...] is a character class, a ** segment matches any number of
+// segments, and a leading ! excludes what it matches (see matchPatterns).
+// A trailing * also matches below it (see matchBranchPatterns).
+func ValidateBranchPattern(pattern string) error {
+	p := strings.TrimPrefix(normalizeBranchPattern(pattern), "!")
+	if p == "" {
+		return fmt.Errorf("empty pattern: %q", pattern)
+	}
+	return validateRefGlob(p, pattern)
+}
+
+// ValidateTagPattern reports whether pattern can match tag names, with the
+// same syntax as a branch pattern.
+func ValidateTagPattern(pattern string) error {
+	p := strings.TrimPrefix(normalizeTagPattern(pattern), "!")
+	if p == "" {
+		return fmt.Errorf("empty pattern: %q", pattern)
+	}
+	return validateRefGlob(p, pattern)
+}
+
+// ValidateRefPattern reports whether pattern can match full refs such as
+// refs/pull/7/head: the same syntax as a branch pattern, starting with refs/.
+func ValidateRefPattern(pattern string) error {
+	p := strings.TrimPrefix(strings.TrimSpace(pattern), "!")
+	if !strings.HasPrefix(p, "refs/") || p == "refs/" {
+		return fmt.Errorf("must be a full ref starting with refs/: %q", pattern)
+	}
+	return validateRefGlob(p, pattern)
+}
+
+// validateRefGlob rejects what can't be in a ref name, other than the glob
+// characters, and malformed character classes.
+func validateRefGlob(p, pattern string) error {
+	switch {
+	case strings.ContainsAny(p, " \t~^:\\"):
+		return fmt.Errorf("invalid character in %q", pattern)
+	case strings.Contains(p, ".."), strings.Contains(p, "//"), strings.HasPrefix(p, "/"), strings.HasPrefix(p, "-"):
+		return fmt.Errorf("not a valid ref pattern: %q", pattern)
+	}
+	for _, seg := range strings.Split(p, "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return fmt.Errorf("invalid pattern segment %q in %q", seg, pattern)
+		}
+	}
+	return nil
+}
+
+// matchPatterns reports whether target, a /-separated branch, ref or file
+// path, is selected by patterns. Patterns apply in order and the last one
+// that matches decides: a plain pattern selects target, a !pattern excludes
+// it. When the first pattern is an exclusion, everything starts selected,
+// so [!main] is every branch but main. No patterns select everything.
+func matchPatterns(patterns []string, target string) bool {
+	if len(patterns) == 0 {
 		return true
 	}
-	if strings.HasSuffix(pattern, "*") {
-		prefix := strings.TrimSuffix(pattern, "*")
-		return strings.HasPrefix(branch, prefix)
+	selected := strings.HasPrefix(patterns[0], "!")
+	for _, p := range patterns {
+		p, neg := strings.CutPrefix(p, "!")
+		if matchPathPattern(p, target) {
+			selected = !neg
+		}
 	}
-	return branch == pattern
+	return selected
 }
 
-func matchAnyPathPattern(file string, patterns []string) bool {
-	target := normalizeRepoRelPath(file)
+// matchBranchPatterns is matchPatterns for branch names, where a pattern
+// ending in * also matches the branches below what it matches: feature-*
+// selects feature-x/y and * every branch, as branch patterns did when they
+// were plain prefixes. Tag, ref and path patterns don't do this.
+func matchBranchPatterns(patterns []string, branch string) bool {
+	expanded := make([]string, 0, len(patterns))
 	for _, p := range patterns {
-		if matchPathPattern(normalizeRepoRelPath(p), target) {
-			return true
+		expanded = append(expanded, p)
+		if strings.HasSuffix(p, "*") && !strings.HasSuffix(p, "**") {
+			// The same sign and place in the list: the pair acts as one.
+			expanded = append(expanded, p+"/**")
+		}
+	}
+	return matchPatterns(expanded, branch)
+}
+
+func matchAnyPathPattern(file string, patterns []string) bool {
+	normalized := make([]string, len(patterns))
+	for i, p := range patterns {
+		p, neg := strings.CutPrefix(strings.TrimSpace(p), "!")
+		normalized[i] = normalizeRepoRelPath(p)
+		if neg {
+			normalized[i] = "!" + normalized[i]
 		}
 	}
-	return false
+	return matchPatterns(normalized, normalizeRepoRelPath(file))
 }
 
 func normalizeRepoRelPath(v string) string {
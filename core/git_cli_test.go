@@ -0,0 +1,71 @@
+package core
+
+import "testing"
+
+func TestMatchBranchPatterns(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		branch   string
+		want     bool
+	}{
+		// Prefix patterns match as they did before globs: below them too.
+		{"star matches every branch", []string{"*"}, "main", true},
+		{"star matches nested branches", []string{"*"}, "feature/x", true},
+		{"trailing star matches a branch", []string{"feature-*"}, "feature-x", true},
+		{"trailing star matches below it", []string{"feature-*"}, "feature-x/y", true},
+		{"trailing star after a slash", []string{"release/*"}, "release/1.2/hotfix", true},
+		{"trailing star doesn't match other prefixes", []string{"feature-*"}, "fix-x/y", false},
+		{"exact name", []string{"main"}, "main", true},
+		{"exact name is not a prefix", []string{"main"}, "main/x", false},
+		{"no patterns match everything", nil, "any/thing", true},
+
+		// Globs inside a pattern stay within one segment.
+		{"inner star stays in its segment", []string{"release/*/hotfix"}, "release/1.2/hotfix", true},
+		{"inner star doesn't cross segments", []string{"release/*/hotfix"}, "release/1.2/x/hotfix", false},
+		{"question mark", []string{"v?"}, "v1", true},
+		{"question mark doesn't match below", []string{"v?"}, "v1/x", false},
+		{"character class", []string{"release-[0-9]"}, "release-7", true},
+		{"double star", []string{"release/**"}, "release/a/b", true},
+		{"double star in the middle", []string{"team/**/wip"}, "team/a/b/wip", true},
+
+		// Exclusions, where the last pattern that matches decides.
+		{"exclusion alone", []string{"!main"}, "dev", true},
+		{"exclusion alone excludes", []string{"!main"}, "main", false},
+		{"excluded prefix", []string{"!dependabot/*"}, "dependabot/npm/x", false},
+		{"excluded prefix keeps others", []string{"!dependabot/*"}, "main", true},
+		{"later pattern wins", []string{"release/**", "!release/old/**", "release/old/keep"}, "release/old/keep", true},
+		{"exclusion after inclusion", []string{"release/**", "!release/old/**", "release/old/keep"}, "release/old/x", false},
+		{"excluded star prefix", []string{"*", "!wip-*"}, "wip-a/b", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchBranchPatterns(tt.patterns, tt.branch); got != tt.want {
+				t.Errorf("matchBranchPatterns(%q, %q) = %v, want %v", tt.patterns, tt.branch, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchPatterns(t *testing.T) {
+	tests := []struct {
+		patterns []string
+		target   string
+		want     bool
+	}{
+		// Tag, ref and path patterns never match below a trailing star.
+		{[]string{"v*"}, "v1.0", true},
+		{[]string{"v*"}, "v1/rc", false},
+		{[]string{"refs/pull/*/head"}, "refs/pull/7/head", true},
+		{[]string{"refs/pull/*"}, "refs/pull/7/head", false},
+		{[]string{"src/*"}, "src/a/b.go", false},
+		{[]string{"src/**"}, "src/a/b.go", true},
+		{[]string{"**", "!docs/**"}, "docs/a.md", false},
+		{[]string{"**", "!docs/**"}, "main.go", true},
+	}
+	for _, tt := range tests {
+		if got := matchPatterns(tt.patterns, tt.target); got != tt.want {
+			t.Errorf("matchPatterns(%q, %q) = %v, want %v", tt.patterns, tt.target, got, tt.want)
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -15,13 +16,26 @@ import (
 )
 
 type RunJobRequest struct {
-	Repo       string
-	Name       string
-	Branch     string
-	SHA        string
-	ScriptPath string
-	WorkDir    string
-	Env        []string
+	Repo        string
+	Name        string
+	Branch      string
+	SHA         string
+	PrevSHA     string    // sha of the job's previous run on Branch, if any
+	ScriptPath  string    // relative to WorkDir
+	WorkDir     string    // when empty, a pooled worktree of SHA is leased for the run
+	Clean       CleanMode // how a reused pooled worktree is cleaned, CleanAll when empty
+	Env         []string
+	Trigger     string        // TriggerPoll when empty
+	MaxParallel int           // max concurrent runs of this job, 0 = no limit
+	Timeout     time.Duration // run time limit once started, 0 = no limit
+	Needs       []string      // jobs that must finish on the same repo/branch/sha first
+}
+
+// RunnerLimits bounds how many jobs a JobRunner runs at once. Zero means no
+// limit. Runs over a limit wait in the pending queue.
+type RunnerLimits struct {
+	MaxParallel int // across all repos
+	PerRepo     int // per repo
 }
 
 type JobRunner struct {
@@ -29,176 +43,585 @@ type JobRunner struct {
 	cancelGrace time.Duration
 
 	mu      sync.Mutex
-	running map[string]*runningJob
+	limits  RunnerLimits
+	running map[int64]*runningJob // pending and running runs owned by this runner
+	queue   []*runningJob         // pending runs, FIFO
+	recheck *time.Timer           // re-runs schedule while runs wait on needs
+	onEvent func(RunEvent)        // see SetEventHandler
+	closed  bool                  // set by Shutdown
 }
 
+const needsRecheckInterval = 2 * time.Second
+
 type runningJob struct {
-	cancel   context.CancelFunc
-	cmd      *exec.Cmd
-	done     chan struct{}
-	canceled atomic.Bool
+	job       Job
+	req       RunJobRequest
+	ctx       context.Context
+	cancel    context.CancelFunc
+	cmd       *exec.Cmd   // nil while pending
+	worktree  *Worktree   // leased at launch when req.WorkDir is empty
+	started   bool        // picked by the scheduler, guarded by JobRunner.mu
+	startedAt time.Time   // when the script started
+	timer     *time.Timer // enforces req.Timeout
+	done      chan struct{}
+	canceled  atomic.Bool
+	timedOut  atomic.Bool
 }
 
 func NewJobRunner(dbRepo DbRepo) *JobRunner {
 	return &JobRunner{
 		dbRepo:      dbRepo,
 		cancelGrace: 5 * time.Second,
-		running:     map[string]*runningJob{},
+		running:     map[int64]*runningJob{},
 	}
 }
 
+// SetLimits changes the concurrency limits; pending runs that now fit are
+// started right away.
+func (r *JobRunner) SetLimits(limits RunnerLimits) {
+	r.mu.Lock()
+	r.limits = limits
+	r.mu.Unlock()
+	r.schedule()
+}
+
+// QueueJob runs jobConf for branch at sha unless that sha already has a run.
 func (j *JobRunner) QueueJob(jobConf JobConf, envs []string, branch, sha string) error {
+	_, err := j.queueJob(jobConf, envs, branch, sha, TriggerPoll, false)
+	return err
+}
+
+// RerunJob starts a new attempt of jobConf for branch at sha, even if that
+// sha already ran. Any run of the job still active on branch is canceled.
+func (j *JobRunner) RerunJob(jobConf JobConf, envs []string, branch, sha, trigger string) (Job, error) {
+	return j.queueJob(jobConf, envs, branch, sha, trigger, true)
+}
+
+func (j *JobRunner) queueJob(jobConf JobConf, envs []string, branch, sha, trigger string, rerun bool) (Job, error) {
 	name := jobConf.Name
 	if name == "" {
-		return fmt.Errorf("job name is required")
+		return Job{}, fmt.Errorf("job name is required")
 	}
 
 	latestJob, err := j.dbRepo.LatestJobByNameBranch(jobConf.Repo, name, branch)
 	if err != nil {
-		return err
+		return Job{}, err
 	}
-	if latestJob.SHA == sha {
-		return nil
+	if latestJob.SHA == sha && !rerun {
+		return Job{}, nil
 	}
 
-	// sha is new
-	if latestJob.Status == StatusRunning || latestJob.Status == StatusPending {
-		if err = j.Cancel(latestJob.Repo, latestJob.Name, latestJob.Branch, latestJob.SHA); err != nil {
-			return err
+	// sha is new, or a re-run was asked for. Runs owned by another refci
+	// process can't be canceled from here.
+	if (latestJob.Status == StatusRunning || latestJob.Status == StatusPending) && j.IsRunning(latestJob.ID) {
+		if err = j.Cancel(latestJob.ID); err != nil {
+			return Job{}, err
 		}
 	}
 
-	workDir, err := EnsureWorktree(context.Background(), jobConf.Repo, branch, sha)
+	prevSHA, err := j.previousSHA(latestJob, sha)
 	if err != nil {
-		return err
-	}
-	scriptPath := filepath.Join(workDir, jobConf.ScriptPath)
-	if _, err := os.Stat(scriptPath); err != nil {
-		return fmt.Errorf("script not found: %s", scriptPath)
+		return Job{}, err
 	}
 
-	if _, err = j.Start(context.Background(), RunJobRequest{
-		Repo:       jobConf.Repo,
-		Name:       name,
-		Branch:     branch,
-		SHA:        sha,
-		ScriptPath: scriptPath,
-		WorkDir:    workDir,
-		Env:        envs,
-	}); err != nil {
-		return err
+	ok, err := FileExistsAtCommit(context.Background(), jobConf.Repo, sha, jobConf.ScriptPath)
+	if err != nil {
+		return Job{}, err
+	}
+	if !ok {
+		return Job{}, fmt.Errorf("script not found: %s at %s", jobConf.ScriptPath, ShortSHA(sha))
 	}
 
-	return nil
+	return j.Start(context.Background(), RunJobRequest{
+		Repo:        jobConf.Repo,
+		Name:        name,
+		Branch:      branch,
+		SHA:         sha,
+		PrevSHA:     prevSHA,
+		ScriptPath:  jobConf.ScriptPath,
+		Clean:       jobConf.Clean,
+		Env:         append(append([]string{}, envs...), MatrixEnv(jobConf.Matrix)...),
+		Trigger:     trigger,
+		MaxParallel: jobConf.MaxParallel,
+		Timeout:     jobConf.Timeout,
+		Needs:       jobConf.Needs,
+	})
 }
 
-func (r *JobRunner) Start(ctx context.Context, req RunJobRequest) (string, error) {
-	key := jobKey(req.Repo, req.Name, req.Branch, req.SHA)
+// previousSHA is the sha of the newest run of latest's job and branch that
+// isn't sha, the same one polling diffs against to match path_patterns.
+func (j *JobRunner) previousSHA(latest Job, sha string) (string, error) {
+	if latest.SHA != sha {
+		return latest.SHA, nil
+	}
+	jobs, err := j.dbRepo.ListJob(JobFilter{Repo: latest.Repo, Name: latest.Name, Branch: latest.Branch})
+	if err != nil {
+		return "", err
+	}
+	for _, job := range jobs {
+		if job.SHA != sha {
+			return job.SHA, nil
+		}
+	}
+	return "", nil
+}
+
+// Start records a new pending run and queues it. The run is launched as soon
+// as the runner limits allow, possibly before Start returns. The returned job
+// carries the run ID; its log will be at JobLogPath(job).
+func (r *JobRunner) Start(ctx context.Context, req RunJobRequest) (Job, error) {
 	r.mu.Lock()
-	if _, exists := r.running[key]; exists {
+	closed := r.closed
+	r.mu.Unlock()
+	if closed {
+		return Job{}, ErrRunnerShutdown
+	}
+
+	job, err := r.dbRepo.CreateJob(Job{
+		Repo:    req.Repo,
+		Name:    req.Name,
+		Branch:  req.Branch,
+		SHA:     req.SHA,
+		Trigger: req.Trigger,
+		Owner:   ProcessOwner(),
+	})
+	if err != nil {
+		return Job{}, fmt.Errorf("create job row: %w", err)
+	}
+
+	rj := &runningJob{
+		job:  job,
+		req:  req,
+		ctx:  ctx,
+		done: make(chan struct{}),
+	}
+
+	r.mu.Lock()
+	if r.closed {
+		// Shut down while the row was being created.
+		r.mu.Unlock()
+		_ = r.dbRepo.UpdateJob(job.ID, StatusCanceled, "canceled while pending: runner shut down")
+		return Job{}, ErrRunnerShutdown
+	}
+	r.running[job.ID] = rj
+	r.queue = append(r.queue, rj)
+	r.mu.Unlock()
+	r.emit(RunQueued, rj, StatusPending, "")
+
+	r.schedule()
+	return job, nil
+}
+
+// schedule launches pending runs, oldest first, while the limits allow.
+// A run blocked by a per-repo or per-job limit, or still waiting on a job it
+// needs, doesn't hold back runs queued behind it. Runs whose needs failed
+// are recorded as skipped. Once the runner is shut down nothing more is
+// launched.
+func (r *JobRunner) schedule() {
+	for {
+		needs := r.loadNeeds()
+		r.mu.Lock()
+		if r.closed {
+			// Shutdown cancels what is still pending; a run launched now
+			// would escape it.
+			r.mu.Unlock()
+			return
+		}
+		var (
+			next       *runningJob
+			skip       *runningJob
+			skipStatus string
+			skipMsg    string
+			waiting    bool
+		)
+		for i, rj := range r.queue {
+			ready, failStatus, failMsg := r.needsStateLocked(rj, needs)
+			if failStatus != "" {
+				skip, skipStatus, skipMsg = rj, failStatus, failMsg
+			} else if !ready {
+				waiting = true
+				continue
+			} else if r.canLaunchLocked(rj) {
+				next = rj
+			} else {
+				continue
+			}
+			r.queue = append(r.queue[:i:i], r.queue[i+1:]...)
+			rj.started = true
+			break
+		}
+		if next == nil && skip == nil && waiting && r.recheck == nil {
+			// Needs may be run by another refci process, which won't wake
+			// us up, so look again later.
+			r.recheck = time.AfterFunc(needsRecheckInterval, func() {
+				r.mu.Lock()
+				r.recheck = nil
+				r.mu.Unlock()
+				r.schedule()
+			})
+		}
 		r.mu.Unlock()
-		return "", fmt.Errorf("job is already running: %s %s %s %s", req.Repo, req.Name, req.Branch, req.SHA)
+
+		switch {
+		case skip != nil:
+			r.finishUnstarted(skip, skipStatus, skipMsg)
+		case next != nil:
+			r.launch(next)
+		default:
+			return
+		}
+	}
+}
+
+// needKey names the runs of a needed job: its repo, name, branch and sha.
+type needKey struct{ repo, name, branch, sha string }
+
+// needRun is the newest recorded run of a needed job, or why it couldn't be
+// looked up.
+type needRun struct {
+	latest Job
+	found  bool
+	err    error
+}
+
+// loadNeeds looks up the newest run of every job the queued runs need that
+// this runner isn't running itself. It queries the db without holding
+// JobRunner.mu.
+func (r *JobRunner) loadNeeds() map[needKey]needRun {
+	r.mu.Lock()
+	var keys []needKey
+	seen := map[needKey]bool{}
+	for _, rj := range r.queue {
+		for _, need := range rj.req.Needs {
+			k := needKey{rj.req.Repo, need, rj.req.Branch, rj.req.SHA}
+			if !seen[k] && !r.runsLocked(k) {
+				seen[k] = true
+				keys = append(keys, k)
+			}
+		}
 	}
 	r.mu.Unlock()
 
-	if err := r.dbRepo.CreateJob(req.Repo, req.Name, req.Branch, req.SHA); err != nil {
-		return "", fmt.Errorf("create job row: %w", err)
+	out := make(map[needKey]needRun, len(keys))
+	for _, k := range keys {
+		runs, err := r.dbRepo.ListJob(JobFilter{Repo: k.repo, Name: k.name, Branch: k.branch, SHA: k.sha})
+		nr := needRun{err: err}
+		if err == nil && len(runs) > 0 {
+			nr.latest, nr.found = runs[0], true
+		}
+		out[k] = nr
 	}
+	return out
+}
+
+// runsLocked reports whether this runner has a pending or running run of k.
+func (r *JobRunner) runsLocked(k needKey) bool {
+	for _, other := range r.running {
+		if other.req.Repo == k.repo && other.req.Name == k.name &&
+			other.req.Branch == k.branch && other.req.SHA == k.sha {
+			return true
+		}
+	}
+	return false
+}
 
-	logPath, logFile, err := createJobLogFile(req)
+// needsStateLocked reports whether every job rj needs has finished
+// successfully on the same repo/branch/sha, going by needs from loadNeeds.
+// A non-empty failStatus means rj can never run and should be recorded with
+// it: StatusSkipped when a need didn't finish. Needs whose runs couldn't be
+// looked up keep rj waiting; the next pass looks again.
+func (r *JobRunner) needsStateLocked(rj *runningJob, needs map[needKey]needRun) (ready bool, failStatus, failMsg string) {
+	req := rj.req
+	for _, need := range req.Needs {
+		k := needKey{req.Repo, need, req.Branch, req.SHA}
+		if r.runsLocked(k) {
+			return false, "", ""
+		}
+		nr, ok := needs[k]
+		if !ok {
+			// It ended after loadNeeds looked; the next pass looks it up.
+			return false, "", ""
+		}
+		if nr.err != nil {
+			return false, "", ""
+		}
+		if !nr.found {
+			return false, StatusSkipped, fmt.Sprintf("needs %s: no run for %s", need, ShortSHA(req.SHA))
+		}
+		switch nr.latest.Status {
+		case StatusFinished:
+		case StatusPending, StatusRunning:
+			return false, "", ""
+		default:
+			return false, StatusSkipped, fmt.Sprintf("needs %s: run %d %s", need, nr.latest.ID, nr.latest.Status)
+		}
+	}
+	return true, "", ""
+}
+
+func (r *JobRunner) canLaunchLocked(rj *runningJob) bool {
+	var total, sameRepo, sameJob int
+	for _, other := range r.running {
+		if !other.started {
+			continue
+		}
+		total++
+		if other.req.Repo == rj.req.Repo {
+			sameRepo++
+			if other.req.Name == rj.req.Name {
+				sameJob++
+			}
+		}
+	}
+
+	if r.limits.MaxParallel > 0 && total >= r.limits.MaxParallel {
+		return false
+	}
+	if r.limits.PerRepo > 0 && sameRepo >= r.limits.PerRepo {
+		return false
+	}
+	if rj.req.MaxParallel > 0 && sameJob >= rj.req.MaxParallel {
+		return false
+	}
+	return true
+}
+
+func (r *JobRunner) launch(rj *runningJob) {
+	id := rj.job.ID
+	req := rj.req
+
+	logPath, logFile, err := createJobLogFile(rj.job)
 	if err != nil {
-		_ = r.dbRepo.UpdateJob(req.Repo, req.Name, req.Branch, req.SHA, StatusFailed, err.Error())
-		return "", err
+		r.finishUnstarted(rj, StatusFailed, err.Error())
+		return
+	}
+	if err := r.dbRepo.SetJobLogPath(id, logPath); err != nil {
+		_ = logFile.Close()
+		r.finishUnstarted(rj, StatusFailed, fmt.Sprintf("record log path: %v", err))
+		return
+	}
+	rj.job.LogPath = logPath
+
+	changedPath := changedFilesPath(logPath)
+	if err := writeChangedFiles(rj.ctx, changedPath, req.Repo, req.PrevSHA, req.SHA); err != nil {
+		_ = logFile.Close()
+		r.finishUnstarted(rj, StatusFailed, fmt.Sprintf("list changed files: %v", err))
+		return
 	}
 
-	runCtx, cancel := context.WithCancel(ctx)
-	cmd := exec.CommandContext(runCtx, "bash", req.ScriptPath)
+	if strings.TrimSpace(req.WorkDir) == "" {
+		wt, err := AcquireWorktree(rj.ctx, req.Repo, req.Branch, req.SHA, req.Clean)
+		if err != nil {
+			_ = logFile.Close()
+			r.finishUnstarted(rj, StatusFailed, fmt.Sprintf("prepare worktree: %v", err))
+			return
+		}
+		rj.worktree = wt
+		req.WorkDir = wt.Path
+	}
+	scriptPath := req.ScriptPath
+	if !filepath.IsAbs(scriptPath) {
+		scriptPath = filepath.Join(req.WorkDir, scriptPath)
+	}
+
+	runCtx, cancel := context.WithCancel(rj.ctx)
+	cmd := exec.CommandContext(runCtx, "bash", scriptPath)
 	cmd.Dir = strings.TrimSpace(req.WorkDir)
 	cmd.Stdout = logFile
 	cmd.Stderr = logFile
-	cmd.Env = append(os.Environ(), req.Env...)
+	cmd.Env = append(append(os.Environ(), req.Env...), jobContextEnv(rj.job, req, logPath, changedPath)...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 
-	if err := r.dbRepo.UpdateJob(req.Repo, req.Name, req.Branch, req.SHA, StatusRunning, logPath); err != nil {
+	if err := r.dbRepo.UpdateJob(id, StatusRunning, ""); err != nil {
 		_ = logFile.Close()
 		cancel()
-		return "", fmt.Errorf("set job running: %w", err)
+		r.finishUnstarted(rj, StatusFailed, fmt.Sprintf("set job running: %v", err))
+		return
 	}
 
+	r.mu.Lock()
+	if rj.canceled.Load() {
+		// Canceled between leaving the queue and getting here.
+		r.mu.Unlock()
+		_ = logFile.Close()
+		cancel()
+		r.finishUnstarted(rj, StatusCanceled, "canceled")
+		return
+	}
 	if err := cmd.Start(); err != nil {
+		r.mu.Unlock()
 		_ = logFile.Close()
-		_ = r.dbRepo.UpdateJob(req.Repo, req.Name, req.Branch, req.SHA, StatusFailed, err.Error())
 		cancel()
-		return "", fmt.Errorf("start job process: %w", err)
+		r.finishUnstarted(rj, StatusFailed, err.Error())
+		return
 	}
-
-	rj := &runningJob{
-		cancel: cancel,
-		cmd:    cmd,
-		done:   make(chan struct{}),
+	rj.cmd = cmd
+	rj.cancel = cancel
+	rj.startedAt = time.Now()
+	if req.Timeout > 0 {
+		rj.timer = time.AfterFunc(req.Timeout, func() {
+			rj.timedOut.Store(true)
+			r.terminate(rj, cmd)
+		})
 	}
-
-	r.mu.Lock()
-	r.running[key] = rj
 	r.mu.Unlock()
+	// Lets RecoverJobs find the script if this process dies before it.
+	_ = r.dbRepo.SetJobPID(id, cmd.Process.Pid, processStart(cmd.Process.Pid))
+	r.emit(RunStarted, rj, StatusRunning, "")
 
-	go r.waitJob(req, key, rj, logFile)
-
-	return logPath, nil
+	go r.waitJob(rj, logFile)
 }
 
-func (r *JobRunner) Cancel(repo, name, branch, sha string) error {
-	key := jobKey(repo, name, branch, sha)
+// finishUnstarted records a run that ended without a process to wait on.
+// JobRunner.mu must not be held.
+func (r *JobRunner) finishUnstarted(rj *runningJob, status, msg string) {
+	rj.worktree.Release()
+	_ = r.dbRepo.UpdateJob(rj.job.ID, status, msg)
+	r.emit(RunEnded, rj, status, msg)
 
 	r.mu.Lock()
-	rj, ok := r.running[key]
+	delete(r.running, rj.job.ID)
 	r.mu.Unlock()
+	close(rj.done)
+}
+
+func (r *JobRunner) Cancel(id int64) error {
+	r.mu.Lock()
+	rj, ok := r.running[id]
 	if !ok {
-		return fmt.Errorf("job is not running: %s %s %s %s", repo, name, branch, sha)
+		r.mu.Unlock()
+		return fmt.Errorf("job is not running: run %d", id)
 	}
-
 	rj.canceled.Store(true)
-	rj.cancel()
 
-	if rj.cmd.Process != nil {
-		_ = signalProcess(rj.cmd.Process.Pid, syscall.SIGTERM)
+	if !rj.started {
+		for i, q := range r.queue {
+			if q == rj {
+				r.queue = append(r.queue[:i:i], r.queue[i+1:]...)
+				break
+			}
+		}
+		r.mu.Unlock()
+		r.finishUnstarted(rj, StatusCanceled, "canceled while pending")
+		return nil
+	}
+	cmd := rj.cmd
+	r.mu.Unlock()
+
+	if cmd == nil {
+		// Being launched right now; launch sees canceled and records it.
+		<-rj.done
+		return nil
+	}
+
+	r.terminate(rj, cmd)
+	return nil
+}
+
+// terminate stops a started run: SIGTERM to its process group, then SIGKILL
+// if it is still alive after cancelGrace.
+func (r *JobRunner) terminate(rj *runningJob, cmd *exec.Cmd) {
+	rj.cancel()
+	if cmd.Process != nil {
+		_ = signalProcess(cmd.Process.Pid, syscall.SIGTERM)
 	}
 
 	select {
 	case <-rj.done:
-		return nil
+		return
 	case <-time.After(r.cancelGrace):
 	}
 
-	if rj.cmd.Process != nil {
-		_ = signalProcess(rj.cmd.Process.Pid, syscall.SIGKILL)
+	if cmd.Process != nil {
+		_ = signalProcess(cmd.Process.Pid, syscall.SIGKILL)
 	}
-
-	return nil
 }
 
-func (r *JobRunner) IsRunning(repo, name, branch, sha string) bool {
-	key := jobKey(repo, name, branch, sha)
+// IsRunning reports whether run id is pending or running in this runner.
+func (r *JobRunner) IsRunning(id int64) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	_, ok := r.running[key]
+	_, ok := r.running[id]
 	return ok
 }
 
-func (r *JobRunner) waitJob(req RunJobRequest, key string, rj *runningJob, logFile *os.File) {
+// Wait blocks until run id started by this runner exits and returns the
+// script's exit code (-1 if it was killed by a signal or never started).
+func (r *JobRunner) Wait(ctx context.Context, id int64) (int, error) {
+	r.mu.Lock()
+	rj, ok := r.running[id]
+	r.mu.Unlock()
+	if !ok {
+		// Already exited: the final status is in the db.
+		job, err := r.dbRepo.GetJob(id)
+		if err != nil {
+			return 0, err
+		}
+		return job.ExitCode, nil
+	}
+
+	select {
+	case <-rj.done:
+		// rj.job.JobExit is set before done is closed.
+		return rj.job.ExitCode, nil
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+func (r *JobRunner) waitJob(rj *runningJob, logFile *os.File) {
 	err := rj.cmd.Wait()
+	wall := time.Since(rj.startedAt)
 	_ = logFile.Close()
+	rj.worktree.Release()
+	if rj.timer != nil {
+		rj.timer.Stop()
+	}
+	if ps := rj.cmd.ProcessState; ps != nil {
+		rj.job.JobExit = jobExitOf(ps, wall)
+		_ = r.dbRepo.SetJobExit(rj.job.ID, rj.job.JobExit)
+	}
 
-	status, msg := classifyJobResult(err, rj.canceled.Load())
-	_ = r.dbRepo.UpdateJob(req.Repo, req.Name, req.Branch, req.SHA, status, msg)
+	status, msg := classifyJobResult(err, rj.canceled.Load(), rj.timedOut.Load(), rj.req.Timeout)
+	_ = r.dbRepo.UpdateJob(rj.job.ID, status, msg)
+	r.emit(RunEnded, rj, status, msg)
 
 	r.mu.Lock()
-	delete(r.running, key)
+	delete(r.running, rj.job.ID)
 	r.mu.Unlock()
 	close(rj.done)
+
+	r.schedule()
+}
+
+// jobExitOf reads how a script that ran for wall exited from its process
+// state.
+func jobExitOf(ps *os.ProcessState, wall time.Duration) JobExit {
+	exit := JobExit{
+		ExitCode: ps.ExitCode(),
+		Duration: wall,
+		UserCPU:  ps.UserTime(),
+		SysCPU:   ps.SystemTime(),
+	}
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		exit.Signal = ws.Signal().String()
+	}
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		exit.MaxRSS = int64(ru.Maxrss)
+		if runtime.GOOS != "darwin" {
+			// Linux and the BSDs report kilobytes, macOS bytes.
+			exit.MaxRSS *= 1024
+		}
+	}
+	return exit
 }
 
-func classifyJobResult(waitErr error, canceled bool) (status, msg string) {
+// classifyJobResult is the final status of a started run and the reason
+// for it; timeout is the run's time limit, for a run that hit it.
+func classifyJobResult(waitErr error, canceled, timedOut bool, timeout time.Duration) (status, msg string) {
+	if timedOut && !canceled {
+		return StatusTimedOut, fmt.Sprintf("timed out after %s", timeout)
+	}
 	if canceled {
 		if waitErr == nil {
 			return StatusCanceled, "canceled"
@@ -211,19 +634,28 @@ func classifyJobResult(waitErr error, canceled bool) (status, msg string) {
 	return StatusFailed, strings.TrimSpace(waitErr.Error())
 }
 
-func createJobLogFile(req RunJobRequest) (string, *os.File, error) {
-	repoPart := ToLocalRepo(req.Repo)
-	refPart := sanitizePathToken(req.Name)
-	branchPart := sanitizePathToken(req.Branch)
-	shaPart := sanitizePathToken(shortSHA(req.SHA))
+// RunLogPath is the log of a recorded run: its stored LogPath, or where
+// JobLogPath puts it for runs recorded before log paths were stored. Old
+// logs may since have been compressed to RunLogPath(job)+".gz".
+func RunLogPath(job Job) string {
+	if job.LogPath != "" {
+		return job.LogPath
+	}
+	return JobLogPath(job)
+}
+
+// JobLogPath is where the log of run job is written.
+func JobLogPath(job Job) string {
+	return filepath.Join(Root, "logs", ToLocalRepo(job.Repo), JobLogName(job.Name, job.Branch, job.SHA, job.ID))
+}
 
-	dir := filepath.Join(Root, "logs", repoPart)
+func createJobLogFile(job Job) (string, *os.File, error) {
+	logPath := JobLogPath(job)
+	dir := filepath.Dir(logPath)
 	if err := os.MkdirAll(dir, 0o755); err != nil {
 		return "", nil, fmt.Errorf("create log dir %q: %w", dir, err)
 	}
 
-	name := fmt.Sprintf("%s-%s-%s.log", refPart, branchPart, shaPart)
-	logPath := filepath.Join(dir, name)
 	f, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
 	if err != nil {
 		return "", nil, fmt.Errorf("open log file %q: %w", logPath, err)
@@ -231,6 +663,17 @@ func createJobLogFile(req RunJobRequest) (string, *os.File, error) {
 	return logPath, f, nil
 }
 
+// JobLogName is the log file name of one run, unique per run ID so that
+// re-runs of the same sha never share a log.
+func JobLogName(name, branch, sha string, runID int64) string {
+	return fmt.Sprintf("%s-%s-%s-%d.log",
+		sanitizePathToken(name),
+		sanitizePathToken(branch),
+		sanitizePathToken(ShortSHA(sha)),
+		runID,
+	)
+}
+
 func signalProcess(pid int, sig syscall.Signal) error {
 	if pid <= 0 {
 		return nil
@@ -250,11 +693,8 @@ func signalProcess(pid int, sig syscall.Signal) error {
 	return nil
 }
 
-func jobKey(repo, name, branch, sha string) string {
-	return repo + "\x00" + name + "\x00" + branch + "\x00" + sha
-}
-
-func shortSHA(sha string) string {
+// ShortSHA abbreviates sha the way refci shows it and names logs with it.
+func ShortSHA(sha string) string {
 	s := strings.TrimSpace(sha)
 	if len(s) <= 12 {
 		return s
@@ -1,11 +1,15 @@
 package core
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 )
@@ -13,17 +17,134 @@ import (
 // JobConfFile matches .refci/conf.yml as a top-level job map.
 //
 //	my-job:
-//	  branch_pattern: main
+//	  branch_pattern: [main, "release/**", "!release/old/**"]
+//	  tag_pattern: v*
+//	  ref_pattern: refs/pull/*/head
 //	  path_patterns:
 //	    - services/**
 //	  script: .refci/main.sh
+//	  max_parallel: 1
+//	  timeout: 15m
+//	  needs: [test, lint]
+//	  clean: untracked
+//	  matrix:
+//	    go: ["1.24", "1.25"]
 type JobConfFile map[string]JobConfSpec
 
 // JobConfSpec matches one job entry in .refci/conf.yml.
 type JobConfSpec struct {
-	BranchPattern string   `yaml:"branch_pattern"`
-	PathPatterns  []string `yaml:"path_patterns"`
-	Script        string   `yaml:"script"`
+	BranchPattern Patterns   `yaml:"branch_pattern"`
+	TagPattern    Patterns   `yaml:"tag_pattern"` // tags to run on, once per tag
+	RefPattern    Patterns   `yaml:"ref_pattern"` // other refs to run on, e.g. refs/pull/*/head
+	PathPatterns  []string   `yaml:"path_patterns"`
+	Script        string     `yaml:"script"`
+	MaxParallel   int        `yaml:"max_parallel"` // concurrent runs of this job, 0 = no limit
+	Timeout       Duration   `yaml:"timeout"`      // Go duration, e.g. 90s or 1h30m; 0 = no limit
+	Needs         []string   `yaml:"needs"`        // jobs that must finish on the same sha first
+	Matrix        *JobMatrix `yaml:"matrix"`       // one job per combination, see JobMatrix
+	Clean         string     `yaml:"clean"`        // see CleanMode; all when empty
+}
+
+// ConfError is one problem found in a conf.yml. Job and Field are empty
+// when the problem isn't specific to one.
+type ConfError struct {
+	File  string
+	Line  int
+	Job   string
+	Field string
+	Msg   string
+}
+
+func (e *ConfError) Error() string {
+	var b strings.Builder
+	if e.File != "" {
+		b.WriteString(e.File)
+		b.WriteString(":")
+	}
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "%d:", e.Line)
+	}
+	if b.Len() > 0 {
+		b.WriteString(" ")
+	}
+	if e.Job != "" {
+		fmt.Fprintf(&b, "job %q: ", e.Job)
+	}
+	if e.Field != "" {
+		b.WriteString(e.Field + ": ")
+	}
+	b.WriteString(e.Msg)
+	return b.String()
+}
+
+// ConfErrors is every problem found in one conf.yml, in file order.
+type ConfErrors []*ConfError
+
+func (errs ConfErrors) Error() string {
+	lines := make([]string, 0, len(errs))
+	for _, e := range errs {
+		lines = append(lines, e.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (errs ConfErrors) inFile(file string) ConfErrors {
+	for _, e := range errs {
+		e.File = file
+	}
+	return errs
+}
+
+func confErrorf(line int, format string, args ...any) *ConfError {
+	return &ConfError{Line: line, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Duration is a time.Duration written as a Go duration string in yaml.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	var raw string
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		*d = 0
+		return nil
+	}
+	v, err := time.ParseDuration(raw)
+	if err != nil {
+		return confErrorf(node.Line, "invalid duration %q", raw)
+	}
+	if v < 0 {
+		return confErrorf(node.Line, "duration must not be negative: %q", raw)
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Patterns is a list of branch, tag or ref patterns, written in yaml as one
+// pattern or a list of them. An empty string is no pattern at all.
+type Patterns []string
+
+func (p *Patterns) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		var raw string
+		if err := node.Decode(&raw); err != nil {
+			return err
+		}
+		*p = nil
+		if strings.TrimSpace(raw) != "" {
+			*p = Patterns{raw}
+		}
+		return nil
+	}
+	var list []string
+	if err := node.Decode(&list); err != nil {
+		return err
+	}
+	*p = list
+	return nil
 }
 
 // LoadJobConfs loads job definitions from .refci/conf.yml format.
@@ -38,49 +159,245 @@ func LoadJobConfs(path string) ([]JobConf, error) {
 		return nil, fmt.Errorf("read job conf: %w", err)
 	}
 
-	return ParseJobConfs(string(data)), nil
+	confs, err := ParseJobConfs(string(data))
+	if errs, ok := err.(ConfErrors); ok {
+		return nil, errs.inFile(confPath)
+	}
+	return confs, err
 }
 
-func ParseJobConfs(raw string) []JobConf {
-	var file JobConfFile
-	if err := yaml.Unmarshal([]byte(raw), &file); err != nil {
-		return nil
+// ParseJobConfs parses and validates a conf.yml. Any problem fails the
+// whole file; the error is a ConfErrors listing all of them.
+func ParseJobConfs(raw string) ([]JobConf, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(raw), &doc); err != nil {
+		return nil, ConfErrors{yamlConfError(err, 0)}
 	}
-	if len(file) == 0 {
-		return nil
+	if len(doc.Content) == 0 {
+		return nil, ConfErrors{confErrorf(0, "no jobs defined")}
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, ConfErrors{confErrorf(root.Line, "top level must be a map of job name to job")}
+	}
+	if len(root.Content) == 0 {
+		return nil, ConfErrors{confErrorf(root.Line, "no jobs defined")}
 	}
 
-	normalized := make(map[string]JobConfSpec, len(file))
-	for name, spec := range file {
-		key := strings.TrimSpace(name)
-		if key == "" {
+	var errs ConfErrors
+	specs := map[string]JobConfSpec{}
+	var keys []string
+	needLines := map[string]int{}
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		keyNode, valNode := root.Content[i], root.Content[i+1]
+		name := strings.TrimSpace(keyNode.Value)
+		switch {
+		case name == "":
+			errs = append(errs, confErrorf(keyNode.Line, "blank job name"))
+			continue
+		case strings.ContainsAny(name, "[]"):
+			errs = append(errs, &ConfError{Line: keyNode.Line, Job: name, Msg: "job name must not contain [ or ]"})
 			continue
 		}
-		if _, exists := normalized[key]; exists {
+		if _, dup := specs[name]; dup {
+			errs = append(errs, &ConfError{Line: keyNode.Line, Job: name, Msg: "duplicate job name"})
 			continue
 		}
-		normalized[key] = spec
-	}
-	if len(normalized) == 0 {
-		return nil
+
+		spec, line, jobErrs := parseJobConfSpec(name, keyNode.Line, valNode)
+		errs = append(errs, jobErrs...)
+		specs[name] = spec
+		keys = append(keys, name)
+		needLines[name] = line
 	}
 
-	keys := make([]string, 0, len(normalized))
-	for key := range normalized {
-		keys = append(keys, key)
+	// needs refer to job names as written, before matrix expansion.
+	for _, name := range keys {
+		for _, need := range specs[name].Needs {
+			switch _, ok := specs[need]; {
+			case need == name:
+				errs = append(errs, &ConfError{Line: needLines[name], Job: name, Field: "needs", Msg: "job needs itself"})
+			case !ok:
+				errs = append(errs, &ConfError{Line: needLines[name], Job: name, Field: "needs", Msg: fmt.Sprintf("unknown job %q", need)})
+			}
+		}
+	}
+	if len(errs) > 0 {
+		sort.SliceStable(errs, func(i, j int) bool { return errs[i].Line < errs[j].Line })
+		return nil, errs
 	}
-	sort.Strings(keys)
 
+	sort.Strings(keys)
 	out := make([]JobConf, 0, len(keys))
+	expanded := map[string][]string{} // matrix job name -> combination names
 	for _, name := range keys {
-		spec := normalized[name]
-		out = append(out, JobConf{
-			Name:          name,
-			BranchPattern: spec.BranchPattern,
-			PathPatterns:  spec.PathPatterns,
-			ScriptPath:    spec.Script,
-		})
+		spec := specs[name]
+		base := JobConf{
+			Name:           name,
+			BranchPatterns: spec.BranchPattern,
+			TagPatterns:    spec.TagPattern,
+			RefPatterns:    spec.RefPattern,
+			PathPatterns:   spec.PathPatterns,
+			ScriptPath:     spec.Script,
+			MaxParallel:    spec.MaxParallel,
+			Timeout:        time.Duration(spec.Timeout),
+			Needs:          spec.Needs,
+			Clean:          CleanMode(spec.Clean),
+		}
+		if spec.Matrix == nil {
+			out = append(out, base)
+			continue
+		}
+
+		expanded[name] = []string{}
+		for _, combo := range spec.Matrix.Combinations() {
+			jc := base
+			jc.Name = MatrixJobName(name, combo)
+			jc.Matrix = combo
+			out = append(out, jc)
+			expanded[name] = append(expanded[name], jc.Name)
+		}
+	}
+
+	// needs: [test] on a matrix job means every combination of test.
+	for i := range out {
+		var needs []string
+		for _, need := range out[i].Needs {
+			if names, ok := expanded[need]; ok {
+				needs = append(needs, names...)
+				continue
+			}
+			needs = append(needs, need)
+		}
+		out[i].Needs = needs
+	}
+
+	if err := ValidateJobConfs(out); err != nil {
+		return nil, ConfErrors{confErrorf(0, "%v", err)}
+	}
+	return out, nil
+}
+
+// parseJobConfSpec decodes one job field by field so each problem can be
+// pinned to its field. It also returns the line of the needs field.
+func parseJobConfSpec(name string, line int, node *yaml.Node) (JobConfSpec, int, ConfErrors) {
+	var spec JobConfSpec
+	if node.Kind != yaml.MappingNode {
+		return spec, line, ConfErrors{&ConfError{Line: line, Job: name, Msg: "job must be a map of fields"}}
+	}
+
+	fields := map[string]any{
+		"branch_pattern": &spec.BranchPattern,
+		"tag_pattern":    &spec.TagPattern,
+		"ref_pattern":    &spec.RefPattern,
+		"path_patterns":  &spec.PathPatterns,
+		"script":         &spec.Script,
+		"max_parallel":   &spec.MaxParallel,
+		"timeout":        &spec.Timeout,
+		"needs":          &spec.Needs,
+		"matrix":         &spec.Matrix,
+		"clean":          &spec.Clean,
+	}
+
+	var errs ConfErrors
+	fail := func(line int, field, format string, args ...any) {
+		errs = append(errs, &ConfError{Line: line, Job: name, Field: field, Msg: fmt.Sprintf(format, args...)})
+	}
+
+	fieldLines := map[string]int{} // where each field was set
+	badFields := map[string]bool{}
+	lineOf := func(field string) int {
+		if l, ok := fieldLines[field]; ok {
+			return l
+		}
+		return line
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valNode := node.Content[i], node.Content[i+1]
+		field := keyNode.Value
+		target, ok := fields[field]
+		if !ok {
+			fail(keyNode.Line, field, "unknown field")
+			continue
+		}
+		if _, dup := fieldLines[field]; dup {
+			fail(keyNode.Line, field, "duplicate field")
+			continue
+		}
+		fieldLines[field] = keyNode.Line
+		if err := valNode.Decode(target); err != nil {
+			e := yamlConfError(err, valNode.Line)
+			e.Job, e.Field = name, field
+			errs = append(errs, e)
+			badFields[field] = true
+		}
+	}
+
+	spec.Script = strings.TrimSpace(spec.Script)
+	if spec.Script == "" {
+		fail(lineOf("script"), "script", "is required")
+	}
+	for i, p := range spec.BranchPattern {
+		spec.BranchPattern[i] = normalizeBranchPattern(p)
+		if err := ValidateBranchPattern(p); err != nil {
+			fail(lineOf("branch_pattern"), "branch_pattern", "%v", err)
+		}
+	}
+	for i, p := range spec.TagPattern {
+		spec.TagPattern[i] = normalizeTagPattern(p)
+		if err := ValidateTagPattern(p); err != nil {
+			fail(lineOf("tag_pattern"), "tag_pattern", "%v", err)
+		}
+	}
+	for i, p := range spec.RefPattern {
+		spec.RefPattern[i] = strings.TrimSpace(p)
+		if err := ValidateRefPattern(p); err != nil {
+			fail(lineOf("ref_pattern"), "ref_pattern", "%v", err)
+		}
+	}
+	if mode, err := ParseCleanMode(spec.Clean); err != nil {
+		fail(lineOf("clean"), "clean", "%v", err)
+	} else {
+		spec.Clean = string(mode)
+	}
+	if spec.MaxParallel < 0 {
+		fail(lineOf("max_parallel"), "max_parallel", "must not be negative")
+	}
+	spec.Needs = trimNames(spec.Needs)
+	if spec.Matrix != nil && !badFields["matrix"] && len(spec.Matrix.Combinations()) == 0 {
+		fail(lineOf("matrix"), "matrix", "no combinations left after exclude")
+	}
+	return spec, lineOf("needs"), errs
+}
+
+var yamlLineRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): `)
+
+// yamlConfError turns a yaml decode error into a ConfError, taking the line
+// from the message when yaml put one there and line otherwise.
+func yamlConfError(err error, line int) *ConfError {
+	var ce *ConfError
+	if errors.As(err, &ce) {
+		return ce
 	}
 
+	msg := err.Error()
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) && len(typeErr.Errors) > 0 {
+		msg = typeErr.Errors[0]
+	}
+	if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+		line, _ = strconv.Atoi(m[1])
+		msg = msg[len(m[0]):]
+	}
+	return confErrorf(line, "%s", strings.TrimPrefix(msg, "yaml: "))
+}
+
+func trimNames(names []string) []string {
+	var out []string
+	for _, n := range names {
+		if v := strings.TrimSpace(n); v != "" {
+			out = append(out, v)
+		}
+	}
 	return out
 }
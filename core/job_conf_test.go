@@ -0,0 +1,173 @@
+package core
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseJobConfs(t *testing.T) {
+	confs, err := ParseJobConfs(`
+test:
+  branch_pattern: [main, "release/**", "!release/old/**"]
+  tag_pattern: v*
+  path_patterns: ["src/**"]
+  script: " .refci/test.sh "
+  max_parallel: 2
+  timeout: 1h30m
+  clean: untracked
+lint:
+  ref_pattern: refs/pull/*/head
+  script: .refci/lint.sh
+  needs: [" test "]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []JobConf{
+		{
+			Name:        "lint",
+			RefPatterns: []string{"refs/pull/*/head"},
+			ScriptPath:  ".refci/lint.sh",
+			Needs:       []string{"test"},
+			Clean:       CleanAll,
+		},
+		{
+			Name:           "test",
+			BranchPatterns: []string{"main", "release/**", "!release/old/**"},
+			TagPatterns:    []string{"v*"},
+			PathPatterns:   []string{"src/**"},
+			ScriptPath:     ".refci/test.sh",
+			MaxParallel:    2,
+			Timeout:        90 * time.Minute,
+			Clean:          CleanUntracked,
+		},
+	}
+	if !reflect.DeepEqual(confs, want) {
+		t.Errorf("ParseJobConfs =\n%+v\nwant\n%+v", confs, want)
+	}
+}
+
+func TestParseJobConfsErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		want []ConfError // in line order
+	}{
+		{
+			name: "not yaml",
+			conf: "test: [\n",
+			want: []ConfError{{Line: 1, Msg: "did not find expected node content"}},
+		},
+		{
+			name: "empty",
+			conf: "",
+			want: []ConfError{{Msg: "no jobs defined"}},
+		},
+		{
+			name: "not a map",
+			conf: "- test\n",
+			want: []ConfError{{Line: 1, Msg: "top level must be a map of job name to job"}},
+		},
+		{
+			name: "job not a map",
+			conf: "test: test.sh\n",
+			want: []ConfError{{Line: 1, Job: "test", Msg: "job must be a map of fields"}},
+		},
+		{
+			name: "blank and duplicate names",
+			conf: "\"\":\n  script: a.sh\ntest:\n  script: a.sh\ntest:\n  script: b.sh\n",
+			want: []ConfError{
+				{Line: 1, Msg: "blank job name"},
+				{Line: 5, Job: "test", Msg: "duplicate job name"},
+			},
+		},
+		{
+			name: "bracket in a name",
+			conf: "test[x]:\n  script: a.sh\n",
+			want: []ConfError{{Line: 1, Job: "test[x]", Msg: "job name must not contain [ or ]"}},
+		},
+		{
+			name: "every problem of one job",
+			conf: `test:
+  branch_pattern: "bad..branch"
+  tag_pattern: ["v*", "a b"]
+  ref_pattern: heads/main
+  scrpit: a.sh
+  max_parallel: -1
+  timeout: soon
+  clean: sometimes
+`,
+			want: []ConfError{
+				{Line: 1, Job: "test", Field: "script", Msg: "is required"},
+				{Line: 2, Job: "test", Field: "branch_pattern", Msg: `not a valid ref pattern: "bad..branch"`},
+				{Line: 3, Job: "test", Field: "tag_pattern", Msg: `invalid character in "a b"`},
+				{Line: 4, Job: "test", Field: "ref_pattern", Msg: `must be a full ref starting with refs/: "heads/main"`},
+				{Line: 5, Job: "test", Field: "scrpit", Msg: "unknown field"},
+				{Line: 6, Job: "test", Field: "max_parallel", Msg: "must not be negative"},
+				{Line: 7, Job: "test", Field: "timeout", Msg: `invalid duration "soon"`},
+				{Line: 8, Job: "test", Field: "clean", Msg: `must be one of all, untracked, none: "sometimes"`},
+			},
+		},
+		{
+			name: "duplicate field and wrong type",
+			conf: "test:\n  script: a.sh\n  script: b.sh\n  max_parallel: many\n",
+			want: []ConfError{
+				{Line: 3, Job: "test", Field: "script", Msg: "duplicate field"},
+				{Line: 4, Job: "test", Field: "max_parallel", Msg: "cannot unmarshal !!str `many` into int"},
+			},
+		},
+		{
+			name: "needs",
+			conf: "a:\n  script: a.sh\n  needs: [a]\nb:\n  script: b.sh\n  needs: [c]\n",
+			want: []ConfError{
+				{Line: 3, Job: "a", Field: "needs", Msg: "job needs itself"},
+				{Line: 6, Job: "b", Field: "needs", Msg: `unknown job "c"`},
+			},
+		},
+		{
+			name: "needs cycle",
+			conf: "a:\n  script: a.sh\n  needs: [b]\nb:\n  script: b.sh\n  needs: [a]\n",
+			want: []ConfError{{Msg: "needs cycle: a -> b -> a"}},
+		},
+		{
+			name: "matrix with nothing left",
+			conf: "test:\n  script: a.sh\n  matrix:\n    go: [a]\n    exclude: [{go: a}]\n",
+			want: []ConfError{{Line: 3, Job: "test", Field: "matrix", Msg: "no combinations left after exclude"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			confs, err := ParseJobConfs(tt.conf)
+			if confs != nil {
+				t.Errorf("ParseJobConfs returned jobs %+v along with errors", confs)
+			}
+			var errs ConfErrors
+			if !errors.As(err, &errs) {
+				t.Fatalf("ParseJobConfs = %v, want ConfErrors", err)
+			}
+			var got []ConfError
+			for _, e := range errs {
+				got = append(got, *e)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("errors =\n%+v\nwant\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadJobConfsNamesTheFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "conf.yml")
+	if err := os.WriteFile(path, []byte("test:\n  scrpit: a.sh\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := LoadJobConfs(path)
+	want := path + `:1: job "test": script: is required` + "\n" + path + `:2: job "test": scrpit: unknown field`
+	if err == nil || err.Error() != want {
+		t.Errorf("LoadJobConfs = %v, want\n%s", err, want)
+	}
+}
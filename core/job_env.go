@@ -0,0 +1,76 @@
+package core
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Context variables set for every job script. They are set after the .env
+// entries, so a .env can't override them. Names and meanings are stable.
+const (
+	EnvRepo         = "REFCI_REPO"          // owner/repo
+	EnvJob          = "REFCI_JOB"           // job name, including any matrix suffix
+	EnvBranch       = "REFCI_BRANCH"        // branch the run is for, or the full ref of a tag or other ref
+	EnvRefType      = "REFCI_REF_TYPE"      // branch, tag or ref
+	EnvSHA          = "REFCI_SHA"           // full commit sha being run
+	EnvPrevSHA      = "REFCI_PREV_SHA"      // sha of this job's previous run on the branch, empty on the first
+	EnvRunID        = "REFCI_RUN_ID"        // run ID, unique across re-runs
+	EnvAttempt      = "REFCI_ATTEMPT"       // 1 for the first run of this sha, 2 for the first re-run, ...
+	EnvTrigger      = "REFCI_TRIGGER"       // poll or manual
+	EnvWorktree     = "REFCI_WORKTREE"      // checkout the script runs in
+	EnvChangedFiles = "REFCI_CHANGED_FILES" // file listing paths changed since REFCI_PREV_SHA, one per line
+	EnvLog          = "REFCI_LOG"           // this run's log file
+)
+
+// jobContextEnv returns the REFCI_* variables of run job.
+func jobContextEnv(job Job, req RunJobRequest, logPath, changedPath string) []string {
+	return []string{
+		EnvRepo + "=" + job.Repo,
+		EnvJob + "=" + job.Name,
+		EnvBranch + "=" + job.Branch,
+		EnvRefType + "=" + job.RefType,
+		EnvSHA + "=" + job.SHA,
+		EnvPrevSHA + "=" + req.PrevSHA,
+		EnvRunID + "=" + strconv.FormatInt(job.ID, 10),
+		EnvAttempt + "=" + strconv.Itoa(job.Attempt),
+		EnvTrigger + "=" + job.Trigger,
+		EnvWorktree + "=" + req.WorkDir,
+		EnvChangedFiles + "=" + changedPath,
+		EnvLog + "=" + logPath,
+	}
+}
+
+// changedFilesPath is where the REFCI_CHANGED_FILES list of the run logged
+// at logPath is written.
+func changedFilesPath(logPath string) string {
+	return strings.TrimSuffix(logPath, ".log") + ".changed"
+}
+
+// writeChangedFiles writes the files changed between prevSHA and sha to
+// path. With no usable prevSHA every file at sha counts as changed.
+func writeChangedFiles(ctx context.Context, path, repo, prevSHA, sha string) error {
+	var files []string
+	var err error
+	if prevSHA != "" && prevSHA != sha {
+		files, err = ListChangedFiles(ctx, repo, prevSHA, sha)
+	}
+	if prevSHA == "" || err != nil {
+		// No previous run, or its sha is gone (e.g. after a force push).
+		files, err = ListFiles(ctx, repo, sha)
+		if err != nil {
+			return err
+		}
+	}
+
+	content := strings.Join(files, "\n")
+	if content != "" {
+		content += "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		return fmt.Errorf("write changed files: %w", err)
+	}
+	return nil
+}
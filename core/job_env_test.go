@@ -0,0 +1,143 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobContextEnv(t *testing.T) {
+	oldRoot := Root
+	Root = t.TempDir()
+	t.Cleanup(func() { Root = oldRoot })
+
+	mirror := filepath.Join(Root, "repos", ToLocalRepo("o/app"))
+	testGit(t, "", "init", "-q", mirror)
+	script := "env | grep -E '^(REFCI_|FOO=)' | sort > \"$OUT\"\n"
+	if err := os.MkdirAll(filepath.Join(mirror, ".refci"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(mirror, ".refci", "env.sh"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, mirror, "add", "-A")
+	testGit(t, mirror, "commit", "-q", "-m", "first")
+	first := testGit(t, mirror, "rev-parse", "HEAD")
+	if err := os.WriteFile(filepath.Join(mirror, "b.txt"), []byte("b\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, mirror, "add", "-A")
+	testGit(t, mirror, "commit", "-q", "-m", "second")
+	second := testGit(t, mirror, "rev-parse", "HEAD")
+
+	dbRepo := newTestRepo(t)
+	prev, err := dbRepo.CreateJob(Job{Repo: "o/app", Name: "env[go=1.24]", Branch: "main", SHA: first})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dbRepo.UpdateJob(prev.ID, StatusFinished, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(t.TempDir(), "env")
+	runner := NewJobRunner(dbRepo)
+	jc := JobConf{
+		Repo: "o/app", Name: "env[go=1.24]", ScriptPath: ".refci/env.sh",
+		Matrix: []MatrixValue{{Key: "go", Value: "1.24"}},
+	}
+	// A .env can't override the context variables.
+	job, err := runner.RerunJob(jc, []string{"OUT=" + out, "FOO=bar", EnvSHA + "=spoofed"}, "main", second, TriggerManual)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if code, err := runner.Wait(ctx, job.ID); err != nil || code != 0 {
+		t.Fatalf("Wait = %d, %v; want 0, nil", code, err)
+	}
+	job, err = dbRepo.GetJob(job.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		k, v, _ := strings.Cut(line, "=")
+		got[k] = v
+	}
+	want := map[string]string{
+		"FOO":             "bar",
+		EnvRepo:           "o/app",
+		EnvJob:            "env[go=1.24]",
+		EnvBranch:         "main",
+		EnvRefType:        RefBranch,
+		EnvSHA:            second,
+		EnvPrevSHA:        first,
+		EnvRunID:          strconv.FormatInt(job.ID, 10),
+		EnvAttempt:        "1",
+		EnvTrigger:        TriggerManual,
+		EnvWorktree:       got[EnvWorktree],
+		EnvChangedFiles:   changedFilesPath(job.LogPath),
+		EnvLog:            job.LogPath,
+		"REFCI_MATRIX_GO": "1.24",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("job env =\n%v\nwant\n%v", got, want)
+	}
+	if !strings.HasPrefix(got[EnvWorktree], filepath.Join(Root, "worktrees", ToLocalRepo("o/app"))+string(filepath.Separator)) {
+		t.Errorf("%s = %q, want a pooled worktree", EnvWorktree, got[EnvWorktree])
+	}
+	if changed, err := os.ReadFile(got[EnvChangedFiles]); err != nil || string(changed) != "b.txt\n" {
+		t.Errorf("changed files = %q, %v; want b.txt", changed, err)
+	}
+}
+
+func TestWriteChangedFiles(t *testing.T) {
+	oldRoot := Root
+	Root = t.TempDir()
+	t.Cleanup(func() { Root = oldRoot })
+
+	mirror := filepath.Join(Root, "repos", ToLocalRepo("o/app"))
+	testGit(t, "", "init", "-q", mirror)
+	commit := func(name string) string {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(mirror, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		testGit(t, mirror, "add", "-A")
+		testGit(t, mirror, "commit", "-q", "-m", name)
+		return testGit(t, mirror, "rev-parse", "HEAD")
+	}
+	first := commit("a.txt")
+	second := commit("b.txt")
+
+	tests := []struct {
+		name    string
+		prevSHA string
+		want    string
+	}{
+		{"since the previous run", first, "b.txt\n"},
+		{"first run", "", "a.txt\nb.txt\n"},
+		{"previous sha gone", strings.Repeat("0", 40), "a.txt\nb.txt\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "changed")
+			if err := writeChangedFiles(context.Background(), path, "o/app", tt.prevSHA, second); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := os.ReadFile(path); err != nil || string(got) != tt.want {
+				t.Errorf("changed files = %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,228 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestRepo returns a DbRepo backed by a fresh sqlite file.
+func newTestRepo(t *testing.T) SQLiteRepo {
+	t.Helper()
+	db, err := OpenDB(DBConfig{Kind: DBSQLite, SQLitePath: filepath.Join(t.TempDir(), "refci.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	repo, err := NewSQLiteRepo(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return *repo
+}
+
+// failingListRepo fails ListJob for runs of job name while down is set.
+type failingListRepo struct {
+	SQLiteRepo
+	name string
+	down *atomic.Bool
+}
+
+func (r failingListRepo) ListJob(filter JobFilter) ([]Job, error) {
+	if filter.Name == r.name && r.down.Load() {
+		return nil, errors.New("db is down")
+	}
+	return r.SQLiteRepo.ListJob(filter)
+}
+
+func TestNeedsThatCanNeverFinish(t *testing.T) {
+	tests := []struct {
+		name       string
+		prepare    func(t *testing.T, dbRepo DbRepo)
+		wantStatus string
+		wantMsg    string
+	}{
+		{
+			name:       "no run of the need",
+			wantStatus: StatusSkipped,
+			wantMsg:    "needs build: no run for",
+		},
+		{
+			name: "need failed",
+			prepare: func(t *testing.T, dbRepo DbRepo) {
+				job, err := dbRepo.CreateJob(Job{Repo: "o/app", Name: "build", Branch: "main", SHA: "abc"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := dbRepo.UpdateJob(job.ID, StatusFailed, "exit status 1"); err != nil {
+					t.Fatal(err)
+				}
+			},
+			wantStatus: StatusSkipped,
+			wantMsg:    "needs build: run 1 failed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dbRepo := newTestRepo(t)
+			if tt.prepare != nil {
+				tt.prepare(t, dbRepo)
+			}
+			runner := NewJobRunner(dbRepo)
+			job, err := runner.Start(context.Background(), RunJobRequest{
+				Repo: "o/app", Name: "test", Branch: "main", SHA: "abc",
+				ScriptPath: "test.sh", WorkDir: t.TempDir(), Needs: []string{"build"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if code, err := runner.Wait(ctx, job.ID); err != nil || code != -1 {
+				t.Fatalf("Wait = %d, %v; want -1, nil", code, err)
+			}
+
+			got, err := dbRepo.GetJob(job.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.wantStatus || !strings.HasPrefix(got.Msg, tt.wantMsg) {
+				t.Errorf("run is %s %q, want %s %q...", got.Status, got.Msg, tt.wantStatus, tt.wantMsg)
+			}
+		})
+	}
+}
+
+// A need whose runs can't be looked up keeps the run waiting until they can.
+func TestNeedsLookedUpAgainAfterDbError(t *testing.T) {
+	oldRoot := Root
+	Root = t.TempDir()
+	t.Cleanup(func() { Root = oldRoot })
+	mirror := filepath.Join(Root, "repos", ToLocalRepo("o/app"))
+	testGit(t, "", "init", "-q", mirror)
+	testGit(t, mirror, "commit", "-q", "--allow-empty", "-m", "first")
+	sha := testGit(t, mirror, "rev-parse", "HEAD")
+
+	down := &atomic.Bool{}
+	down.Store(true)
+	dbRepo := failingListRepo{SQLiteRepo: newTestRepo(t), name: "build", down: down}
+	build, err := dbRepo.CreateJob(Job{Repo: "o/app", Name: "build", Branch: "main", SHA: sha})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := dbRepo.UpdateJob(build.ID, StatusFinished, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	work := t.TempDir()
+	if err := os.WriteFile(filepath.Join(work, "test.sh"), []byte("exit 0\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	runner := NewJobRunner(dbRepo)
+	job, err := runner.Start(context.Background(), RunJobRequest{
+		Repo: "o/app", Name: "test", Branch: "main", SHA: sha,
+		ScriptPath: "test.sh", WorkDir: work, Needs: []string{"build"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := dbRepo.GetJob(job.ID); err != nil || got.Status != StatusPending {
+		t.Fatalf("run while the db is down = %+v, %v; want it pending", got, err)
+	}
+
+	down.Store(false)
+	runner.schedule()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if code, err := runner.Wait(ctx, job.ID); err != nil || code != 0 {
+		t.Errorf("Wait = %d, %v; want 0, nil", code, err)
+	}
+}
+
+func TestRunnerRecordsJobExit(t *testing.T) {
+	sha := testMirror(t, "o/app", nil)
+	tests := []struct {
+		name        string
+		script      string
+		timeout     time.Duration
+		wantStatus  string
+		wantCode    int
+		wantSignal  string
+		wantMsg     string
+		minDuration time.Duration
+	}{
+		{"exit 0", "exit 0\n", 0, StatusFinished, 0, "", "", 0},
+		{"exit 3", "exit 3\n", 0, StatusFailed, 3, "", "exit status 3", 0},
+		{"killed", "kill -KILL $$\n", 0, StatusFailed, -1, "killed", "signal: killed", 0},
+		{"slow", "sleep 0.2\n", 0, StatusFinished, 0, "", "", 200 * time.Millisecond},
+		{"timed out", "sleep 5\n", 100 * time.Millisecond, StatusTimedOut, -1, "terminated", "timed out after 100ms", 100 * time.Millisecond},
+	}
+	dbRepo := newTestRepo(t)
+	runner := NewJobRunner(dbRepo)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			work := t.TempDir()
+			if err := os.WriteFile(filepath.Join(work, "run.sh"), []byte(tt.script), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			job, err := runner.Start(context.Background(), RunJobRequest{
+				Repo: "o/app", Name: tt.name, Branch: "main", SHA: sha,
+				ScriptPath: "run.sh", WorkDir: work, Timeout: tt.timeout,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			code, err := runner.Wait(ctx, job.ID)
+			if err != nil || code != tt.wantCode {
+				t.Errorf("Wait = %d, %v; want %d", code, err, tt.wantCode)
+			}
+
+			got, err := dbRepo.GetJob(job.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Status != tt.wantStatus || got.Msg != tt.wantMsg || got.ExitCode != tt.wantCode || got.Signal != tt.wantSignal {
+				t.Errorf("run = %s %q, exit %d, signal %q; want %s %q, exit %d, signal %q",
+					got.Status, got.Msg, got.ExitCode, got.Signal, tt.wantStatus, tt.wantMsg, tt.wantCode, tt.wantSignal)
+			}
+			if got.Duration < tt.minDuration || got.Duration > 5*time.Second {
+				t.Errorf("duration %s, want at least %s", got.Duration, tt.minDuration)
+			}
+			if got.MaxRSS <= 0 {
+				t.Errorf("max rss %d, want it recorded", got.MaxRSS)
+			}
+
+			// The exit is queryable.
+			runs, err := dbRepo.ListJob(JobFilter{Name: tt.name, ExitCode: &tt.wantCode, Signal: tt.wantSignal})
+			if err != nil || len(runs) != 1 || runs[0].ID != job.ID {
+				t.Errorf("ListJob by exit = %+v, %v; want run #%d", runs, err, job.ID)
+			}
+		})
+	}
+}
+
+func TestRunLogPath(t *testing.T) {
+	job := Job{ID: 3, Repo: "o/app", Name: "build", Branch: "main", SHA: "abc"}
+	tests := []struct {
+		name    string
+		logPath string
+		want    string
+	}{
+		{"stored", "/var/log/refci/run.log", "/var/log/refci/run.log"},
+		{"recorded before log paths were stored", "", JobLogPath(job)},
+	}
+	for _, tt := range tests {
+		j := job
+		j.LogPath = tt.logPath
+		if got := RunLogPath(j); got != tt.want {
+			t.Errorf("%s: RunLogPath = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
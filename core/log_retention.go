@@ -0,0 +1,195 @@
+package core
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// PruneReport is what one Prune pass did, or would do on a dry run.
+type PruneReport struct {
+	DeletedRuns    []Job    // runs deleted with their logs
+	CompressedLogs []string // logs gzipped, by their uncompressed path
+	FreedBytes     int64    // deleted files plus, unless dry, what compression saved
+}
+
+// Prune applies setting to finished runs. A run is deleted with its log
+// when it ended more than LogRetentionDays ago or is older than the newest
+// KeepRuns runs of its repo/job/branch; logs of the remaining runs that
+// ended more than CompressAfterDays ago are gzipped. The newest finished run
+// of a repo/job/branch is always kept, however old: polling compares new
+// heads against its SHA, and a tag with a run never runs again. Pending and
+// running runs are never touched. With dryRun nothing is changed.
+func Prune(dbRepo DbRepo, setting GlobalSetting, now time.Time, dryRun bool) (PruneReport, error) {
+	var report PruneReport
+	if setting.LogRetentionDays == 0 && setting.KeepRuns == 0 && setting.CompressAfterDays == 0 {
+		return report, nil
+	}
+
+	jobs, err := dbRepo.ListJob(JobFilter{})
+	if err != nil {
+		return report, err
+	}
+
+	type groupKey struct{ repo, name, branch string }
+	kept := map[groupKey]int{}
+	retainCutoff := now.AddDate(0, 0, -setting.LogRetentionDays)
+	compressCutoff := now.AddDate(0, 0, -setting.CompressAfterDays)
+
+	// ListJob is newest first, so the first KeepRuns of a group are kept.
+	for _, job := range jobs {
+		if !IsTerminalStatus(job.Status) {
+			continue
+		}
+		ended := job.End
+		if ended.IsZero() {
+			ended = job.Start
+		}
+
+		k := groupKey{job.Repo, job.Name, job.Branch}
+		tooMany := setting.KeepRuns > 0 && kept[k] >= setting.KeepRuns
+		tooOld := setting.LogRetentionDays > 0 && ended.Before(retainCutoff)
+		if kept[k] > 0 && (tooMany || tooOld) {
+			freed, err := deleteRun(dbRepo, job, dryRun)
+			if err != nil {
+				return report, err
+			}
+			report.DeletedRuns = append(report.DeletedRuns, job)
+			report.FreedBytes += freed
+			continue
+		}
+		kept[k]++
+
+		if setting.CompressAfterDays > 0 && ended.Before(compressCutoff) {
+			logPath := RunLogPath(job)
+			if _, err := os.Stat(logPath); err != nil {
+				continue // already compressed, or no log
+			}
+			saved, ok, err := compressLog(logPath, dryRun)
+			if err != nil {
+				return report, err
+			}
+			if ok {
+				report.CompressedLogs = append(report.CompressedLogs, logPath)
+				report.FreedBytes += saved
+			}
+		}
+	}
+	return report, nil
+}
+
+// deleteRun removes job's files and row, returning the bytes the files took.
+func deleteRun(dbRepo DbRepo, job Job, dryRun bool) (int64, error) {
+	logPath := RunLogPath(job)
+	var freed int64
+	for _, path := range []string{logPath, logPath + ".gz", changedFilesPath(logPath)} {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		freed += info.Size()
+		if dryRun {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return freed, fmt.Errorf("remove %s: %w", path, err)
+		}
+	}
+	if dryRun {
+		return freed, nil
+	}
+	return freed, dbRepo.DeleteJob(job.ID)
+}
+
+// compressLog replaces path with path.gz and returns the bytes saved. Logs
+// too small for gzip to shrink are left as they are, and ok is false.
+func compressLog(path string, dryRun bool) (saved int64, ok bool, err error) {
+	if dryRun {
+		return 0, true, nil
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, false, fmt.Errorf("open log: %w", err)
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return 0, false, fmt.Errorf("stat log: %w", err)
+	}
+
+	tmp := path + ".gz.tmp"
+	dst, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return 0, false, fmt.Errorf("create compressed log: %w", err)
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = dst.Close()
+	} else {
+		_ = dst.Close()
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return 0, false, fmt.Errorf("compress log %s: %w", path, err)
+	}
+
+	gzInfo, err := os.Stat(tmp)
+	if err != nil {
+		return 0, false, fmt.Errorf("stat compressed log: %w", err)
+	}
+	if gzInfo.Size() >= info.Size() {
+		_ = os.Remove(tmp)
+		return 0, false, nil
+	}
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		return 0, false, fmt.Errorf("rename compressed log: %w", err)
+	}
+	if err := os.Remove(path); err != nil {
+		return 0, false, fmt.Errorf("remove compressed log source: %w", err)
+	}
+	return info.Size() - gzInfo.Size(), true, nil
+}
+
+// OpenJobLog opens the log at path for reading, transparently reading
+// path.gz instead once Prune has compressed it.
+func OpenJobLog(path string) (io.ReadCloser, error) {
+	if !strings.HasSuffix(path, ".gz") {
+		f, err := os.Open(path)
+		if err == nil {
+			return f, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, err
+		}
+		path += ".gz"
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("read compressed log: %w", err)
+	}
+	return gzipLog{Reader: zr, f: f}, nil
+}
+
+type gzipLog struct {
+	*gzip.Reader
+	f *os.File
+}
+
+func (g gzipLog) Close() error {
+	_ = g.Reader.Close()
+	return g.f.Close()
+}
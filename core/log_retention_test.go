@@ -0,0 +1,184 @@
+package core
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPrune(t *testing.T) {
+	log := strings.Repeat("building...\n", 500)
+	tests := []struct {
+		name           string
+		setting        GlobalSetting
+		days           int // how long after the runs ended Prune runs
+		dryRun         bool
+		wantDeleted    []string
+		wantCompressed []string
+	}{
+		{
+			name:    "nothing set",
+			setting: GlobalSetting{},
+			days:    365,
+		},
+		{
+			name:        "keep runs",
+			setting:     GlobalSetting{KeepRuns: 2},
+			wantDeleted: []string{"build 1"},
+		},
+		{
+			name:        "retention",
+			setting:     GlobalSetting{LogRetentionDays: 30},
+			days:        60,
+			wantDeleted: []string{"build 1", "build 2"},
+		},
+		{
+			name:    "retention not reached",
+			setting: GlobalSetting{LogRetentionDays: 30},
+			days:    10,
+		},
+		{
+			name:           "compress",
+			setting:        GlobalSetting{CompressAfterDays: 10},
+			days:           20,
+			wantCompressed: []string{"build 1", "build 2", "build 3", "test 1"},
+		},
+		{
+			name:           "compress what is kept",
+			setting:        GlobalSetting{KeepRuns: 1, CompressAfterDays: 10},
+			days:           20,
+			wantDeleted:    []string{"build 1", "build 2"},
+			wantCompressed: []string{"build 3", "test 1"},
+		},
+		{
+			name:           "dry run",
+			setting:        GlobalSetting{KeepRuns: 1, CompressAfterDays: 10},
+			days:           20,
+			dryRun:         true,
+			wantDeleted:    []string{"build 1", "build 2"},
+			wantCompressed: []string{"build 3", "test 1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			oldRoot := Root
+			Root = t.TempDir()
+			t.Cleanup(func() { Root = oldRoot })
+			dbRepo := newTestRepo(t)
+
+			runs := map[string]Job{}
+			for _, run := range []struct {
+				key, name, status string
+			}{
+				{"build 1", "build", StatusFinished},
+				{"build 2", "build", StatusFailed},
+				{"build 3", "build", StatusFinished},
+				{"test 1", "test", StatusCanceled},
+				{"test pending", "test", StatusPending},
+			} {
+				job, err := dbRepo.CreateJob(Job{Repo: "o/app", Name: run.name, Branch: "main", SHA: run.key})
+				if err != nil {
+					t.Fatal(err)
+				}
+				job.LogPath = JobLogPath(job)
+				if err := os.MkdirAll(filepath.Dir(job.LogPath), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(job.LogPath, []byte(log), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if err := dbRepo.SetJobLogPath(job.ID, job.LogPath); err != nil {
+					t.Fatal(err)
+				}
+				if err := dbRepo.UpdateJob(job.ID, run.status, ""); err != nil {
+					t.Fatal(err)
+				}
+				runs[run.key] = job
+			}
+
+			report, err := Prune(dbRepo, tt.setting, time.Now().AddDate(0, 0, tt.days), tt.dryRun)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keyOf := map[string]string{}
+			for key, job := range runs {
+				keyOf[job.LogPath] = key
+			}
+			var deleted, compressed []string
+			for _, job := range report.DeletedRuns {
+				deleted = append(deleted, keyOf[job.LogPath])
+			}
+			for _, path := range report.CompressedLogs {
+				compressed = append(compressed, keyOf[path])
+			}
+			sort.Strings(deleted)
+			sort.Strings(compressed)
+			if !reflect.DeepEqual(deleted, tt.wantDeleted) {
+				t.Errorf("deleted %q, want %q", deleted, tt.wantDeleted)
+			}
+			if !reflect.DeepEqual(compressed, tt.wantCompressed) {
+				t.Errorf("compressed %q, want %q", compressed, tt.wantCompressed)
+			}
+			if did := len(deleted) > 0 || len(compressed) > 0; did != (report.FreedBytes > 0) {
+				t.Errorf("freed %d bytes", report.FreedBytes)
+			}
+
+			// What the report says was done is what was done, unless dry.
+			for key, job := range runs {
+				wantRow, wantLog, wantGz := true, true, false
+				if !tt.dryRun {
+					for _, k := range tt.wantDeleted {
+						if k == key {
+							wantRow, wantLog = false, false
+						}
+					}
+					for _, k := range tt.wantCompressed {
+						if k == key {
+							wantLog, wantGz = false, true
+						}
+					}
+				}
+				_, err := dbRepo.GetJob(job.ID)
+				_, logErr := os.Stat(job.LogPath)
+				_, gzErr := os.Stat(job.LogPath + ".gz")
+				if (err == nil) != wantRow || (logErr == nil) != wantLog || (gzErr == nil) != wantGz {
+					t.Errorf("%s: row %v, log %v, gz %v; want %v, %v, %v", key, err == nil, logErr == nil, gzErr == nil, wantRow, wantLog, wantGz)
+				}
+				if wantGz {
+					r, err := OpenJobLog(job.LogPath)
+					if err != nil {
+						t.Fatal(err)
+					}
+					b, err := io.ReadAll(r)
+					_ = r.Close()
+					if err != nil || string(b) != log {
+						t.Errorf("%s: compressed log reads back %d bytes, %v", key, len(b), err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestCompressLogKeepsSmallLogs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.log")
+	if err := os.WriteFile(path, []byte("ok\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	saved, ok, err := compressLog(path, false)
+	if err != nil || ok || saved != 0 {
+		t.Errorf("compressLog = %d, %v, %v; want the log left as it is", saved, ok, err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(path + ".gz"); !os.IsNotExist(err) {
+		t.Errorf("%s.gz left behind", path)
+	}
+}
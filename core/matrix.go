@@ -0,0 +1,251 @@
+package core
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// JobMatrix matches the matrix: entry of a job. Every key except include
+// and exclude is an axis; the job runs once per combination of axis values.
+//
+//	matrix:
+//	  go: ["1.24", "1.25"]
+//	  db: [pg, sqlite]
+//	  exclude:
+//	    - {go: "1.24", db: sqlite}
+//	  include:
+//	    - {go: "1.23", db: pg}
+type JobMatrix struct {
+	Axes    []MatrixAxis
+	Include [][]MatrixValue // extra combinations, added as-is
+	Exclude [][]MatrixValue // partial combinations to drop
+}
+
+type MatrixAxis struct {
+	Key    string
+	Values []string
+}
+
+// MatrixValue is one key=value of a matrix combination.
+type MatrixValue struct {
+	Key   string
+	Value string
+}
+
+func (m *JobMatrix) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.MappingNode {
+		return confErrorf(node.Line, "must be a map of axis to values")
+	}
+
+	var out JobMatrix
+	seen := map[string]bool{}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		keyNode, valNode := node.Content[i], node.Content[i+1]
+		key := strings.TrimSpace(keyNode.Value)
+		if seen[key] {
+			return confErrorf(keyNode.Line, "duplicate key %q", key)
+		}
+		seen[key] = true
+		switch key {
+		case "include", "exclude":
+			combos, err := decodeMatrixCombos(valNode)
+			if err != nil {
+				err.Msg = key + ": " + err.Msg
+				return err
+			}
+			if key == "include" {
+				out.Include = combos
+			} else {
+				out.Exclude = combos
+			}
+		default:
+			if !validMatrixKey(key) {
+				return confErrorf(keyNode.Line, "invalid axis name %q", key)
+			}
+			var values []string
+			if err := valNode.Decode(&values); err != nil {
+				return confErrorf(valNode.Line, "%s must be a list of values", key)
+			}
+			if len(values) == 0 {
+				return confErrorf(valNode.Line, "%s has no values", key)
+			}
+			for _, v := range values {
+				if !validMatrixValue(v) {
+					return confErrorf(valNode.Line, "%s: value %q must not contain %s", key, v, matrixValueSeparators)
+				}
+			}
+			out.Axes = append(out.Axes, MatrixAxis{Key: key, Values: values})
+		}
+	}
+
+	*m = out
+	return nil
+}
+
+func decodeMatrixCombos(node *yaml.Node) ([][]MatrixValue, *ConfError) {
+	if node.Kind != yaml.SequenceNode {
+		return nil, confErrorf(node.Line, "must be a list of maps")
+	}
+
+	var combos [][]MatrixValue
+	for _, item := range node.Content {
+		if item.Kind != yaml.MappingNode {
+			return nil, confErrorf(item.Line, "must be a map")
+		}
+		var combo []MatrixValue
+		for i := 0; i+1 < len(item.Content); i += 2 {
+			key := strings.TrimSpace(item.Content[i].Value)
+			if !validMatrixKey(key) {
+				return nil, confErrorf(item.Content[i].Line, "invalid axis name %q", key)
+			}
+			var value string
+			if err := item.Content[i+1].Decode(&value); err != nil {
+				return nil, confErrorf(item.Content[i+1].Line, "value of %s must be a scalar", key)
+			}
+			if !validMatrixValue(value) {
+				return nil, confErrorf(item.Content[i+1].Line, "%s: value %q must not contain %s", key, value, matrixValueSeparators)
+			}
+			combo = append(combo, MatrixValue{Key: key, Value: value})
+		}
+		combos = append(combos, combo)
+	}
+	return combos, nil
+}
+
+var matrixKeyRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+func validMatrixKey(key string) bool {
+	return matrixKeyRe.MatchString(key)
+}
+
+// matrixValueSeparators are what MatrixJobName joins a combination with;
+// SplitMatrixJobName couldn't take a value with one of them back apart.
+const matrixValueSeparators = ", = [ or ]"
+
+func validMatrixValue(v string) bool {
+	return !strings.ContainsAny(v, ",=[]")
+}
+
+// Combinations expands the matrix: the cartesian product of the axes in
+// declaration order, minus excluded combinations, plus included ones.
+func (m JobMatrix) Combinations() [][]MatrixValue {
+	var combos [][]MatrixValue
+	if len(m.Axes) > 0 {
+		combos = [][]MatrixValue{nil}
+		for _, axis := range m.Axes {
+			next := make([][]MatrixValue, 0, len(combos)*len(axis.Values))
+			for _, combo := range combos {
+				for _, v := range axis.Values {
+					c := append(append([]MatrixValue{}, combo...), MatrixValue{Key: axis.Key, Value: v})
+					next = append(next, c)
+				}
+			}
+			combos = next
+		}
+	}
+
+	kept := combos[:0]
+	for _, combo := range combos {
+		excluded := false
+		for _, ex := range m.Exclude {
+			if comboHasAll(combo, ex) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			kept = append(kept, combo)
+		}
+	}
+	combos = kept
+
+	for _, inc := range m.Include {
+		combo := m.orderCombo(inc)
+		dup := false
+		for _, existing := range combos {
+			if matrixSuffix(existing) == matrixSuffix(combo) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			combos = append(combos, combo)
+		}
+	}
+	return combos
+}
+
+// orderCombo puts axis keys first in axis order, then any extra keys sorted.
+func (m JobMatrix) orderCombo(combo []MatrixValue) []MatrixValue {
+	rank := make(map[string]int, len(m.Axes))
+	for i, axis := range m.Axes {
+		rank[axis.Key] = i
+	}
+	out := append([]MatrixValue{}, combo...)
+	sort.SliceStable(out, func(i, j int) bool {
+		ri, iAxis := rank[out[i].Key]
+		rj, jAxis := rank[out[j].Key]
+		switch {
+		case iAxis && jAxis:
+			return ri < rj
+		case iAxis != jAxis:
+			return iAxis
+		default:
+			return out[i].Key < out[j].Key
+		}
+	})
+	return out
+}
+
+func comboHasAll(combo, subset []MatrixValue) bool {
+	for _, want := range subset {
+		found := false
+		for _, v := range combo {
+			if v.Key == want.Key && v.Value == want.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func matrixSuffix(combo []MatrixValue) string {
+	parts := make([]string, 0, len(combo))
+	for _, v := range combo {
+		parts = append(parts, v.Key+"="+v.Value)
+	}
+	return "[" + strings.Join(parts, ",") + "]"
+}
+
+// MatrixJobName is the job name of one matrix combination, e.g.
+// test[go=1.24,db=pg].
+func MatrixJobName(base string, combo []MatrixValue) string {
+	return base + matrixSuffix(combo)
+}
+
+// SplitMatrixJobName splits test[go=1.24,db=pg] into "test" and
+// "go=1.24,db=pg". Names of plain jobs come back with an empty combo.
+func SplitMatrixJobName(name string) (base, combo string) {
+	i := strings.Index(name, "[")
+	if i <= 0 || !strings.HasSuffix(name, "]") {
+		return name, ""
+	}
+	return name[:i], name[i+1 : len(name)-1]
+}
+
+// MatrixEnv returns REFCI_MATRIX_<KEY>=value for each value of combo.
+func MatrixEnv(combo []MatrixValue) []string {
+	out := make([]string, 0, len(combo))
+	for _, v := range combo {
+		key := strings.ToUpper(strings.ReplaceAll(v.Key, "-", "_"))
+		out = append(out, "REFCI_MATRIX_"+key+"="+v.Value)
+	}
+	return out
+}
@@ -0,0 +1,198 @@
+package core
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestParseJobConfsRejectsMatrixSeparators(t *testing.T) {
+	tests := []struct {
+		name    string
+		matrix  string
+		wantMsg string
+	}{
+		{"comma in an axis", `{go: ["1.24,1.25"]}`, `go: value "1.24,1.25" must not contain , = [ or ]`},
+		{"equals in an axis", `{db: ["a=b"]}`, `db: value "a=b" must not contain , = [ or ]`},
+		{"bracket in an axis", `{os: ["[x"]}`, `os: value "[x" must not contain , = [ or ]`},
+		{"bracket in include", `{go: ["1.24"], include: [{go: "1.25]"}]}`, `include: go: value "1.25]" must not contain , = [ or ]`},
+		{"comma in exclude", `{go: ["1.24"], exclude: [{go: "a,b"}]}`, `exclude: go: value "a,b" must not contain , = [ or ]`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseJobConfs("test:\n  script: test.sh\n  matrix: " + tt.matrix + "\n")
+			var errs ConfErrors
+			if !errors.As(err, &errs) || len(errs) != 1 {
+				t.Fatalf("ParseJobConfs = %v, want one ConfError", err)
+			}
+			if e := errs[0]; e.Job != "test" || e.Field != "matrix" || e.Msg != tt.wantMsg {
+				t.Errorf("error is %+v, want job test, field matrix, %q", *e, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestMatrixCombinations(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		want []string
+	}{
+		{
+			name: "one axis",
+			yaml: `{go: ["1.24", "1.25"]}`,
+			want: []string{"[go=1.24]", "[go=1.25]"},
+		},
+		{
+			name: "product in declaration order",
+			yaml: `{go: ["1.24", "1.25"], db: [pg, sqlite]}`,
+			want: []string{"[go=1.24,db=pg]", "[go=1.24,db=sqlite]", "[go=1.25,db=pg]", "[go=1.25,db=sqlite]"},
+		},
+		{
+			name: "partial exclude",
+			yaml: `{go: ["1.24", "1.25"], db: [pg, sqlite], exclude: [{db: sqlite}]}`,
+			want: []string{"[go=1.24,db=pg]", "[go=1.25,db=pg]"},
+		},
+		{
+			name: "full exclude",
+			yaml: `{go: ["1.24", "1.25"], db: [pg, sqlite], exclude: [{go: "1.24", db: sqlite}]}`,
+			want: []string{"[go=1.24,db=pg]", "[go=1.25,db=pg]", "[go=1.25,db=sqlite]"},
+		},
+		{
+			name: "include in axis order",
+			yaml: `{go: ["1.24"], db: [pg], include: [{db: mysql, go: "1.23"}]}`,
+			want: []string{"[go=1.24,db=pg]", "[go=1.23,db=mysql]"},
+		},
+		{
+			name: "include with extra keys sorted after the axes",
+			yaml: `{go: ["1.24"], include: [{race: "on", go: "1.25", arch: arm}]}`,
+			want: []string{"[go=1.24]", "[go=1.25,arch=arm,race=on]"},
+		},
+		{
+			name: "include of an existing combination",
+			yaml: `{go: ["1.24"], include: [{go: "1.24"}]}`,
+			want: []string{"[go=1.24]"},
+		},
+		{
+			name: "include only",
+			yaml: `{include: [{go: "1.24"}, {go: "1.25"}]}`,
+			want: []string{"[go=1.24]", "[go=1.25]"},
+		},
+		{
+			name: "everything excluded",
+			yaml: `{go: ["1.24"], exclude: [{go: "1.24"}]}`,
+			want: nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var m JobMatrix
+			if err := yaml.Unmarshal([]byte(tt.yaml), &m); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, combo := range m.Combinations() {
+				got = append(got, matrixSuffix(combo))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Combinations = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJobMatrixUnmarshalErrors(t *testing.T) {
+	tests := []struct {
+		yaml    string
+		wantMsg string
+	}{
+		{`[go]`, "must be a map of axis to values"},
+		{`{go: ["1.24"], go: ["1.25"]}`, `duplicate key "go"`},
+		{`{"1go": [a]}`, `invalid axis name "1go"`},
+		{`{go: "1.24"}`, "go must be a list of values"},
+		{`{go: []}`, "go has no values"},
+		{`{go: [a], include: {go: b}}`, "include: must be a list of maps"},
+		{`{go: [a], exclude: [b]}`, "exclude: must be a map"},
+		{`{go: [a], include: [{"a b": c}]}`, `include: invalid axis name "a b"`},
+		{`{go: [a], include: [{go: [b]}]}`, "include: value of go must be a scalar"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.yaml, func(t *testing.T) {
+			var m JobMatrix
+			err := yaml.Unmarshal([]byte(tt.yaml), &m)
+			var ce *ConfError
+			if !errors.As(err, &ce) || ce.Msg != tt.wantMsg {
+				t.Errorf("Unmarshal = %v, want %q", err, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestSplitMatrixJobName(t *testing.T) {
+	tests := []struct {
+		name  string
+		base  string
+		combo string
+	}{
+		{"test[go=1.24,db=pg]", "test", "go=1.24,db=pg"},
+		{"test[go=1.24]", "test", "go=1.24"},
+		{"test", "test", ""},
+		{"test[]", "test", ""},
+		{"[go=1.24]", "[go=1.24]", ""},
+		{"test[go=1.24", "test[go=1.24", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base, combo := SplitMatrixJobName(tt.name)
+			if base != tt.base || combo != tt.combo {
+				t.Errorf("SplitMatrixJobName(%q) = %q, %q; want %q, %q", tt.name, base, combo, tt.base, tt.combo)
+			}
+		})
+	}
+
+	// Names made by MatrixJobName split back into their parts.
+	combo := []MatrixValue{{Key: "go", Value: "1.24"}, {Key: "db-kind", Value: "pg"}}
+	if base, got := SplitMatrixJobName(MatrixJobName("test", combo)); base != "test" || got != "go=1.24,db-kind=pg" {
+		t.Errorf("round trip = %q, %q", base, got)
+	}
+}
+
+func TestMatrixEnv(t *testing.T) {
+	got := MatrixEnv([]MatrixValue{{Key: "go", Value: "1.24"}, {Key: "db-kind", Value: "pg"}})
+	want := []string{"REFCI_MATRIX_GO=1.24", "REFCI_MATRIX_DB_KIND=pg"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("MatrixEnv = %q, want %q", got, want)
+	}
+}
+
+func TestParseJobConfsExpandsMatrix(t *testing.T) {
+	confs, err := ParseJobConfs(`
+test:
+  script: test.sh
+  matrix:
+    go: ["1.24", "1.25"]
+deploy:
+  script: deploy.sh
+  needs: [test]
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]JobConf{}
+	var names []string
+	for _, c := range confs {
+		byName[c.Name] = c
+		names = append(names, c.Name)
+	}
+	if want := []string{"deploy", "test[go=1.24]", "test[go=1.25]"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("jobs = %q, want %q", names, want)
+	}
+	if got := byName["test[go=1.25]"]; got.ScriptPath != "test.sh" || !reflect.DeepEqual(got.Matrix, []MatrixValue{{Key: "go", Value: "1.25"}}) {
+		t.Errorf("test[go=1.25] = %+v", got)
+	}
+	if got, want := byName["deploy"].Needs, []string{"test[go=1.24]", "test[go=1.25]"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("deploy needs %q, want every combination %q", got, want)
+	}
+}
@@ -0,0 +1,401 @@
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// migration is one forward-only schema step. Steps are applied in version
+// order, each inside its own transaction, and recorded in schema_version.
+type migration struct {
+	version  int
+	name     string
+	sqlite   []string
+	postgres []string
+}
+
+// migrations must only ever be appended to; released versions are never
+// edited because existing roots have already recorded them.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "create jobs",
+		sqlite: []string{
+			`CREATE TABLE IF NOT EXISTS jobs (
+				repo TEXT NOT NULL,
+				name TEXT NOT NULL,
+				branch TEXT NOT NULL,
+				sha TEXT NOT NULL,
+				start_at TEXT NOT NULL,
+				end_at TEXT,
+				status TEXT NOT NULL,
+				msg TEXT NOT NULL DEFAULT '',
+				PRIMARY KEY (repo, name, branch, sha)
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_jobs_repo_name_branch_status_start
+			 ON jobs(repo, name, branch, status, start_at DESC);`,
+		},
+		postgres: []string{
+			`CREATE TABLE IF NOT EXISTS jobs (
+				repo TEXT NOT NULL,
+				name TEXT NOT NULL,
+				branch TEXT NOT NULL,
+				sha TEXT NOT NULL,
+				start_at TIMESTAMPTZ NOT NULL,
+				end_at TIMESTAMPTZ,
+				status TEXT NOT NULL,
+				msg TEXT NOT NULL DEFAULT '',
+				PRIMARY KEY (repo, name, branch, sha)
+			);`,
+			`CREATE INDEX IF NOT EXISTS idx_jobs_repo_name_branch_status_start
+			 ON jobs(repo, name, branch, status, start_at DESC);`,
+		},
+	},
+	{
+		version: 2,
+		name:    "job run ids",
+		sqlite: []string{
+			// sqlite cannot change a primary key in place, so rebuild the table.
+			`CREATE TABLE jobs_v2 (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				repo TEXT NOT NULL,
+				name TEXT NOT NULL,
+				branch TEXT NOT NULL,
+				sha TEXT NOT NULL,
+				attempt INTEGER NOT NULL DEFAULT 1,
+				start_at TEXT NOT NULL,
+				end_at TEXT,
+				status TEXT NOT NULL,
+				msg TEXT NOT NULL DEFAULT ''
+			);`,
+			`INSERT INTO jobs_v2 (repo, name, branch, sha, attempt, start_at, end_at, status, msg)
+			 SELECT repo, name, branch, sha, 1, start_at, end_at, status, msg
+			 FROM jobs
+			 ORDER BY start_at;`,
+			`DROP TABLE jobs;`,
+			`ALTER TABLE jobs_v2 RENAME TO jobs;`,
+			`CREATE INDEX idx_jobs_repo_name_branch_status_start
+			 ON jobs(repo, name, branch, status, start_at DESC);`,
+			`CREATE UNIQUE INDEX idx_jobs_run_attempt
+			 ON jobs(repo, name, branch, sha, attempt);`,
+		},
+		postgres: []string{
+			`ALTER TABLE jobs DROP CONSTRAINT jobs_pkey;`,
+			`ALTER TABLE jobs ADD COLUMN attempt INTEGER NOT NULL DEFAULT 1;`,
+			`ALTER TABLE jobs ADD COLUMN id BIGSERIAL PRIMARY KEY;`,
+			`CREATE UNIQUE INDEX idx_jobs_run_attempt
+			 ON jobs(repo, name, branch, sha, attempt);`,
+		},
+	},
+	{
+		version: 3,
+		name:    "job trigger",
+		sqlite: []string{
+			`ALTER TABLE jobs ADD COLUMN trigger TEXT NOT NULL DEFAULT 'poll';`,
+		},
+		postgres: []string{
+			`ALTER TABLE jobs ADD COLUMN trigger TEXT NOT NULL DEFAULT 'poll';`,
+		},
+	},
+	{
+		version: 4,
+		name:    "job owner",
+		sqlite: []string{
+			`ALTER TABLE jobs ADD COLUMN owner TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE jobs ADD COLUMN pid INTEGER NOT NULL DEFAULT 0;`,
+			`CREATE INDEX idx_jobs_status ON jobs(status);`,
+		},
+		postgres: []string{
+			`ALTER TABLE jobs ADD COLUMN owner TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE jobs ADD COLUMN pid INTEGER NOT NULL DEFAULT 0;`,
+			`CREATE INDEX idx_jobs_status ON jobs(status);`,
+		},
+	},
+	{
+		version: 5,
+		name:    "settings",
+		sqlite: []string{
+			`CREATE TABLE settings (
+				key TEXT PRIMARY KEY,
+				value TEXT NOT NULL
+			);`,
+		},
+		postgres: []string{
+			`CREATE TABLE settings (
+				key TEXT PRIMARY KEY,
+				value TEXT NOT NULL
+			);`,
+		},
+	},
+	{
+		version: 6,
+		name:    "repos",
+		sqlite: []string{
+			`CREATE TABLE repos (
+				repo TEXT PRIMARY KEY,
+				url TEXT NOT NULL DEFAULT '',
+				cloned_at TEXT,
+				poll_interval_ms INTEGER NOT NULL DEFAULT 0,
+				enabled INTEGER NOT NULL DEFAULT 1
+			);`,
+			`CREATE TABLE repo_settings (
+				repo TEXT NOT NULL,
+				key TEXT NOT NULL,
+				value TEXT NOT NULL,
+				PRIMARY KEY (repo, key)
+			);`,
+		},
+		postgres: []string{
+			`CREATE TABLE repos (
+				repo TEXT PRIMARY KEY,
+				url TEXT NOT NULL DEFAULT '',
+				cloned_at TIMESTAMPTZ,
+				poll_interval_ms BIGINT NOT NULL DEFAULT 0,
+				enabled BOOLEAN NOT NULL DEFAULT TRUE
+			);`,
+			`CREATE TABLE repo_settings (
+				repo TEXT NOT NULL,
+				key TEXT NOT NULL,
+				value TEXT NOT NULL,
+				PRIMARY KEY (repo, key)
+			);`,
+		},
+	},
+	{
+		version: 7,
+		name:    "repo health",
+		sqlite: []string{
+			`CREATE TABLE repo_health (
+				repo TEXT PRIMARY KEY,
+				state TEXT NOT NULL,
+				failures INTEGER NOT NULL DEFAULT 0,
+				last_error TEXT NOT NULL DEFAULT '',
+				last_poll_at TEXT,
+				last_failure_at TEXT,
+				next_poll_at TEXT,
+				conf_sha TEXT NOT NULL DEFAULT '',
+				conf_error TEXT NOT NULL DEFAULT ''
+			);`,
+		},
+		postgres: []string{
+			`CREATE TABLE repo_health (
+				repo TEXT PRIMARY KEY,
+				state TEXT NOT NULL,
+				failures INTEGER NOT NULL DEFAULT 0,
+				last_error TEXT NOT NULL DEFAULT '',
+				last_poll_at TIMESTAMPTZ,
+				last_failure_at TIMESTAMPTZ,
+				next_poll_at TIMESTAMPTZ,
+				conf_sha TEXT NOT NULL DEFAULT '',
+				conf_error TEXT NOT NULL DEFAULT ''
+			);`,
+		},
+	},
+	{
+		version: 8,
+		name:    "job ref type",
+		sqlite: []string{
+			`ALTER TABLE jobs ADD COLUMN ref_type TEXT NOT NULL DEFAULT 'branch';`,
+		},
+		postgres: []string{
+			`ALTER TABLE jobs ADD COLUMN ref_type TEXT NOT NULL DEFAULT 'branch';`,
+		},
+	},
+	{
+		version: 9,
+		name:    "job exit",
+		sqlite: []string{
+			`ALTER TABLE jobs ADD COLUMN exit_code INTEGER;`,
+			`ALTER TABLE jobs ADD COLUMN signal TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE jobs ADD COLUMN duration_ms INTEGER NOT NULL DEFAULT 0;`,
+			`ALTER TABLE jobs ADD COLUMN user_cpu_ms INTEGER NOT NULL DEFAULT 0;`,
+			`ALTER TABLE jobs ADD COLUMN sys_cpu_ms INTEGER NOT NULL DEFAULT 0;`,
+			`ALTER TABLE jobs ADD COLUMN max_rss_bytes INTEGER NOT NULL DEFAULT 0;`,
+		},
+		postgres: []string{
+			`ALTER TABLE jobs ADD COLUMN exit_code INTEGER;`,
+			`ALTER TABLE jobs ADD COLUMN signal TEXT NOT NULL DEFAULT '';`,
+			`ALTER TABLE jobs ADD COLUMN duration_ms BIGINT NOT NULL DEFAULT 0;`,
+			`ALTER TABLE jobs ADD COLUMN user_cpu_ms BIGINT NOT NULL DEFAULT 0;`,
+			`ALTER TABLE jobs ADD COLUMN sys_cpu_ms BIGINT NOT NULL DEFAULT 0;`,
+			`ALTER TABLE jobs ADD COLUMN max_rss_bytes BIGINT NOT NULL DEFAULT 0;`,
+		},
+	},
+	{
+		version: 10,
+		name:    "job log path",
+		// msg used to hold the log path of running runs.
+		sqlite: []string{
+			`ALTER TABLE jobs ADD COLUMN log_path TEXT NOT NULL DEFAULT '';`,
+			`UPDATE jobs SET log_path = msg, msg = '' WHERE status = 'running';`,
+		},
+		postgres: []string{
+			`ALTER TABLE jobs ADD COLUMN log_path TEXT NOT NULL DEFAULT '';`,
+			`UPDATE jobs SET log_path = msg, msg = '' WHERE status = 'running';`,
+		},
+	},
+	{
+		version: 11,
+		name:    "job pid start",
+		sqlite: []string{
+			`ALTER TABLE jobs ADD COLUMN pid_start TEXT NOT NULL DEFAULT '';`,
+		},
+		postgres: []string{
+			`ALTER TABLE jobs ADD COLUMN pid_start TEXT NOT NULL DEFAULT '';`,
+		},
+	},
+	{
+		version: 12,
+		name:    "repo health queue error",
+		sqlite: []string{
+			`ALTER TABLE repo_health ADD COLUMN queue_error TEXT NOT NULL DEFAULT '';`,
+		},
+		postgres: []string{
+			`ALTER TABLE repo_health ADD COLUMN queue_error TEXT NOT NULL DEFAULT '';`,
+		},
+	},
+	{
+		version: 13,
+		name:    "job tag patterns",
+		sqlite: []string{
+			`CREATE TABLE job_tag_patterns (
+				repo TEXT NOT NULL,
+				name TEXT NOT NULL,
+				patterns TEXT NOT NULL,
+				PRIMARY KEY (repo, name)
+			);`,
+		},
+		postgres: []string{
+			`CREATE TABLE job_tag_patterns (
+				repo TEXT NOT NULL,
+				name TEXT NOT NULL,
+				patterns TEXT NOT NULL,
+				PRIMARY KEY (repo, name)
+			);`,
+		},
+	},
+}
+
+// migrateLockID serializes postgres migrations across refci hosts.
+const migrateLockID = 7_265_636_900
+
+// LatestSchemaVersion is the schema version this binary expects.
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion returns the highest applied migration version, or 0 for a
+// database that has never been migrated.
+func SchemaVersion(db *sql.DB) (int, error) {
+	if err := ensureSchemaVersionTable(db); err != nil {
+		return 0, err
+	}
+	return currentSchemaVersion(db)
+}
+
+// Migrate applies all pending migrations and returns the ones it applied,
+// formatted as "<version> <name>". It refuses to touch a database written
+// by a newer refci.
+func Migrate(db *sql.DB, kind DBKind) ([]string, error) {
+	if err := ensureSchemaVersionTable(db); err != nil {
+		return nil, err
+	}
+
+	var applied []string
+	for _, m := range migrations {
+		ok, err := applyMigration(db, kind, m)
+		if err != nil {
+			return applied, err
+		}
+		if ok {
+			applied = append(applied, fmt.Sprintf("%04d %s", m.version, m.name))
+		}
+	}
+	return applied, nil
+}
+
+func ensureSchemaVersionTable(db *sql.DB) error {
+	stmt := `CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TEXT NOT NULL
+	);`
+	if _, err := db.Exec(stmt); err != nil {
+		return fmt.Errorf("ensure schema_version: %w", err)
+	}
+
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if latest := LatestSchemaVersion(); current > latest {
+		return fmt.Errorf("db schema version %d is newer than this refci supports (%d), upgrade refci", current, latest)
+	}
+	return nil
+}
+
+type queryRower interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+func currentSchemaVersion(q queryRower) (int, error) {
+	var v sql.NullInt64
+	if err := q.QueryRow(`SELECT MAX(version) FROM schema_version`).Scan(&v); err != nil {
+		return 0, fmt.Errorf("read schema version: %w", err)
+	}
+	return int(v.Int64), nil
+}
+
+func applyMigration(db *sql.DB, kind DBKind, m migration) (bool, error) {
+	var stmts []string
+	switch kind {
+	case DBSQLite:
+		stmts = m.sqlite
+	case DBPostgres:
+		stmts = m.postgres
+	default:
+		return false, fmt.Errorf("unsupported db kind: %q", kind)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, fmt.Errorf("migration %d: begin: %w", m.version, err)
+	}
+	defer tx.Rollback()
+
+	if kind == DBPostgres {
+		if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, migrateLockID); err != nil {
+			return false, fmt.Errorf("migration %d: lock: %w", m.version, err)
+		}
+	}
+
+	// Re-check inside the transaction: another process may have migrated
+	// while we were waiting.
+	current, err := currentSchemaVersion(tx)
+	if err != nil {
+		return false, err
+	}
+	if current >= m.version {
+		return false, nil
+	}
+
+	for _, stmt := range stmts {
+		if _, err := tx.Exec(stmt); err != nil {
+			return false, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+
+	insert := `INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)`
+	if kind == DBPostgres {
+		insert = `INSERT INTO schema_version (version, name, applied_at) VALUES ($1, $2, $3)`
+	}
+	if _, err := tx.Exec(insert, m.version, m.name, formatStoredTime(time.Now().UTC())); err != nil {
+		return false, fmt.Errorf("migration %d: record version: %w", m.version, err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("migration %d: commit: %w", m.version, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,161 @@
+package core
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// migrateToVersion applies the migrations up to and including version.
+func migrateToVersion(t *testing.T, db *sql.DB, kind DBKind, version int) {
+	t.Helper()
+	if err := ensureSchemaVersionTable(db); err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range migrations {
+		if m.version > version {
+			break
+		}
+		if _, err := applyMigration(db, kind, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// A root last opened by any earlier refci migrates to the latest schema,
+// keeping its runs.
+func TestMigrateFromEveryVersion(t *testing.T) {
+	kinds := []struct {
+		kind DBKind
+		open func(t *testing.T) *sql.DB
+	}{
+		{DBSQLite, func(t *testing.T) *sql.DB {
+			db, err := OpenDB(DBConfig{Kind: DBSQLite, SQLitePath: filepath.Join(t.TempDir(), "refci.db")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { _ = db.Close() })
+			return db
+		}},
+		{DBPostgres, func(t *testing.T) *sql.DB {
+			dsn := os.Getenv(testPostgresDSNEnv)
+			if dsn == "" {
+				t.Skip(testPostgresDSNEnv + " not set")
+			}
+			return newTestPostgresDB(t, dsn)
+		}},
+	}
+	start := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, k := range kinds {
+		for from := 0; from <= LatestSchemaVersion(); from++ {
+			t.Run(fmt.Sprintf("%s from %d", k.kind, from), func(t *testing.T) {
+				db := k.open(t)
+				d := dialect(k.kind)
+				migrateToVersion(t, db, k.kind, from)
+				if from >= 1 {
+					// Written with the columns of version 1, which every
+					// later version still has. Running runs kept their log
+					// path in msg until version 10.
+					for _, run := range [][]any{
+						{"build", StatusFailed, "exit status 1", d.timeArg(start.Add(time.Minute))},
+						{"test", StatusRunning, "/root/logs/test.log", nil},
+					} {
+						if _, err := db.Exec(d.bind(`INSERT INTO jobs (repo, name, branch, sha, start_at, end_at, status, msg)
+							VALUES ('o/app', ?, 'main', 'abc', ?, ?, ?, ?)`),
+							run[0], d.timeArg(start), run[3], run[1], run[2]); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+
+				applied, err := Migrate(db, k.kind)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var want []string
+				for _, m := range migrations[from:] {
+					want = append(want, fmt.Sprintf("%04d %s", m.version, m.name))
+				}
+				if !reflect.DeepEqual(applied, want) {
+					t.Errorf("applied %q, want %q", applied, want)
+				}
+				if v, err := SchemaVersion(db); err != nil || v != LatestSchemaVersion() {
+					t.Errorf("SchemaVersion = %d, %v; want %d", v, err, LatestSchemaVersion())
+				}
+				if again, err := Migrate(db, k.kind); err != nil || len(again) != 0 {
+					t.Errorf("migrating again applied %q, %v", again, err)
+				}
+
+				repo := sqlRepo{db: db, d: d}
+				if from >= 1 {
+					runs, err := repo.ListJob(JobFilter{Repo: "o/app"})
+					if err != nil {
+						t.Fatal(err)
+					}
+					got := map[string]Job{}
+					for _, run := range runs {
+						got[run.Name] = run
+					}
+					build, test := got["build"], got["test"]
+					if len(runs) != 2 || build.Attempt != 1 || build.Trigger != TriggerPoll || build.RefType != RefBranch ||
+						build.ExitCode != -1 || !build.Start.Equal(start) || !build.End.Equal(start.Add(time.Minute)) {
+						t.Errorf("runs after migrating = %+v", runs)
+					}
+					if build.Msg != "exit status 1" || build.LogPath != "" {
+						t.Errorf("failed run has msg %q, log %q", build.Msg, build.LogPath)
+					}
+					wantMsg, wantLog := "", "/root/logs/test.log"
+					if from >= 10 {
+						// Already past the move: msg is the status reason.
+						wantMsg, wantLog = wantLog, ""
+					}
+					if test.Msg != wantMsg || test.LogPath != wantLog {
+						t.Errorf("running run has msg %q, log %q; want %q, %q", test.Msg, test.LogPath, wantMsg, wantLog)
+					}
+				}
+
+				// The migrated schema works like a fresh one.
+				job, err := repo.CreateJob(Job{Repo: "o/app", Name: "build", Branch: "main", SHA: "abc"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				wantAttempt := 1
+				if from >= 1 {
+					wantAttempt = 2
+				}
+				if job.Attempt != wantAttempt {
+					t.Errorf("new run is attempt %d, want %d", job.Attempt, wantAttempt)
+				}
+				if err := repo.SaveCodeRepo(CodeRepo{Repo: "o/app", Enabled: true}); err != nil {
+					t.Fatal(err)
+				}
+				if err := repo.SaveRepoHealth(RepoHealth{Repo: "o/app", State: HealthOK, QueueError: "x"}); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
+
+func TestMigrateRejectsNewerSchema(t *testing.T) {
+	db, err := OpenDB(DBConfig{Kind: DBSQLite, SQLitePath: filepath.Join(t.TempDir(), "refci.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := Migrate(db, DBSQLite); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO schema_version (version, name, applied_at) VALUES (?, 'future', '')`, LatestSchemaVersion()+1); err != nil {
+		t.Fatal(err)
+	}
+	_, err = Migrate(db, DBSQLite)
+	if err == nil || !strings.Contains(err.Error(), "upgrade refci") {
+		t.Errorf("Migrate = %v, want a newer schema rejected", err)
+	}
+}
@@ -1 +1,17 @@
 package core
+
+import "database/sql"
+
+// PostgresRepo stores jobs in postgres, which several refci hosts can share.
+type PostgresRepo struct {
+	sqlRepo
+}
+
+var _ DbRepo = PostgresRepo{}
+
+func NewPostgresRepo(db *sql.DB) (*PostgresRepo, error) {
+	if _, err := Migrate(db, DBPostgres); err != nil {
+		return nil, err
+	}
+	return &PostgresRepo{sqlRepo{db: db, d: dialect(DBPostgres)}}, nil
+}
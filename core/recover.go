@@ -0,0 +1,204 @@
+package core
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RecoverMode is what happens to runs left pending or running by a refci
+// process that exited.
+type RecoverMode string
+
+const (
+	RecoverAbandon RecoverMode = "abandon" // record them as abandoned
+	RecoverRequeue RecoverMode = "requeue" // record them as abandoned and start a new attempt
+)
+
+func ParseRecoverMode(v string) (RecoverMode, error) {
+	switch mode := RecoverMode(strings.TrimSpace(v)); mode {
+	case RecoverAbandon, RecoverRequeue:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("recover mode must be abandon or requeue: %q", v)
+	}
+}
+
+var processOwner = sync.OnceValue(func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	instance := processStart(os.Getpid())
+	if instance == "" {
+		b := make([]byte, 8)
+		_, _ = rand.Read(b)
+		instance = hex.EncodeToString(b)
+	}
+	return host + ":" + strconv.Itoa(os.Getpid()) + ":" + instance
+})
+
+// ProcessOwner identifies this refci process in Job.Owner as
+// "host:pid:instance". instance is the processStart of this process, or a
+// random token where that is unknown, so a later refci that gets the same
+// pid, like PID 1 in a container, is a different owner.
+func ProcessOwner() string {
+	return processOwner()
+}
+
+// processStart identifies process pid for as long as it lives: the boot ID
+// and its start time since boot, so a later process reusing the pid, in
+// this boot or after a reboot, has a different one. It is "" when pid is
+// gone or /proc can't tell (not Linux).
+func processStart(pid int) string {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return ""
+	}
+	// The command name (field 2) may contain spaces and parentheses; the
+	// fields after it start past the last ')'.
+	i := bytes.LastIndexByte(stat, ')')
+	if i < 0 {
+		return ""
+	}
+	fields := strings.Fields(string(stat[i+1:]))
+	if len(fields) < 20 {
+		return ""
+	}
+	boot, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
+	if err != nil {
+		return ""
+	}
+	// fields[0] is field 3; the start time is field 22.
+	return strings.TrimSpace(string(boot)) + "/" + fields[19]
+}
+
+// RecoveredRun is a run RecoverJobs found orphaned.
+type RecoveredRun struct {
+	Job     Job  // as it was before being marked abandoned
+	Stopped bool // its script was still running and was stopped
+}
+
+// recoverGrace is how long a leftover script gets between SIGTERM and SIGKILL.
+var recoverGrace = 5 * time.Second
+
+// RecoverJobs marks the pending and running runs of repo (all repos when
+// empty) whose refci process on this host has exited as abandoned. A script
+// such a run left behind is stopped first: nothing waits on it any more and
+// its worktree may be handed to another run. It is only signalled when its
+// pid still has the processStart recorded for it. Runs of live processes
+// and of other hosts are left alone; runs recorded before owners were
+// tracked count as orphaned.
+func RecoverJobs(dbRepo DbRepo, repo string) ([]RecoveredRun, error) {
+	var out []RecoveredRun
+	for _, status := range []string{StatusRunning, StatusPending} {
+		jobs, err := dbRepo.ListJob(JobFilter{Repo: repo, Status: status})
+		if err != nil {
+			return out, err
+		}
+		for _, job := range jobs {
+			if !ownerGone(job.Owner) {
+				continue
+			}
+
+			rec := RecoveredRun{Job: job}
+			msg := fmt.Sprintf("refci exited while the job was %s", job.Status)
+			if job.Owner != "" {
+				msg = fmt.Sprintf("refci (%s) exited while the job was %s", job.Owner, job.Status)
+			}
+			if job.Status == StatusRunning && processGroupAlive(job.PID) {
+				if job.PIDStart != "" && processStart(job.PID) == job.PIDStart {
+					stopProcessGroup(job.PID, recoverGrace)
+					rec.Stopped = true
+					msg += fmt.Sprintf("; stopped its leftover process group %d", job.PID)
+				} else {
+					msg += fmt.Sprintf("; left process group %d alone, it can't be told to be the job's", job.PID)
+				}
+			}
+			if err := dbRepo.UpdateJob(job.ID, StatusAbandoned, msg); err != nil {
+				return out, err
+			}
+			appendJobLog(job, "[refci] run abandoned: "+msg)
+			out = append(out, rec)
+		}
+	}
+	return out, nil
+}
+
+// ownerGone reports whether the refci process owner ("host:pid:instance",
+// or "host:pid" from before instances were recorded) is known to have
+// exited. Owners on other hosts can't be checked and never are.
+func ownerGone(owner string) bool {
+	if owner == "" {
+		return true
+	}
+	if owner == ProcessOwner() {
+		return false
+	}
+	parts := strings.SplitN(owner, ":", 3)
+	if len(parts) < 2 {
+		return false
+	}
+	host, _, _ := strings.Cut(ProcessOwner(), ":")
+	if parts[0] != host {
+		return false
+	}
+	pid, err := strconv.Atoi(parts[1])
+	if err != nil || pid <= 0 {
+		return false
+	}
+	if pid == os.Getpid() {
+		// An earlier refci that had our pid.
+		return true
+	}
+	if errors.Is(syscall.Kill(pid, 0), syscall.ESRCH) {
+		return true
+	}
+	// The pid is taken; by the owner only if it started when the owner did.
+	if len(parts) == 3 {
+		if start := processStart(pid); start != "" && start != parts[2] {
+			return true
+		}
+	}
+	return false
+}
+
+func processGroupAlive(pgid int) bool {
+	if pgid <= 0 {
+		return false
+	}
+	err := syscall.Kill(-pgid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// stopProcessGroup sends SIGTERM to process group pgid and SIGKILL if it is
+// still there after grace.
+func stopProcessGroup(pgid int, grace time.Duration) {
+	_ = syscall.Kill(-pgid, syscall.SIGTERM)
+	deadline := time.Now().Add(grace)
+	for time.Now().Before(deadline) {
+		if !processGroupAlive(pgid) {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	_ = syscall.Kill(-pgid, syscall.SIGKILL)
+}
+
+// appendJobLog adds a line to the log of job, if it has one.
+func appendJobLog(job Job, line string) {
+	f, err := os.OpenFile(RunLogPath(job), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	_, _ = fmt.Fprintln(f, line)
+}
@@ -0,0 +1,46 @@
+package core
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestOwnerGone(t *testing.T) {
+	if processStart(os.Getpid()) == "" {
+		t.Skip("no /proc here to tell processes apart")
+	}
+	host, _, _ := strings.Cut(ProcessOwner(), ":")
+	self := strconv.Itoa(os.Getpid())
+	parent := strconv.Itoa(os.Getppid())
+
+	done := exec.Command("true")
+	if err := done.Run(); err != nil {
+		t.Fatal(err)
+	}
+	exited := strconv.Itoa(done.Process.Pid)
+
+	tests := []struct {
+		name  string
+		owner string
+		want  bool
+	}{
+		{"no owner", "", true},
+		{"this process", ProcessOwner(), false},
+		{"earlier process with our pid", host + ":" + self + ":other-boot/1", true},
+		{"other host", "elsewhere:" + self + ":x", false},
+		{"live owner", host + ":" + parent + ":" + processStart(os.Getppid()), false},
+		{"live owner from before instances", host + ":" + parent, false},
+		{"pid reused by another process", host + ":" + parent + ":other-boot/1", true},
+		{"exited owner", host + ":" + exited + ":x", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ownerGone(tt.owner); got != tt.want {
+				t.Errorf("ownerGone(%q) = %v, want %v", tt.owner, got, tt.want)
+			}
+		})
+	}
+}
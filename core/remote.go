@@ -0,0 +1,186 @@
+package core
+
+import (
+	"fmt"
+	neturl "net/url"
+	"path/filepath"
+	"strings"
+)
+
+// LocalHost is the RemoteRepo host of local paths and file:// URLs.
+const LocalHost = "local"
+
+const (
+	githubHost = "github.com"
+	gitlabHost = "gitlab.com"
+)
+
+// RemoteRepo identifies a repository by where it is cloned from.
+type RemoteRepo struct {
+	Host  string // lower-case host[:port], or LocalHost
+	Owner string // path between host and name, e.g. "team" or "group/subgroup"; may be empty
+	Name  string // last path segment without .git
+}
+
+// String is the repo name refci uses for r everywhere: "owner/name" on
+// GitHub, as before other hosts were supported, and "host/owner/name"
+// elsewhere, so equally named repos on different hosts never share a mirror.
+// Without an owner it is "host/-/name": "-" is no GitHub owner, so that
+// can't be mistaken for one either.
+func (r RemoteRepo) String() string {
+	if r.Host == githubHost {
+		return r.Owner + "/" + r.Name
+	}
+	owner := r.Owner
+	if owner == "" {
+		owner = "-"
+	}
+	return r.Host + "/" + owner + "/" + r.Name
+}
+
+// ParseRemoteURL parses the repository locations git clone accepts: URLs
+// (https, http, ssh, git and file schemes), scp-like "[user@]host:path" and
+// local paths. Local paths are identified by their full path, e.g.
+// /srv/git/team/app.git is local/srv/git/team/app.
+func ParseRemoteURL(raw string) (RemoteRepo, error) {
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return RemoteRepo{}, fmt.Errorf("repo url is required")
+	}
+
+	var host, path string
+	switch {
+	case strings.Contains(s, "://"):
+		u, err := neturl.Parse(s)
+		if err != nil {
+			return RemoteRepo{}, fmt.Errorf("invalid repo url %q: %w", raw, err)
+		}
+		switch strings.ToLower(u.Scheme) {
+		case "file":
+			return parseLocalRemote(u.Path, raw)
+		case "https", "http", "ssh", "git", "git+ssh", "ssh+git":
+		default:
+			return RemoteRepo{}, fmt.Errorf("unsupported repo url scheme %q: %q", u.Scheme, raw)
+		}
+		host, path = strings.ToLower(u.Host), u.Path
+	case isLocalRemote(s):
+		return parseLocalRemote(s, raw)
+	default:
+		// scp-like: [user@]host:path, recognized by git when the first
+		// colon comes before any slash.
+		h, p, _ := strings.Cut(s, ":")
+		if _, after, ok := strings.Cut(h, "@"); ok {
+			h = after
+		}
+		host, path = strings.ToLower(h), p
+	}
+	if host == "" {
+		return RemoteRepo{}, fmt.Errorf("repo url %q has no host", raw)
+	}
+
+	segs, err := remotePathSegments(path, raw)
+	if err != nil {
+		return RemoteRepo{}, err
+	}
+	segs = trimWebPath(host, segs)
+	if host == githubHost {
+		// github.com/owner/repo/pulls and the like name owner/repo.
+		if len(segs) < 2 {
+			return RemoteRepo{}, fmt.Errorf("github url %q must name owner/repo", raw)
+		}
+		segs = segs[:2]
+		segs[1] = strings.TrimSuffix(segs[1], ".git")
+	}
+	return RemoteRepo{
+		Host:  host,
+		Owner: strings.Join(segs[:len(segs)-1], "/"),
+		Name:  segs[len(segs)-1],
+	}, nil
+}
+
+// trimWebPath cuts the page off the web URL of a repo, on any host:
+// GitLab's group/app/-/merge_requests/1 and the group/app/tree/main of
+// GitHub, Gitea and others name group/app. Only a "-" or "tree" followed
+// by a page starts one, and never a "tree" on gitlab.com, whose pages are
+// all below "-": a subgroup project there may be called tree.
+func trimWebPath(host string, segs []string) []string {
+	for i, seg := range segs[:len(segs)-1] {
+		if (seg == "-" && i >= 1) || (seg == "tree" && i >= 2 && host != gitlabHost) {
+			segs = segs[:i]
+			segs[i-1] = strings.TrimSuffix(segs[i-1], ".git")
+			return segs
+		}
+	}
+	return segs
+}
+
+// isLocalRemote reports whether s is a local path rather than a URL: git
+// treats anything without a colon before the first slash as a path, so
+// "owner/app" is the directory ./owner/app, not a GitHub repo.
+func isLocalRemote(s string) bool {
+	if strings.HasPrefix(s, "/") || strings.HasPrefix(s, ".") {
+		return true
+	}
+	colon := strings.Index(s, ":")
+	slash := strings.Index(s, "/")
+	return colon < 0 || (slash >= 0 && slash < colon)
+}
+
+func parseLocalRemote(path, raw string) (RemoteRepo, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return RemoteRepo{}, fmt.Errorf("resolve repo path: %w", err)
+	}
+	segs, err := remotePathSegments(filepath.ToSlash(abs), raw)
+	if err != nil {
+		return RemoteRepo{}, err
+	}
+	if len(segs) > 1 && segs[len(segs)-1] == ".git" {
+		// A working copy's .git directory: name it after the working copy.
+		segs = segs[:len(segs)-1]
+	}
+	return RemoteRepo{
+		Host:  LocalHost,
+		Owner: strings.Join(segs[:len(segs)-1], "/"),
+		Name:  segs[len(segs)-1],
+	}, nil
+}
+
+// remotePathSegments splits a repo path into its non-empty segments, with
+// .git trimmed from the last one. Segments become directory names, so "."
+// and ".." are rejected.
+func remotePathSegments(path, raw string) ([]string, error) {
+	var segs []string
+	for _, seg := range strings.Split(path, "/") {
+		switch seg {
+		case "":
+			continue
+		case ".", "..":
+			return nil, fmt.Errorf("repo url %q must not contain %q", raw, seg)
+		}
+		segs = append(segs, seg)
+	}
+	if len(segs) == 0 {
+		return nil, fmt.Errorf("repo url %q has no repository path", raw)
+	}
+	last := len(segs) - 1
+	if name := strings.TrimSuffix(segs[last], ".git"); name != "" {
+		segs[last] = name
+	}
+	return segs, nil
+}
+
+// AbsRemoteURL returns raw with a relative local path made absolute, since
+// a mirror fetches from the URL it was cloned with from its own directory.
+// URLs are returned unchanged.
+func AbsRemoteURL(raw string) (string, error) {
+	s := strings.TrimSpace(raw)
+	if strings.Contains(s, "://") || !isLocalRemote(s) || filepath.IsAbs(s) {
+		return s, nil
+	}
+	abs, err := filepath.Abs(s)
+	if err != nil {
+		return "", fmt.Errorf("resolve repo path: %w", err)
+	}
+	return abs, nil
+}
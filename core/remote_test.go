@@ -0,0 +1,204 @@
+package core
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseRemoteURL(t *testing.T) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parent := strings.TrimPrefix(filepath.ToSlash(filepath.Dir(cwd)), "/")
+
+	tests := []struct {
+		raw     string
+		want    string
+		wantErr bool
+	}{
+		{raw: "https://github.com/owner/app.git", want: "owner/app"},
+		{raw: "git@github.com:owner/app.git", want: "owner/app"},
+		{raw: "https://GitHub.com/owner/app/tree/main/docs", want: "owner/app"},
+		{raw: "https://github.com/owner/app/pulls", want: "owner/app"},
+		{raw: "https://gitlab.com/group/sub/app", want: "gitlab.com/group/sub/app"},
+		{raw: "git@gitlab.com:group/sub/app.git", want: "gitlab.com/group/sub/app"},
+		{raw: "https://gitlab.com/group/app/-/merge_requests/1", want: "gitlab.com/group/app"},
+		{raw: "https://gitlab.com/group/app.git/-/tree/main", want: "gitlab.com/group/app"},
+		{raw: "https://gitea.example.com/team/app/tree/main", want: "gitea.example.com/team/app"},
+		{raw: "https://git.example.com/team/tree", want: "git.example.com/team/tree"},
+		{raw: "https://git.example.com/team/sub/tree", want: "git.example.com/team/sub/tree"},
+		{raw: "https://gitlab.com/a/b/tree", want: "gitlab.com/a/b/tree"},
+		{raw: "git@gitlab.com:a/b/tree.git", want: "gitlab.com/a/b/tree"},
+		{raw: "https://gitlab.com/a/b/tree/-/tree/main", want: "gitlab.com/a/b/tree"},
+		{raw: "https://gitlab.com/a/b/tree/sub/app", want: "gitlab.com/a/b/tree/sub/app"},
+		{raw: "git@git.internal:team/app.git", want: "git.internal/team/app"},
+		{raw: "git.internal:app.git", want: "git.internal/-/app"},
+		{raw: "ssh://git@host:2222/team/app.git", want: "host:2222/team/app"},
+		{raw: "file:///srv/git/app.git", want: "local/srv/git/app"},
+		{raw: "/srv/git/app.git", want: "local/srv/git/app"},
+		{raw: "/srv/git/app/.git", want: "local/srv/git/app"},
+		{raw: "../app", want: "local/" + parent + "/app"},
+		{raw: "owner/app", want: "local/" + strings.TrimPrefix(filepath.ToSlash(cwd), "/") + "/owner/app"},
+		{raw: "", wantErr: true},
+		{raw: "https://github.com/owner", wantErr: true},
+		{raw: "ftp://host/team/app", wantErr: true},
+		{raw: "https://host/team/../app", wantErr: true},
+		{raw: "https://host/", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := ParseRemoteURL(tt.raw)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("ParseRemoteURL(%q) = %q, want an error", tt.raw, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tt.want {
+				t.Errorf("ParseRemoteURL(%q) = %q, want %q", tt.raw, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalRepo(t *testing.T) {
+	tests := []struct {
+		repo string
+		dir  string
+	}{
+		{repo: "owner/app", dir: "owner--app"},
+		{repo: "owner/my-app", dir: "owner--my-app"},
+		{repo: "owner/my--app", dir: "owner--my%2D%2Dapp"},
+		{repo: "owner/-app", dir: "owner--%2Dapp"},
+		{repo: "owner/app-", dir: "owner--app%2D"},
+		{repo: "owner/50%", dir: "owner--50%25"},
+		{repo: "gitlab.com/group/sub/app", dir: "gitlab.com--group--sub--app"},
+		{repo: "host:2222/team/app", dir: "host%3A2222--team--app"},
+		{repo: "git.internal/-/app", dir: "git.internal--%2D--app"},
+		{repo: "local/srv/git/app", dir: "local--srv--git--app"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.repo, func(t *testing.T) {
+			if got := ToLocalRepo(tt.repo); got != tt.dir {
+				t.Errorf("ToLocalRepo(%q) = %q, want %q", tt.repo, got, tt.dir)
+			}
+			if got := FromLocalRepo(tt.dir); got != tt.repo {
+				t.Errorf("FromLocalRepo(%q) = %q, want %q", tt.dir, got, tt.repo)
+			}
+		})
+	}
+}
+
+// testGit runs git in dir and returns its trimmed output.
+func testGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_AUTHOR_NAME=t", "GIT_AUTHOR_EMAIL=t@t",
+		"GIT_COMMITTER_NAME=t", "GIT_COMMITTER_EMAIL=t@t",
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+func TestLocalRemoteMirror(t *testing.T) {
+	oldRoot := Root
+	Root = t.TempDir()
+	t.Cleanup(func() { Root = oldRoot })
+	ctx := context.Background()
+
+	// A bare origin, pushed to from a working copy.
+	origin := filepath.Join(t.TempDir(), "team", "app.git")
+	testGit(t, "", "init", "-q", "--bare", origin)
+	work := t.TempDir()
+	testGit(t, work, "init", "-q", "-b", "main")
+	testGit(t, work, "commit", "-q", "--allow-empty", "-m", "first")
+	testGit(t, work, "push", "-q", origin, "main")
+	first := testGit(t, work, "rev-parse", "HEAD")
+
+	remote, err := ParseRemoteURL(origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := remote.String()
+	if want := "local" + filepath.ToSlash(strings.TrimSuffix(origin, ".git")); repo != want {
+		t.Fatalf("repo = %q, want %q", repo, want)
+	}
+	mirror := filepath.Join(Root, "repos", ToLocalRepo(repo))
+	if err := CloneMirror(ctx, origin, mirror); err != nil {
+		t.Fatal(err)
+	}
+	if err := CloneMirror(ctx, origin, mirror); err == nil {
+		t.Fatal("cloning into an existing mirror succeeded")
+	}
+	if url, err := MirrorURL(ctx, mirror); err != nil || url != origin {
+		t.Fatalf("MirrorURL = %q, %v; want %q", url, err, origin)
+	}
+
+	// New commits, branches and tags show up after a fetch; deleted
+	// branches go.
+	testGit(t, work, "commit", "-q", "--allow-empty", "-m", "second")
+	second := testGit(t, work, "rev-parse", "HEAD")
+	testGit(t, work, "tag", "v1.0")
+	testGit(t, work, "push", "-q", origin, "main", "main:feature/x", "v1.0")
+	testGit(t, work, "push", "-q", origin, first+":refs/heads/old")
+	testGit(t, work, "push", "-q", origin, first+":refs/pull/7/head")
+	if err := FetchMirror(ctx, mirror); err != nil {
+		t.Fatal(err)
+	}
+	testGit(t, work, "push", "-q", origin, ":old")
+	if err := FetchMirror(ctx, mirror); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		jc   JobConf
+		want map[string]string
+	}{
+		{
+			name: "every branch",
+			jc:   JobConf{},
+			want: map[string]string{"main": second, "feature/x": second},
+		},
+		{
+			name: "branch pattern",
+			jc:   JobConf{BranchPatterns: []string{"feature/*"}},
+			want: map[string]string{"feature/x": second},
+		},
+		{
+			name: "tags only",
+			jc:   JobConf{TagPatterns: []string{"v*"}},
+			want: map[string]string{"refs/tags/v1.0": second},
+		},
+		{
+			name: "refs only",
+			jc:   JobConf{RefPatterns: []string{"refs/pull/*/head"}},
+			want: map[string]string{"refs/pull/7/head": first},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ListJobRefs(ctx, repo, tt.jc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ListJobRefs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package core
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// Repo health states, as stored in repo_health.
+const (
+	HealthOK        = "ok"
+	HealthStaleConf = "stale_conf" // polling, but with the last conf.yml that loaded
+	HealthJobErrors = "job_errors" // polling, but some jobs couldn't be queued
+	HealthRetrying  = "retrying"   // the last poll failed; retrying with backoff
+	HealthFailing   = "failing"    // HealthFailingAfter polls in a row failed
+)
+
+// HealthFailingAfter is how many consecutive failed polls turn a repo from
+// retrying into failing.
+const HealthFailingAfter = 3
+
+// RepoHealth is the outcome of the latest polls of a repo.
+type RepoHealth struct {
+	Repo        string
+	State       string
+	Failures    int       // consecutive failed polls
+	LastError   string    // error of the last failed poll
+	LastPoll    time.Time // last successful poll
+	LastFailure time.Time
+	NextPoll    time.Time // when the next attempt is due while backing off
+	ConfSHA     string    // commit the jobs being polled were loaded from
+	ConfError   string    // why conf.yml at HEAD isn't used, if it isn't
+	QueueError  string    // jobs the last successful poll couldn't queue, and why
+}
+
+// RecordSuccess notes a successful poll at now.
+func (h *RepoHealth) RecordSuccess(now time.Time) {
+	h.Failures = 0
+	h.LastError = ""
+	h.LastPoll = now
+	h.NextPoll = time.Time{}
+	h.State = HealthOK
+	switch {
+	case h.ConfError != "":
+		h.State = HealthStaleConf
+	case h.QueueError != "":
+		h.State = HealthJobErrors
+	}
+}
+
+// RecordFailure notes a poll that failed with err at now; the next one is
+// due at next.
+func (h *RepoHealth) RecordFailure(err error, now, next time.Time) {
+	h.Failures++
+	h.LastError = err.Error()
+	h.LastFailure = now
+	h.NextPoll = next
+	h.State = HealthRetrying
+	if h.Failures >= HealthFailingAfter {
+		h.State = HealthFailing
+	}
+}
+
+// Backoff spaces out retries of a failing operation: the delay doubles with
+// every consecutive failure, from Base up to Max, with jitter so repos that
+// fail together (say, when the network drops) don't retry in lockstep.
+type Backoff struct {
+	Base time.Duration
+	Max  time.Duration
+}
+
+// Delay returns how long to wait after the given number of consecutive
+// failures: a random duration between half and all of min(Base*2^(n-1), Max).
+func (b Backoff) Delay(failures int) time.Duration {
+	if failures <= 0 || b.Base <= 0 {
+		return b.Base
+	}
+	d := b.Max
+	if shift := failures - 1; shift < 32 && b.Base<<shift > 0 && b.Base<<shift < b.Max {
+		d = b.Base << shift
+	}
+	half := d / 2
+	return half + rand.N(d-half+1)
+}
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// RepoRemoval is what RemoveRepo deleted.
+type RepoRemoval struct {
+	Repo         string
+	DeletedRuns  int
+	RemovedPaths []string // mirror, worktrees and logs that existed
+	FreedBytes   int64
+}
+
+// RemoveRepo unregisters repo and deletes everything refci keeps for it: its
+// runs, settings, mirror, worktrees and logs. It refuses while the repo has
+// pending or running runs, since their process still uses the worktrees; an
+// unregistered repo that only has files on disk is cleaned up all the same.
+func RemoveRepo(dbRepo DbRepo, repo string) (RepoRemoval, error) {
+	report := RepoRemoval{Repo: repo}
+	for _, status := range []string{StatusRunning, StatusPending} {
+		active, err := dbRepo.ListJob(JobFilter{Repo: repo, Status: status})
+		if err != nil {
+			return report, err
+		}
+		if len(active) > 0 {
+			return report, fmt.Errorf("%s has %d %s runs (e.g. #%d); cancel them or stop its refci first", repo, len(active), status, active[0].ID)
+		}
+	}
+
+	jobs, err := dbRepo.ListJob(JobFilter{Repo: repo})
+	if err != nil {
+		return report, err
+	}
+	report.DeletedRuns = len(jobs)
+
+	repoPart := ToLocalRepo(repo)
+	// Keep AcquireWorktree from handing out slots while they are removed.
+	lockPath := filepath.Join(Root, "worktrees", repoPart+".lock")
+	repoLock, err := lockFile(lockPath, true)
+	if err != nil {
+		return report, err
+	}
+	defer func() {
+		_ = os.Remove(lockPath)
+		_ = syscall.Flock(int(repoLock.Fd()), syscall.LOCK_UN)
+		_ = repoLock.Close()
+	}()
+
+	// Worktrees first: their .git files point into the mirror.
+	for _, path := range []string{
+		filepath.Join(Root, "worktrees", repoPart),
+		filepath.Join(Root, "repos", repoPart),
+		filepath.Join(Root, "logs", repoPart),
+	} {
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		report.FreedBytes += dirSize(path)
+		if err := os.RemoveAll(path); err != nil {
+			return report, fmt.Errorf("remove %s: %w", path, err)
+		}
+		report.RemovedPaths = append(report.RemovedPaths, path)
+	}
+
+	if err := dbRepo.DeleteCodeRepo(repo); err != nil {
+		return report, err
+	}
+	return report, nil
+}
@@ -0,0 +1,43 @@
+package core
+
+import "time"
+
+// Kinds of RunEvent.
+const (
+	RunQueued  = "queued"  // recorded as pending
+	RunStarted = "started" // its script was started
+	RunEnded   = "ended"   // recorded with a terminal status
+)
+
+// RunEvent is a step in the life of a run owned by a JobRunner.
+type RunEvent struct {
+	Kind string
+	// Job has the recorded Status and Msg, and for RunEnded the JobExit of
+	// a script that ran.
+	Job Job
+}
+
+// SetEventHandler makes the runner call fn for every RunEvent of its runs,
+// synchronously and without holding its locks, so fn must return quickly.
+// A nil fn stops the calls.
+func (r *JobRunner) SetEventHandler(fn func(RunEvent)) {
+	r.mu.Lock()
+	r.onEvent = fn
+	r.mu.Unlock()
+}
+
+func (r *JobRunner) emit(kind string, rj *runningJob, status, msg string) {
+	r.mu.Lock()
+	fn := r.onEvent
+	r.mu.Unlock()
+	if fn == nil {
+		return
+	}
+
+	ev := RunEvent{Kind: kind, Job: rj.job}
+	ev.Job.Status, ev.Job.Msg = status, msg
+	if kind == RunEnded {
+		ev.Job.End = time.Now().UTC()
+	}
+	fn(ev)
+}
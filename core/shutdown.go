@@ -0,0 +1,97 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ShutdownMode is what JobRunner.Shutdown does with runs still running.
+type ShutdownMode string
+
+const (
+	ShutdownCancel ShutdownMode = "cancel" // cancel them right away
+	ShutdownDrain  ShutdownMode = "drain"  // let them finish, until the deadline
+)
+
+func ParseShutdownMode(v string) (ShutdownMode, error) {
+	switch mode := ShutdownMode(strings.TrimSpace(v)); mode {
+	case ShutdownCancel, ShutdownDrain:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("shutdown mode must be cancel or drain: %q", v)
+	}
+}
+
+// ErrRunnerShutdown is returned by Start once the runner is shut down.
+var ErrRunnerShutdown = errors.New("job runner is shut down")
+
+// Shutdown stops the runner before its process exits, so that no run is
+// left to be recovered as abandoned. New runs are refused and pending runs
+// are canceled. Running runs are canceled (SIGTERM to their process group,
+// SIGKILL after the grace period) with ShutdownCancel; with ShutdownDrain
+// they are waited for until ctx is done, and whatever is still running then
+// is canceled. Shutdown returns once every run is recorded, with an error if
+// draining ran out of time.
+func (r *JobRunner) Shutdown(ctx context.Context, mode ShutdownMode) error {
+	r.mu.Lock()
+	r.closed = true
+	if r.recheck != nil {
+		r.recheck.Stop()
+		r.recheck = nil
+	}
+	var pending, running []*runningJob
+	for _, rj := range r.running {
+		if rj.started {
+			running = append(running, rj)
+		} else {
+			pending = append(pending, rj)
+		}
+	}
+	r.mu.Unlock()
+
+	// Canceled first, so none starts in the place of a run that ends.
+	for _, rj := range pending {
+		// Fails only if the run already ended.
+		_ = r.Cancel(rj.job.ID)
+	}
+
+	var err error
+	if mode == ShutdownDrain {
+		for _, rj := range running {
+			select {
+			case <-rj.done:
+			case <-ctx.Done():
+			}
+		}
+		// Counted once ctx is done: runs that ended while draining, even
+		// after the one that was being waited for, are not left.
+		left := 0
+		for _, rj := range running {
+			select {
+			case <-rj.done:
+			default:
+				left++
+			}
+		}
+		if left > 0 {
+			err = fmt.Errorf("draining stopped with %d of %d runs still running, canceled them: %w", left, len(running), ctx.Err())
+		}
+	}
+
+	for _, rj := range running {
+		go func() { _ = r.Cancel(rj.job.ID) }()
+	}
+	for _, rj := range append(pending, running...) {
+		<-rj.done
+	}
+	return err
+}
+
+// Active returns how many runs of this runner are pending or running.
+func (r *JobRunner) Active() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.running)
+}
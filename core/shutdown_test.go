@@ -0,0 +1,107 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdownDrainCountsRunsLeft(t *testing.T) {
+	oldRoot := Root
+	Root = t.TempDir()
+	t.Cleanup(func() { Root = oldRoot })
+
+	mirror := filepath.Join(Root, "repos", ToLocalRepo("o/app"))
+	testGit(t, "", "init", "-q", mirror)
+	testGit(t, mirror, "commit", "-q", "--allow-empty", "-m", "first")
+	sha := testGit(t, mirror, "rev-parse", "HEAD")
+
+	dbRepo := newTestRepo(t)
+	runner := NewJobRunner(dbRepo)
+	work := t.TempDir()
+	for name, script := range map[string]string{"quick": "sleep 0.2\n", "slow": "sleep 30\n"} {
+		if err := os.WriteFile(filepath.Join(work, name+".sh"), []byte(script), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := runner.Start(context.Background(), RunJobRequest{
+			Repo: "o/app", Name: name, Branch: "main", SHA: sha,
+			ScriptPath: name + ".sh", WorkDir: work,
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The quick run ends while slow is still draining; only slow is left.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	err := runner.Shutdown(ctx, ShutdownDrain)
+	if err == nil || !strings.Contains(err.Error(), "with 1 of 2 runs still running") {
+		t.Fatalf("Shutdown = %v, want 1 of 2 runs left", err)
+	}
+
+	runs, err := dbRepo.ListJob(JobFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, run := range runs {
+		want := StatusFinished
+		if run.Name == "slow" {
+			want = StatusCanceled
+		}
+		if run.Status != want {
+			t.Errorf("run of %s is %s, want %s", run.Name, run.Status, want)
+		}
+	}
+}
+
+// A run that ends while Shutdown is under way doesn't launch the pending
+// run queued behind it.
+func TestShutdownLaunchesNothingMore(t *testing.T) {
+	sha := testMirror(t, "o/app", nil)
+	dbRepo := newTestRepo(t)
+	runner := NewJobRunner(dbRepo)
+	runner.SetLimits(RunnerLimits{MaxParallel: 1})
+	work := t.TempDir()
+	if err := os.WriteFile(filepath.Join(work, "slow.sh"), []byte("sleep 30\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	start := func(name string) Job {
+		t.Helper()
+		job, err := runner.Start(context.Background(), RunJobRequest{
+			Repo: "o/app", Name: name, Branch: "main", SHA: sha,
+			ScriptPath: "slow.sh", WorkDir: work,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return job
+	}
+	first, next := start("first"), start("next")
+
+	// Where Shutdown has marked the runner closed but not yet canceled
+	// what is pending.
+	runner.mu.Lock()
+	runner.closed = true
+	runner.mu.Unlock()
+	if err := runner.Cancel(first.ID); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := runner.Wait(ctx, first.ID); err != nil {
+		t.Fatal(err)
+	}
+	if run, err := dbRepo.GetJob(next.ID); err != nil || run.Status != StatusPending {
+		t.Fatalf("queued run = %+v, %v; want it left pending", run, err)
+	}
+
+	if err := runner.Shutdown(ctx, ShutdownCancel); err != nil {
+		t.Fatal(err)
+	}
+	if run, err := dbRepo.GetJob(next.ID); err != nil || run.Status != StatusCanceled || run.Msg != "canceled while pending" {
+		t.Errorf("queued run after Shutdown = %+v, %v; want it canceled while pending", run, err)
+	}
+}
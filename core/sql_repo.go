@@ -0,0 +1,613 @@
+package core
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// dialect is what the SQL of the databases refci stores jobs in differs in.
+// sqlRepo writes every query once, with ? placeholders, and binds it and
+// its times through the dialect.
+type dialect DBKind
+
+// bind rewrites the ? placeholders of query to postgres' $1, $2, ...
+// Queries have no ? anywhere else.
+func (d dialect) bind(query string) string {
+	if DBKind(d) != DBPostgres {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// timeArg is t as stored: RFC 3339 TEXT on sqlite, timestamptz on
+// postgres. The zero time is NULL.
+func (d dialect) timeArg(t time.Time) any {
+	if t.IsZero() {
+		return nil
+	}
+	if DBKind(d) == DBSQLite {
+		return formatStoredTime(t)
+	}
+	return t.UTC()
+}
+
+// isUniqueViolation reports whether err is an insert that broke a unique
+// index.
+func (d dialect) isUniqueViolation(err error) bool {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code == "23505"
+	}
+	var liteErr *sqlite.Error
+	if errors.As(err, &liteErr) {
+		return liteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE
+	}
+	return false
+}
+
+// storedTime scans a time column of either dialect; NULL or "" is the zero
+// time.
+type storedTime struct {
+	time.Time
+}
+
+func (t *storedTime) Scan(v any) error {
+	switch v := v.(type) {
+	case nil:
+		t.Time = time.Time{}
+	case time.Time:
+		t.Time = v.UTC()
+	case string:
+		parsed, err := parseStoredTime(v)
+		if err != nil {
+			return err
+		}
+		t.Time = parsed
+	case []byte:
+		return t.Scan(string(v))
+	default:
+		return fmt.Errorf("unsupported stored time %T", v)
+	}
+	return nil
+}
+
+// sqlRepo is the DbRepo of SQLiteRepo and PostgresRepo.
+type sqlRepo struct {
+	db *sql.DB
+	d  dialect
+}
+
+func (r sqlRepo) exec(query string, args ...any) (sql.Result, error) {
+	return r.db.Exec(r.d.bind(query), args...)
+}
+
+func (r sqlRepo) query(query string, args ...any) (*sql.Rows, error) {
+	return r.db.Query(r.d.bind(query), args...)
+}
+
+func (r sqlRepo) queryRow(query string, args ...any) *sql.Row {
+	return r.db.QueryRow(r.d.bind(query), args...)
+}
+
+const jobColumns = `id, repo, name, branch, sha, attempt, start_at, end_at, status, msg, trigger, owner, pid, ref_type, exit_code, signal, duration_ms, user_cpu_ms, sys_cpu_ms, max_rss_bytes, log_path, pid_start`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanJob(row rowScanner) (Job, error) {
+	var (
+		j          Job
+		start, end storedTime
+		exitCode   sql.NullInt64
+		durationMS int64
+		userCPUMS  int64
+		sysCPUMS   int64
+	)
+	if err := row.Scan(&j.ID, &j.Repo, &j.Name, &j.Branch, &j.SHA, &j.Attempt, &start, &end, &j.Status, &j.Msg, &j.Trigger, &j.Owner, &j.PID, &j.RefType,
+		&exitCode, &j.Signal, &durationMS, &userCPUMS, &sysCPUMS, &j.MaxRSS, &j.LogPath, &j.PIDStart); err != nil {
+		return Job{}, err
+	}
+	j.Start, j.End = start.Time, end.Time
+	// A NULL exit_code means the script never exited.
+	j.ExitCode = -1
+	if exitCode.Valid {
+		j.ExitCode = int(exitCode.Int64)
+	}
+	j.Duration = time.Duration(durationMS) * time.Millisecond
+	j.UserCPU = time.Duration(userCPUMS) * time.Millisecond
+	j.SysCPU = time.Duration(sysCPUMS) * time.Millisecond
+	return j, nil
+}
+
+func (r sqlRepo) LatestJobByNameBranch(repo, name, branch string) (Job, error) {
+	j, err := scanJob(r.queryRow(
+		`SELECT `+jobColumns+`
+		 FROM jobs
+		 WHERE repo = ? AND name = ? AND branch = ?
+		 ORDER BY id DESC
+		 LIMIT 1`,
+		repo, name, branch,
+	))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, nil
+		}
+		return Job{}, err
+	}
+	return j, nil
+}
+
+// createJobTries bounds how often CreateJob numbers a run again after
+// another refci sharing the database took its attempt number.
+const createJobTries = 5
+
+func (r sqlRepo) CreateJob(job Job) (Job, error) {
+	now := time.Now().UTC()
+	out := job
+	out.Start = now
+	out.Status = StatusPending
+	out.Msg = ""
+	if out.Trigger == "" {
+		out.Trigger = TriggerPoll
+	}
+	if out.RefType == "" {
+		out.RefType = RefTypeOf(job.Branch)
+	}
+	out.JobExit = JobExit{ExitCode: -1}
+	for try := 1; ; try++ {
+		// Two hosts creating the same run at once both count the same
+		// attempts; the unique index on the attempt turns one away, and
+		// counting again puts it after the other.
+		err := r.queryRow(
+			`INSERT INTO jobs (repo, name, branch, sha, attempt, start_at, status, msg, trigger, owner, ref_type)
+			 VALUES (?, ?, ?, ?,
+			         (SELECT COALESCE(MAX(attempt), 0) + 1 FROM jobs WHERE repo = ? AND name = ? AND branch = ? AND sha = ?),
+			         ?, ?, '', ?, ?, ?)
+			 RETURNING id, attempt`,
+			job.Repo, job.Name, job.Branch, job.SHA,
+			job.Repo, job.Name, job.Branch, job.SHA,
+			r.d.timeArg(now), StatusPending, out.Trigger, job.Owner, out.RefType,
+		).Scan(&out.ID, &out.Attempt)
+		if err == nil {
+			return out, nil
+		}
+		if !r.d.isUniqueViolation(err) || try == createJobTries {
+			return Job{}, fmt.Errorf("create job: %w", err)
+		}
+	}
+}
+
+func (r sqlRepo) GetJob(id int64) (Job, error) {
+	j, err := scanJob(r.queryRow(`SELECT `+jobColumns+` FROM jobs WHERE id = ?`, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, fmt.Errorf("job %d not found", id)
+		}
+		return Job{}, fmt.Errorf("get job: %w", err)
+	}
+	return j, nil
+}
+
+func (r sqlRepo) UpdateJob(id int64, status, msg string) error {
+	var err error
+	if IsTerminalStatus(status) {
+		_, err = r.exec(`UPDATE jobs SET status = ?, msg = ?, end_at = ? WHERE id = ?`,
+			status, msg, r.d.timeArg(time.Now().UTC()), id)
+	} else {
+		_, err = r.exec(`UPDATE jobs SET status = ?, msg = ? WHERE id = ?`, status, msg, id)
+	}
+	if err != nil {
+		return fmt.Errorf("update job: %w", err)
+	}
+	return nil
+}
+
+func (r sqlRepo) SetJobPID(id int64, pid int, pidStart string) error {
+	if _, err := r.exec(`UPDATE jobs SET pid = ?, pid_start = ? WHERE id = ?`, pid, pidStart, id); err != nil {
+		return fmt.Errorf("set job pid: %w", err)
+	}
+	return nil
+}
+
+func (r sqlRepo) SetJobLogPath(id int64, path string) error {
+	if _, err := r.exec(`UPDATE jobs SET log_path = ? WHERE id = ?`, path, id); err != nil {
+		return fmt.Errorf("set job log path: %w", err)
+	}
+	return nil
+}
+
+func (r sqlRepo) SetJobExit(id int64, exit JobExit) error {
+	_, err := r.exec(
+		`UPDATE jobs
+		 SET exit_code = ?,
+		     signal = ?,
+		     duration_ms = ?,
+		     user_cpu_ms = ?,
+		     sys_cpu_ms = ?,
+		     max_rss_bytes = ?
+		 WHERE id = ?`,
+		exit.ExitCode, exit.Signal, exit.Duration.Milliseconds(), exit.UserCPU.Milliseconds(), exit.SysCPU.Milliseconds(), exit.MaxRSS,
+		id,
+	)
+	if err != nil {
+		return fmt.Errorf("set job exit: %w", err)
+	}
+	return nil
+}
+
+func (r sqlRepo) DeleteJob(id int64) error {
+	if _, err := r.exec(`DELETE FROM jobs WHERE id = ?`, id); err != nil {
+		return fmt.Errorf("delete job: %w", err)
+	}
+	return nil
+}
+
+func (r sqlRepo) ListJob(filter JobFilter) ([]Job, error) {
+	var (
+		where []string
+		args  []any
+	)
+	addOp := func(column, op string, value any) {
+		where = append(where, column+" "+op+" ?")
+		args = append(args, value)
+	}
+	add := func(column string, value any) { addOp(column, "=", value) }
+
+	if filter.ID != 0 {
+		add("id", filter.ID)
+	}
+	if strings.TrimSpace(filter.Repo) != "" {
+		add("repo", filter.Repo)
+	}
+	if strings.TrimSpace(filter.Name) != "" {
+		add("name", filter.Name)
+	}
+	if strings.TrimSpace(filter.Branch) != "" {
+		add("branch", filter.Branch)
+	}
+	if strings.TrimSpace(filter.RefType) != "" {
+		add("ref_type", filter.RefType)
+	}
+	if strings.TrimSpace(filter.SHA) != "" {
+		add("sha", filter.SHA)
+	}
+	if strings.TrimSpace(filter.Status) != "" {
+		add("status", filter.Status)
+	}
+	if strings.TrimSpace(filter.Trigger) != "" {
+		add("trigger", filter.Trigger)
+	}
+	if filter.ExitCode != nil {
+		add("exit_code", *filter.ExitCode)
+	}
+	if strings.TrimSpace(filter.Signal) != "" {
+		add("signal", filter.Signal)
+	}
+	if filter.MinDuration > 0 {
+		addOp("duration_ms", ">=", filter.MinDuration.Milliseconds())
+	}
+	if filter.MinMaxRSS > 0 {
+		addOp("max_rss_bytes", ">=", filter.MinMaxRSS)
+	}
+
+	query := `SELECT ` + jobColumns + ` FROM jobs`
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+
+	rows, err := r.query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("list job: %w", err)
+	}
+	defer rows.Close()
+
+	var out []Job
+	for rows.Next() {
+		j, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan job: %w", err)
+		}
+		out = append(out, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate jobs: %w", err)
+	}
+	return out, nil
+}
+
+func (r sqlRepo) GetGlobalSetting() (GlobalSetting, error) {
+	rows, err := r.query(`SELECT key, value FROM settings`)
+	if err != nil {
+		return GlobalSetting{}, fmt.Errorf("get settings: %w", err)
+	}
+	defer rows.Close()
+
+	var setting GlobalSetting
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return GlobalSetting{}, fmt.Errorf("scan setting: %w", err)
+		}
+		// Keys this version doesn't know are ignored.
+		if _, err := setting.Get(key); err != nil {
+			continue
+		}
+		if err := setting.Set(key, value); err != nil {
+			return GlobalSetting{}, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return GlobalSetting{}, fmt.Errorf("iterate settings: %w", err)
+	}
+	return setting, nil
+}
+
+func (r sqlRepo) SetGlobalSetting(setting GlobalSetting) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("set settings: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, key := range GlobalSettingKeys {
+		value, _ := setting.Get(key)
+		if _, err := tx.Exec(r.d.bind(
+			`INSERT INTO settings (key, value) VALUES (?, ?)
+			 ON CONFLICT (key) DO UPDATE SET value = excluded.value`),
+			key, value,
+		); err != nil {
+			return fmt.Errorf("set setting %s: %w", key, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("set settings: %w", err)
+	}
+	return nil
+}
+
+const repoColumns = `repo, url, cloned_at, poll_interval_ms, enabled`
+
+func scanCodeRepo(row rowScanner) (CodeRepo, error) {
+	var (
+		cr       CodeRepo
+		clonedAt storedTime
+		pollMS   int64
+	)
+	if err := row.Scan(&cr.Repo, &cr.URL, &clonedAt, &pollMS, &cr.Enabled); err != nil {
+		return CodeRepo{}, err
+	}
+	cr.PollInterval = time.Duration(pollMS) * time.Millisecond
+	cr.ClonedAt = clonedAt.Time
+	return cr, nil
+}
+
+func (r sqlRepo) ListCodeRepos() ([]CodeRepo, error) {
+	rows, err := r.query(`SELECT ` + repoColumns + ` FROM repos ORDER BY repo`)
+	if err != nil {
+		return nil, fmt.Errorf("list repos: %w", err)
+	}
+	defer rows.Close()
+
+	var out []CodeRepo
+	for rows.Next() {
+		cr, err := scanCodeRepo(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan repo: %w", err)
+		}
+		out = append(out, cr)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate repos: %w", err)
+	}
+	return out, nil
+}
+
+func (r sqlRepo) GetCodeRepo(repo string) (CodeRepo, error) {
+	cr, err := scanCodeRepo(r.queryRow(`SELECT `+repoColumns+` FROM repos WHERE repo = ?`, repo))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return CodeRepo{}, fmt.Errorf("%s: %w", repo, ErrRepoNotRegistered)
+		}
+		return CodeRepo{}, fmt.Errorf("get repo: %w", err)
+	}
+	return cr, nil
+}
+
+func (r sqlRepo) SaveCodeRepo(repo CodeRepo) error {
+	_, err := r.exec(
+		`INSERT INTO repos (`+repoColumns+`) VALUES (?, ?, ?, ?, ?)
+		 ON CONFLICT (repo) DO UPDATE SET
+		     url = excluded.url,
+		     cloned_at = excluded.cloned_at,
+		     poll_interval_ms = excluded.poll_interval_ms,
+		     enabled = excluded.enabled`,
+		repo.Repo, repo.URL, r.d.timeArg(repo.ClonedAt), repo.PollInterval.Milliseconds(), repo.Enabled,
+	)
+	if err != nil {
+		return fmt.Errorf("save repo: %w", err)
+	}
+	return nil
+}
+
+func (r sqlRepo) DeleteCodeRepo(repo string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		return fmt.Errorf("delete repo: %w", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"repo_settings", "repo_health", "job_tag_patterns", "jobs", "repos"} {
+		if _, err := tx.Exec(r.d.bind(`DELETE FROM `+table+` WHERE repo = ?`), repo); err != nil {
+			return fmt.Errorf("delete repo %s: %w", table, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("delete repo: %w", err)
+	}
+	return nil
+}
+
+func (r sqlRepo) TagPatterns(repo, name string) (string, error) {
+	var patterns string
+	err := r.queryRow(`SELECT patterns FROM job_tag_patterns WHERE repo = ? AND name = ?`, repo, name).Scan(&patterns)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("get tag patterns: %w", err)
+	}
+	return patterns, nil
+}
+
+func (r sqlRepo) SetTagPatterns(repo, name, patterns string) error {
+	_, err := r.exec(
+		`INSERT INTO job_tag_patterns (repo, name, patterns) VALUES (?, ?, ?)
+		 ON CONFLICT (repo, name) DO UPDATE SET patterns = excluded.patterns`,
+		repo, name, patterns,
+	)
+	if err != nil {
+		return fmt.Errorf("set tag patterns: %w", err)
+	}
+	return nil
+}
+
+func (r sqlRepo) ListRepoSettings(repo string) ([]RepoSetting, error) {
+	rows, err := r.query(`SELECT repo, key, value FROM repo_settings WHERE repo = ? ORDER BY key`, repo)
+	if err != nil {
+		return nil, fmt.Errorf("list repo settings: %w", err)
+	}
+	defer rows.Close()
+
+	var out []RepoSetting
+	for rows.Next() {
+		var rs RepoSetting
+		if err := rows.Scan(&rs.Repo, &rs.Key, &rs.Value); err != nil {
+			return nil, fmt.Errorf("scan repo setting: %w", err)
+		}
+		out = append(out, rs)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate repo settings: %w", err)
+	}
+	return out, nil
+}
+
+func (r sqlRepo) SetRepoSetting(setting RepoSetting) error {
+	var err error
+	if setting.Value == "" {
+		_, err = r.exec(`DELETE FROM repo_settings WHERE repo = ? AND key = ?`, setting.Repo, setting.Key)
+	} else {
+		_, err = r.exec(
+			`INSERT INTO repo_settings (repo, key, value) VALUES (?, ?, ?)
+			 ON CONFLICT (repo, key) DO UPDATE SET value = excluded.value`,
+			setting.Repo, setting.Key, setting.Value,
+		)
+	}
+	if err != nil {
+		return fmt.Errorf("set repo setting %s: %w", setting.Key, err)
+	}
+	return nil
+}
+
+const repoHealthColumns = `repo, state, failures, last_error, last_poll_at, last_failure_at, next_poll_at, conf_sha, conf_error, queue_error`
+
+func scanRepoHealth(row rowScanner) (RepoHealth, error) {
+	var (
+		h                               RepoHealth
+		lastPoll, lastFailure, nextPoll storedTime
+	)
+	if err := row.Scan(&h.Repo, &h.State, &h.Failures, &h.LastError, &lastPoll, &lastFailure, &nextPoll, &h.ConfSHA, &h.ConfError, &h.QueueError); err != nil {
+		return RepoHealth{}, err
+	}
+	h.LastPoll, h.LastFailure, h.NextPoll = lastPoll.Time, lastFailure.Time, nextPoll.Time
+	return h, nil
+}
+
+func (r sqlRepo) GetRepoHealth(repo string) (RepoHealth, error) {
+	h, err := scanRepoHealth(r.queryRow(`SELECT `+repoHealthColumns+` FROM repo_health WHERE repo = ?`, repo))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return RepoHealth{Repo: repo}, nil
+		}
+		return RepoHealth{}, fmt.Errorf("get repo health: %w", err)
+	}
+	return h, nil
+}
+
+func (r sqlRepo) ListRepoHealth() ([]RepoHealth, error) {
+	rows, err := r.query(`SELECT ` + repoHealthColumns + ` FROM repo_health ORDER BY repo`)
+	if err != nil {
+		return nil, fmt.Errorf("list repo health: %w", err)
+	}
+	defer rows.Close()
+
+	var out []RepoHealth
+	for rows.Next() {
+		h, err := scanRepoHealth(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scan repo health: %w", err)
+		}
+		out = append(out, h)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("iterate repo health: %w", err)
+	}
+	return out, nil
+}
+
+func (r sqlRepo) SaveRepoHealth(h RepoHealth) error {
+	_, err := r.exec(
+		`INSERT INTO repo_health (`+repoHealthColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		 ON CONFLICT (repo) DO UPDATE SET
+		     state = excluded.state,
+		     failures = excluded.failures,
+		     last_error = excluded.last_error,
+		     last_poll_at = excluded.last_poll_at,
+		     last_failure_at = excluded.last_failure_at,
+		     next_poll_at = excluded.next_poll_at,
+		     conf_sha = excluded.conf_sha,
+		     conf_error = excluded.conf_error,
+		     queue_error = excluded.queue_error`,
+		h.Repo, h.State, h.Failures, h.LastError, r.d.timeArg(h.LastPoll), r.d.timeArg(h.LastFailure), r.d.timeArg(h.NextPoll), h.ConfSHA, h.ConfError, h.QueueError,
+	)
+	if err != nil {
+		return fmt.Errorf("save repo health: %w", err)
+	}
+	return nil
+}
+
+func formatStoredTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+func parseStoredTime(v string) (time.Time, error) {
+	s := strings.TrimSpace(v)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return t, nil
+}
@@ -1,9 +1,18 @@
 package core
 
+import "time"
+
 type JobConf struct {
-	Repo          string   `yaml:"-"`
-	Name          string   `yaml:"-"`
-	BranchPattern string   `yaml:"branch_pattern"`
-	PathPatterns  []string `yaml:"path_patterns"`
-	ScriptPath    string   `yaml:"script"`
+	Repo           string        `yaml:"-"`
+	Name           string        `yaml:"-"`
+	BranchPatterns []string      `yaml:"branch_pattern"`
+	TagPatterns    []string      `yaml:"tag_pattern"`
+	RefPatterns    []string      `yaml:"ref_pattern"`
+	PathPatterns   []string      `yaml:"path_patterns"`
+	ScriptPath     string        `yaml:"script"`
+	MaxParallel    int           `yaml:"max_parallel"`
+	Timeout        time.Duration `yaml:"-"`
+	Needs          []string      `yaml:"needs"`
+	Clean          CleanMode     `yaml:"clean"`
+	Matrix         []MatrixValue `yaml:"-"` // this job's matrix combination, if any
 }
@@ -13,10 +13,38 @@ func LocalPath(path ...string) string {
 	return filepath.Join(append([]string{Root}, path...)...)
 }
 
+// ToLocalRepo is the directory name of repo under repos/, worktrees/ and
+// logs/: its segments joined by "--". Dashes in a segment that contains
+// "--" or starts or ends with "-" are escaped as %2D (and "%" as %25), so
+// distinct repos never share a directory while plain names like
+// owner--my-app keep the layout they always had. The colon of a host:port
+// is escaped as %3A: git would read a path with one as host:path.
 func ToLocalRepo(repo string) string {
-	return strings.ReplaceAll(repo, "/", "--")
+	segs := strings.Split(repo, "/")
+	for i, seg := range segs {
+		seg = strings.ReplaceAll(seg, "%", "%25")
+		seg = strings.ReplaceAll(seg, ":", "%3A")
+		if strings.Contains(seg, "--") || strings.HasPrefix(seg, "-") || strings.HasSuffix(seg, "-") {
+			seg = strings.ReplaceAll(seg, "-", "%2D")
+		}
+		segs[i] = seg
+	}
+	return strings.Join(segs, "--")
+}
+
+// FromLocalRepo is the inverse of ToLocalRepo.
+func FromLocalRepo(dir string) string {
+	segs := strings.Split(dir, "--")
+	for i, seg := range segs {
+		if v, err := neturl.PathUnescape(seg); err == nil {
+			segs[i] = v
+		}
+	}
+	return strings.Join(segs, "/")
 }
 
+// ParseGithubUrl returns owner/repo of a GitHub URL or owner/repo path, or
+// "" for anything else. See ParseRemoteURL for other hosts.
 func ParseGithubUrl(rawURL string) string {
 	raw := strings.TrimSpace(rawURL)
 	if raw == "" {
@@ -25,43 +53,18 @@ func ParseGithubUrl(rawURL string) string {
 
 	// Direct owner/repo form.
 	if !strings.Contains(raw, "://") && !strings.Contains(raw, "@") {
-		return normalizeGithubRepoPath(raw)
-	}
-
-	// SCP-like SSH form: git@github.com:owner/repo(.git)
-	if strings.HasPrefix(strings.ToLower(raw), "git@github.com:") {
-		return normalizeGithubRepoPath(raw[len("git@github.com:"):])
-	}
-
-	u, err := neturl.Parse(raw)
-	if err != nil {
-		return ""
-	}
-
-	host := strings.ToLower(u.Hostname())
-	if host != "github.com" {
-		return ""
+		r, err := ParseRemoteURL("https://github.com/" + strings.TrimPrefix(raw, "/"))
+		if err != nil {
+			return ""
+		}
+		return r.String()
 	}
 
-	return normalizeGithubRepoPath(u.Path)
-}
-
-func normalizeGithubRepoPath(path string) string {
-	p := strings.TrimSpace(path)
-	p = strings.TrimPrefix(p, "/")
-	p = strings.TrimSuffix(p, "/")
-	p = strings.TrimSuffix(p, ".git")
-
-	parts := strings.Split(p, "/")
-	if len(parts) < 2 {
-		return ""
-	}
-	owner := strings.TrimSpace(parts[0])
-	repo := strings.TrimSpace(parts[1])
-	if owner == "" || repo == "" {
+	r, err := ParseRemoteURL(raw)
+	if err != nil || r.Host != githubHost {
 		return ""
 	}
-	return owner + "/" + repo
+	return r.String()
 }
 
 func SafeIdx[T any](idx int, slice []T) (ret T) {
@@ -0,0 +1,181 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// CleanMode is what `git clean` removes from a reused worktree before a run.
+// Tracked files are always reset to the commit.
+type CleanMode string
+
+const (
+	CleanAll       CleanMode = "all"       // git clean -fdx: untracked and ignored files
+	CleanUntracked CleanMode = "untracked" // git clean -fd: keeps ignored files, e.g. build caches
+	CleanNone      CleanMode = "none"      // leave untracked and ignored files alone
+)
+
+// ParseCleanMode parses the clean: field of a job. Empty means CleanAll.
+func ParseCleanMode(v string) (CleanMode, error) {
+	switch mode := CleanMode(strings.TrimSpace(v)); mode {
+	case "":
+		return CleanAll, nil
+	case CleanAll, CleanUntracked, CleanNone:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("must be one of all, untracked, none: %q", v)
+	}
+}
+
+// Worktree is a checkout leased to one run. Worktrees of a branch form a pool
+// under worktrees/<repo>/<branch>/<n>; each slot is guarded by an flock on
+// <n>.lock, so a slot is only reused once no run, in this process or any
+// other refci process, holds it.
+type Worktree struct {
+	Path string
+	lock *os.File
+}
+
+// Release returns the worktree to the pool. Its files are left as they are
+// until the next run cleans them.
+func (w *Worktree) Release() {
+	if w == nil || w.lock == nil {
+		return
+	}
+	_ = syscall.Flock(int(w.lock.Fd()), syscall.LOCK_UN)
+	_ = w.lock.Close()
+	w.lock = nil
+}
+
+// AcquireWorktree leases a worktree of repo checked out at sha for a run on
+// branch. The lowest free slot of the branch is reused when there is one;
+// it is reset to sha and cleaned according to clean. Otherwise a new slot
+// is added to the pool.
+func AcquireWorktree(ctx context.Context, repo, branch, sha string, clean CleanMode) (*Worktree, error) {
+	repoPart := ToLocalRepo(strings.TrimSpace(repo))
+	mirrorPath := filepath.Join(Root, "repos", repoPart)
+	branchDir := filepath.Join(Root, "worktrees", repoPart, toLocalBranch(branch))
+	shaValue := strings.TrimSpace(sha)
+	if clean == "" {
+		clean = CleanAll
+	}
+
+	// Adding and removing worktrees writes to the mirror, so worktrees of a
+	// repo are prepared one at a time.
+	repoLock, err := lockFile(filepath.Join(Root, "worktrees", repoPart+".lock"), true)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = syscall.Flock(int(repoLock.Fd()), syscall.LOCK_UN)
+		_ = repoLock.Close()
+	}()
+
+	if err := removeLegacyWorktree(ctx, mirrorPath, branchDir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(branchDir, 0o755); err != nil {
+		return nil, fmt.Errorf("create worktree dir: %w", err)
+	}
+
+	for n := 1; ; n++ {
+		slot := filepath.Join(branchDir, strconv.Itoa(n))
+		lock, err := lockFile(slot+".lock", false)
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		wt := &Worktree{Path: slot, lock: lock}
+
+		if _, err := os.Stat(filepath.Join(slot, ".git")); err == nil {
+			if err := resetWorktree(ctx, slot, shaValue, clean); err == nil {
+				return wt, nil
+			}
+			// Not a usable checkout any more; start it over.
+			if err := removeWorktree(ctx, mirrorPath, slot); err != nil {
+				wt.Release()
+				return nil, err
+			}
+		} else if !os.IsNotExist(err) {
+			wt.Release()
+			return nil, fmt.Errorf("stat worktree: %w", err)
+		} else if err := os.RemoveAll(slot); err != nil {
+			wt.Release()
+			return nil, fmt.Errorf("remove stale worktree dir: %w", err)
+		} else if err := runGit(ctx, mirrorPath, "worktree", "prune"); err != nil {
+			// The mirror may still list a slot whose checkout was deleted.
+			wt.Release()
+			return nil, err
+		}
+
+		if err := runGit(ctx, mirrorPath, "worktree", "add", "--detach", slot, shaValue); err != nil {
+			wt.Release()
+			return nil, err
+		}
+		return wt, nil
+	}
+}
+
+func resetWorktree(ctx context.Context, path, sha string, clean CleanMode) error {
+	if err := runGit(ctx, path, "reset", "--hard", "--quiet", sha); err != nil {
+		return err
+	}
+	switch clean {
+	case CleanAll:
+		return runGit(ctx, path, "clean", "-fdxq")
+	case CleanUntracked:
+		return runGit(ctx, path, "clean", "-fdq")
+	}
+	return nil
+}
+
+func removeWorktree(ctx context.Context, mirrorPath, path string) error {
+	if err := runGit(ctx, mirrorPath, "worktree", "remove", "--force", path); err == nil {
+		return nil
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("remove worktree %s: %w", path, err)
+	}
+	return runGit(ctx, mirrorPath, "worktree", "prune")
+}
+
+// removeLegacyWorktree removes the single shared worktree older refci
+// versions kept at worktrees/<repo>/<branch>, which is now the pool dir.
+func removeLegacyWorktree(ctx context.Context, mirrorPath, branchDir string) error {
+	if _, err := os.Stat(filepath.Join(branchDir, ".git")); err != nil {
+		return nil
+	}
+	return removeWorktree(ctx, mirrorPath, branchDir)
+}
+
+// lockFile opens path and takes an exclusive flock on it. Without wait it
+// fails with syscall.EWOULDBLOCK when someone else holds the lock.
+func lockFile(path string, wait bool) (*os.File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("create lock dir: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("open lock %s: %w", path, err)
+	}
+	how := syscall.LOCK_EX
+	if !wait {
+		how |= syscall.LOCK_NB
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		_ = f.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, err
+		}
+		return nil, fmt.Errorf("lock %s: %w", path, err)
+	}
+	return f, nil
+}
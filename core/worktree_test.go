@@ -0,0 +1,167 @@
+package core
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testMirror points Root at a fresh root with a mirror of repo holding one
+// commit of files, and returns the commit.
+func testMirror(t *testing.T, repo string, files map[string]string) string {
+	t.Helper()
+	oldRoot := Root
+	Root = t.TempDir()
+	t.Cleanup(func() { Root = oldRoot })
+
+	mirror := filepath.Join(Root, "repos", ToLocalRepo(repo))
+	testGit(t, "", "init", "-q", mirror)
+	for name, content := range files {
+		path := filepath.Join(mirror, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testGit(t, mirror, "add", "-A")
+	testGit(t, mirror, "commit", "-q", "--allow-empty", "-m", "first")
+	return testGit(t, mirror, "rev-parse", "HEAD")
+}
+
+func TestParseCleanMode(t *testing.T) {
+	tests := []struct {
+		v       string
+		want    CleanMode
+		wantErr bool
+	}{
+		{"", CleanAll, false},
+		{"all", CleanAll, false},
+		{" untracked ", CleanUntracked, false},
+		{"none", CleanNone, false},
+		{"some", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseCleanMode(tt.v)
+		if got != tt.want || (err != nil) != tt.wantErr {
+			t.Errorf("ParseCleanMode(%q) = %q, %v; want %q, error %v", tt.v, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestAcquireWorktreePool(t *testing.T) {
+	sha := testMirror(t, "o/app", map[string]string{"a.txt": "a\n"})
+	ctx := context.Background()
+	branchDir := filepath.Join(Root, "worktrees", ToLocalRepo("o/app"), "feature--x")
+
+	// Runs at once get slots of their own.
+	first, err := AcquireWorktree(ctx, "o/app", "feature/x", sha, CleanAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := AcquireWorktree(ctx, "o/app", "feature/x", sha, CleanAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.Path != filepath.Join(branchDir, "1") || second.Path != filepath.Join(branchDir, "2") {
+		t.Fatalf("slots %s and %s, want 1 and 2 under %s", first.Path, second.Path, branchDir)
+	}
+	for _, wt := range []*Worktree{first, second} {
+		if head := testGit(t, wt.Path, "rev-parse", "HEAD"); head != sha {
+			t.Errorf("%s is at %s, want %s", wt.Path, head, sha)
+		}
+	}
+
+	// A released slot is handed out again, the lowest first.
+	first.Release()
+	third, err := AcquireWorktree(ctx, "o/app", "feature/x", sha, CleanAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if third.Path != first.Path {
+		t.Errorf("reused %s, want the released %s", third.Path, first.Path)
+	}
+	second.Release()
+	third.Release()
+
+	// A slot that isn't a checkout any more is started over.
+	if err := os.Remove(filepath.Join(first.Path, ".git")); err != nil {
+		t.Fatal(err)
+	}
+	again, err := AcquireWorktree(ctx, "o/app", "feature/x", sha, CleanAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Release()
+	if again.Path != first.Path {
+		t.Errorf("got %s, want %s started over", again.Path, first.Path)
+	}
+	if b, err := os.ReadFile(filepath.Join(again.Path, "a.txt")); err != nil || string(b) != "a\n" {
+		t.Errorf("a.txt = %q, %v", b, err)
+	}
+}
+
+func TestAcquireWorktreeClean(t *testing.T) {
+	tests := []struct {
+		clean         CleanMode
+		wantUntracked bool
+		wantIgnored   bool
+	}{
+		{CleanAll, false, false},
+		{CleanUntracked, false, true},
+		{CleanNone, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.clean), func(t *testing.T) {
+			sha := testMirror(t, "o/app", map[string]string{"a.txt": "a\n", ".gitignore": "*.cache\n"})
+			ctx := context.Background()
+			wt, err := AcquireWorktree(ctx, "o/app", "main", sha, tt.clean)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, content := range map[string]string{"a.txt": "changed\n", "new.txt": "new\n", "build.cache": "cache\n"} {
+				if err := os.WriteFile(filepath.Join(wt.Path, name), []byte(content), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			wt.Release()
+
+			wt, err = AcquireWorktree(ctx, "o/app", "main", sha, tt.clean)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer wt.Release()
+			// Tracked files are reset whatever the mode.
+			if b, err := os.ReadFile(filepath.Join(wt.Path, "a.txt")); err != nil || string(b) != "a\n" {
+				t.Errorf("a.txt = %q, %v; want it reset", b, err)
+			}
+			for name, want := range map[string]bool{"new.txt": tt.wantUntracked, "build.cache": tt.wantIgnored} {
+				_, err := os.Stat(filepath.Join(wt.Path, name))
+				if got := err == nil; got != want {
+					t.Errorf("%s kept = %v, want %v", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestAcquireWorktreeRemovesLegacyWorktree(t *testing.T) {
+	sha := testMirror(t, "o/app", nil)
+	mirror := filepath.Join(Root, "repos", ToLocalRepo("o/app"))
+	branchDir := filepath.Join(Root, "worktrees", ToLocalRepo("o/app"), "main")
+	testGit(t, mirror, "worktree", "add", "-q", "--detach", branchDir, sha)
+
+	wt, err := AcquireWorktree(context.Background(), "o/app", "main", sha, CleanAll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wt.Release()
+	if wt.Path != filepath.Join(branchDir, "1") {
+		t.Errorf("got %s, want slot 1 of the pool", wt.Path)
+	}
+	if _, err := os.Stat(filepath.Join(branchDir, ".git")); !os.IsNotExist(err) {
+		t.Errorf("legacy worktree still there: %v", err)
+	}
+}
@@ -1,8 +1,10 @@
 package tui
 
 import (
+	"bytes"
 	"dexianta/refci/core"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
@@ -24,11 +26,19 @@ type logsModel struct {
 	repo   string
 
 	jobs     []core.Job
+	queuePos map[int64]int
 	selected int
 
-	mode    logsViewMode
-	logPath string
-	logRows []string
+	mode     logsViewMode
+	detailID int64 // run shown in logsModeDetail
+	logPath  string
+	logSeq   int      // bumped each time a log is opened, to drop reads of the previous one
+	logRows  []string // complete lines, at most logMaxRows
+	logTail  string   // text after the last newline
+	logNext  int64    // offset in logPath to read from next
+	follow   bool     // reading logPath as it grows, until the run ends
+	scroll   int      // lines scrolled up from the end; 0 keeps showing new lines
+	height   int      // rows the page may use, set by topModel
 
 	statusMsg   string
 	statusInErr bool
@@ -52,25 +62,47 @@ func (m logsModel) Init() tea.Cmd {
 func loadRepoJobsCmd(dbRepo core.DbRepo, repo string) tea.Cmd {
 	return func() tea.Msg {
 		jobs, err := dbRepo.ListJob(core.JobFilter{Repo: repo})
+		if err != nil {
+			return loadRepoJobsMsg{repo: repo, err: err}
+		}
+
+		// The queue is shared by all repos, so rank against every pending run.
+		pending, err := dbRepo.ListJob(core.JobFilter{Status: core.StatusPending})
+		queuePos := make(map[int64]int, len(pending))
+		for i := range pending {
+			// ListJob is newest first; the queue is FIFO.
+			queuePos[pending[len(pending)-1-i].ID] = i + 1
+		}
 		return loadRepoJobsMsg{
-			repo: repo,
-			jobs: jobs,
-			err:  err,
+			repo:     repo,
+			jobs:     groupMatrixJobs(jobs),
+			queuePos: queuePos,
+			err:      err,
 		}
 	}
 }
 
-func loadJobLogCmd(path string) tea.Cmd {
+const (
+	logFollowInterval = 500 * time.Millisecond
+	logTailBytes      = 256 << 10 // most of a log read at once
+	logMaxRows        = 2000      // lines of a log kept in the detail view
+)
+
+// loadJobLogCmd reads the log at path from offset next. final marks a read
+// made after the run ended.
+func loadJobLogCmd(seq int, path string, next int64, final bool) tea.Cmd {
 	return func() tea.Msg {
-		rows, err := readTail(path, 220)
-		return loadJobLogMsg{
-			path:  path,
-			lines: rows,
-			err:   err,
-		}
+		data, next, reset, err := readLogFrom(path, next)
+		return loadJobLogMsg{seq: seq, data: data, next: next, reset: reset, final: final, err: err}
 	}
 }
 
+func followJobLogCmd(seq int) tea.Cmd {
+	return tea.Tick(logFollowInterval, func(time.Time) tea.Msg {
+		return followJobLogMsg{seq: seq}
+	})
+}
+
 func (m logsModel) Update(msg tea.Msg) (logsModel, tea.Cmd, bool) {
 	switch mg := msg.(type) {
 	case loadRepoJobsMsg:
@@ -83,6 +115,7 @@ func (m logsModel) Update(msg tea.Msg) (logsModel, tea.Cmd, bool) {
 			return m, nil, true
 		}
 		m.jobs = mg.jobs
+		m.queuePos = mg.queuePos
 		if len(m.jobs) == 0 {
 			m.selected = 0
 		} else if m.selected >= len(m.jobs) {
@@ -91,17 +124,36 @@ func (m logsModel) Update(msg tea.Msg) (logsModel, tea.Cmd, bool) {
 		return m, nil, true
 
 	case loadJobLogMsg:
-		if m.mode != logsModeDetail || mg.path != m.logPath {
+		if m.mode != logsModeDetail || mg.seq != m.logSeq {
 			return m, nil, true
 		}
 		if mg.err != nil {
 			m.statusInErr = true
 			m.statusMsg = mg.err.Error()
-			m.logRows = nil
+			m.follow = false
 			return m, nil, true
 		}
-		m.logRows = mg.lines
-		return m, nil, true
+		m.appendLog(mg.data, mg.reset)
+		m.logNext = mg.next
+		if mg.final {
+			m.follow = false
+		}
+		if !m.follow {
+			return m, nil, true
+		}
+		return m, followJobLogCmd(m.logSeq), true
+
+	case followJobLogMsg:
+		if m.mode != logsModeDetail || mg.seq != m.logSeq || !m.follow {
+			return m, nil, true
+		}
+		// The log is closed before the run's final status is recorded, so a
+		// read made once that status shows up gets all of it.
+		final := true
+		if j, ok := m.detailJob(); ok {
+			final = core.IsTerminalStatus(j.Status)
+		}
+		return m, loadJobLogCmd(m.logSeq, m.logPath, m.logNext, final), true
 
 	case tickMsg:
 		if m.repo == "" {
@@ -115,9 +167,29 @@ func (m logsModel) Update(msg tea.Msg) (logsModel, tea.Cmd, bool) {
 		}
 
 		if m.mode == logsModeDetail {
+			page := max(m.logViewRows()-1, 1)
 			switch mg.String() {
 			case "esc", "enter", "backspace":
 				m.mode = logsModeList
+				m.follow = false
+				return m, nil, true
+			case "up":
+				m.scrollLog(1)
+				return m, nil, true
+			case "down":
+				m.scrollLog(-1)
+				return m, nil, true
+			case "pgup":
+				m.scrollLog(page)
+				return m, nil, true
+			case "pgdown":
+				m.scrollLog(-page)
+				return m, nil, true
+			case "home":
+				m.scrollLog(len(m.logRows) + 1)
+				return m, nil, true
+			case "end":
+				m.scroll = 0
 				return m, nil, true
 			}
 			return m, nil, false
@@ -134,10 +206,15 @@ func (m logsModel) Update(msg tea.Msg) (logsModel, tea.Cmd, bool) {
 			if len(m.jobs) == 0 {
 				return m, nil, true
 			}
+			j := m.jobs[m.selected]
 			m.mode = logsModeDetail
-			m.logPath = pathForJob(m.jobs[m.selected])
-			m.logRows = nil
-			return m, loadJobLogCmd(m.logPath), true
+			m.detailID = j.ID
+			m.logPath = pathForJob(j)
+			m.logSeq++
+			m.logRows, m.logTail, m.logNext, m.scroll = nil, "", 0, 0
+			m.follow = !core.IsTerminalStatus(j.Status)
+			m.statusMsg, m.statusInErr = "", false
+			return m, loadJobLogCmd(m.logSeq, m.logPath, 0, !m.follow), true
 		}
 	}
 
@@ -153,7 +230,13 @@ func (m logsModel) View() string {
 
 func (m logsModel) help() string {
 	if m.mode == logsModeDetail {
+		end := "bottom"
+		if m.follow {
+			end = "follow"
+		}
 		return footerBarStyle.Render(
+			renderHint("UP/DOWN/PGUP/PGDN", "scroll"),
+			renderHint("END", end),
 			renderHint("ESC/ENTER", "back"),
 		)
 	}
@@ -167,12 +250,23 @@ func (m logsModel) help() string {
 func (m logsModel) renderJobList() string {
 	lines := make([]string, 0, len(m.jobs))
 	now := time.Now()
+	names := matrixTreeNames(m.jobs)
+	nameWidth := 14
+	for _, n := range names {
+		if w := lipgloss.Width(n); w > nameWidth {
+			nameWidth = min(w, 40)
+		}
+	}
 	for i, j := range m.jobs {
-		line := fmt.Sprintf("%-14s  %-14s  %-8s  %-6s  %s",
-			j.Name,
-			j.Branch,
-			shortSHA(j.SHA),
-			statusTag(j.Status),
+		name := names[i]
+		if pad := nameWidth - lipgloss.Width(name); pad > 0 {
+			name += strings.Repeat(" ", pad)
+		}
+		line := fmt.Sprintf("%s  %-14s  %-15s  %-8s  %s",
+			name,
+			refLabel(j),
+			runLabel(j),
+			m.statusLabel(j),
 			timeAgo(now, lastTime(j)),
 		)
 		if i == m.selected {
@@ -197,36 +291,194 @@ func (m logsModel) renderJobList() string {
 	return renderRegion("Jobs", []string{strings.Join(lines, "\n")}, help, true)
 }
 
-func (m logsModel) renderLogDetail() string {
-	header := sectionTitleStyle.Render("Log Detail")
-	meta := mutedStyle.Render(fmt.Sprintf("path=%s", m.logPath))
-
-	body := mutedStyle.Render("(empty)")
-	if len(m.logRows) > 0 {
-		body = strings.Join(m.logRows, "\n")
+// detailHead is the part of the log detail above the log lines.
+func (m logsModel) detailHead() string {
+	metaLines := []string{fmt.Sprintf("path=%s", m.logPath)}
+	if j, ok := m.detailJob(); ok {
+		metaLines = append(metaLines, runExitLines(j)...)
+	}
+	switch {
+	case m.follow && m.scroll > 0:
+		metaLines = append(metaLines, fmt.Sprintf("following, paused %d lines up (END resumes)", m.scroll))
+	case m.follow:
+		metaLines = append(metaLines, "following...")
 	}
+
+	parts := []string{sectionTitleStyle.Render("Log Detail"), mutedStyle.Render(strings.Join(metaLines, "\n")), ""}
 	if m.statusMsg != "" && m.statusInErr {
-		body = errorStyle.Render(m.statusMsg) + "\n\n" + body
+		parts = append(parts, errorStyle.Render(m.statusMsg), "")
+	}
+	return lipgloss.JoinVertical(lipgloss.Left, parts...)
+}
+
+func (m logsModel) renderLogDetail() string {
+	body := mutedStyle.Render("(empty)")
+	if rows := m.logLines(); len(rows) > 0 {
+		end := len(rows) - m.scroll
+		start := max(end-m.logViewRows(), 0)
+		body = strings.Join(rows[start:end], "\n")
 	}
 
-	content := lipgloss.JoinVertical(lipgloss.Left, header, meta, "", body)
+	content := lipgloss.JoinVertical(lipgloss.Left, m.detailHead(), body)
 	return regionFocusedStyle.Render(content)
 }
 
-func shortSHA(sha string) string {
-	s := strings.TrimSpace(sha)
-	if len(s) <= 8 {
-		return s
+// logViewRows is how many log lines fit under the detail head.
+func (m logsModel) logViewRows() int {
+	if m.height == 0 {
+		return logMaxRows
+	}
+	// The region's top border takes a row too.
+	return max(m.height-lipgloss.Height(m.detailHead())-1, 5)
+}
+
+// logLines are the lines of the log read so far, including a last one
+// that has no newline yet.
+func (m logsModel) logLines() []string {
+	if m.logTail == "" {
+		return m.logRows
+	}
+	return append(m.logRows[:len(m.logRows):len(m.logRows)], m.logTail)
+}
+
+// appendLog adds text read from the log, or replaces what was read with it
+// on reset. A view scrolled up stays on the lines it shows.
+func (m *logsModel) appendLog(data string, reset bool) {
+	if reset {
+		m.logRows, m.logTail = nil, ""
+	}
+	before := len(m.logLines())
+	rows := strings.Split(m.logTail+data, "\n")
+	m.logRows = append(m.logRows, rows[:len(rows)-1]...)
+	m.logTail = rows[len(rows)-1]
+	if m.scroll > 0 && !reset {
+		m.scroll += len(m.logLines()) - before
+	}
+	if over := len(m.logRows) - logMaxRows; over > 0 {
+		m.logRows = append([]string(nil), m.logRows[over:]...)
+	}
+	m.scrollLog(0)
+}
+
+// scrollLog moves the log view delta lines up (down if negative), within
+// the lines read.
+func (m *logsModel) scrollLog(delta int) {
+	m.scroll = min(max(m.scroll+delta, 0), max(len(m.logLines())-m.logViewRows(), 0))
+}
+
+// detailJob is the run shown in the log detail, as of the last reload of
+// the job list.
+func (m logsModel) detailJob() (core.Job, bool) {
+	for _, j := range m.jobs {
+		if j.ID == m.detailID {
+			return j, true
+		}
 	}
-	return s[:8]
+	return core.Job{}, false
 }
 
-func shortLogSHA(sha string) string {
-	s := strings.TrimSpace(sha)
-	if len(s) <= 12 {
-		return s
+// runExitLines describe run j and, once its script exited, how: exit code
+// or signal, wall time, CPU time and peak memory.
+func runExitLines(j core.Job) []string {
+	lines := []string{fmt.Sprintf("run=#%d status=%s ref=%s sha=%s", j.ID, j.Status, j.Branch, runLabel(j))}
+	if j.ExitCode < 0 && j.Signal == "" {
+		return lines
+	}
+	exit := fmt.Sprintf("exit=%d", j.ExitCode)
+	if j.Signal != "" {
+		exit = "signal=" + j.Signal
 	}
-	return s[:12]
+	lines = append(lines, fmt.Sprintf("%s duration=%s user_cpu=%s sys_cpu=%s max_rss=%s",
+		exit,
+		j.Duration.Round(time.Millisecond),
+		j.UserCPU.Round(time.Millisecond),
+		j.SysCPU.Round(time.Millisecond),
+		formatBytes(j.MaxRSS),
+	))
+	return lines
+}
+
+// groupMatrixJobs keeps the newest-first order of jobs but pulls the runs of
+// one matrix (same job, branch and sha) up next to its newest member.
+func groupMatrixJobs(jobs []core.Job) []core.Job {
+	type groupKey struct{ base, branch, sha string }
+	groups := map[groupKey][]core.Job{}
+	var order []groupKey
+	out := make([]core.Job, 0, len(jobs))
+	for _, j := range jobs {
+		base, combo := core.SplitMatrixJobName(j.Name)
+		if combo == "" {
+			order = append(order, groupKey{})
+			groups[groupKey{}] = append(groups[groupKey{}], j)
+			continue
+		}
+		k := groupKey{base: base, branch: j.Branch, sha: j.SHA}
+		if _, ok := groups[k]; !ok {
+			order = append(order, k)
+		}
+		groups[k] = append(groups[k], j)
+	}
+
+	plain := 0
+	for _, k := range order {
+		if k == (groupKey{}) {
+			out = append(out, groups[k][plain])
+			plain++
+			continue
+		}
+		out = append(out, groups[k]...)
+	}
+	return out
+}
+
+// matrixTreeNames is the name column of the job list: the first run of a
+// matrix group shows the full name, the rest only their combination.
+func matrixTreeNames(jobs []core.Job) []string {
+	names := make([]string, len(jobs))
+	for i, j := range jobs {
+		base, combo := core.SplitMatrixJobName(j.Name)
+		if combo == "" || i == 0 || !sameMatrixGroup(jobs[i-1], j, base) {
+			names[i] = j.Name
+			continue
+		}
+		branch := "├"
+		if i+1 == len(jobs) || !sameMatrixGroup(jobs[i+1], j, base) {
+			branch = "└"
+		}
+		names[i] = " " + branch + " " + combo
+	}
+	return names
+}
+
+func sameMatrixGroup(other, j core.Job, base string) bool {
+	otherBase, otherCombo := core.SplitMatrixJobName(other.Name)
+	return otherCombo != "" && otherBase == base && other.Branch == j.Branch && other.SHA == j.SHA
+}
+
+// refLabel names the ref a run is for: the branch, "tag <name>" or the full
+// ref.
+func refLabel(j core.Job) string {
+	if j.RefType == core.RefTag {
+		return "tag " + strings.TrimPrefix(j.Branch, "refs/tags/")
+	}
+	return j.Branch
+}
+
+// runLabel is the short sha, suffixed with the attempt for re-runs.
+func runLabel(j core.Job) string {
+	if j.Attempt > 1 {
+		return fmt.Sprintf("%s#%d", core.ShortSHA(j.SHA), j.Attempt)
+	}
+	return core.ShortSHA(j.SHA)
+}
+
+// statusLabel is statusTag plus the queue position of pending runs.
+func (m logsModel) statusLabel(j core.Job) string {
+	tag := statusTag(j.Status)
+	if pos, ok := m.queuePos[j.ID]; ok && j.Status == core.StatusPending {
+		return fmt.Sprintf("%s #%d", tag, pos)
+	}
+	return tag
 }
 
 func statusTag(v string) string {
@@ -241,6 +493,12 @@ func statusTag(v string) string {
 		return "WAIT"
 	case core.StatusCanceled:
 		return "CANC"
+	case core.StatusTimedOut:
+		return "TIME"
+	case core.StatusSkipped:
+		return "SKIP"
+	case core.StatusAbandoned:
+		return "ABND"
 	default:
 		return strings.ToUpper(v)
 	}
@@ -273,34 +531,107 @@ func timeAgo(now, t time.Time) string {
 	}
 }
 
-func readTail(path string, max int) ([]string, error) {
+// readLogFrom reads what was written to the log at path past offset next,
+// and returns the offset to read from after it. A first read (next 0), and
+// a read of a log that shrank or grew by more than logTailBytes, starts
+// over from the last logTailBytes, at a line start, and reports reset. A
+// log that doesn't exist yet reads as empty. Compressed logs are read whole
+// as they no longer grow.
+func readLogFrom(path string, next int64) (data string, newNext int64, reset bool, err error) {
 	if path == "" {
-		return nil, nil
+		return "", 0, false, nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		if _, gzErr := os.Stat(path + ".gz"); gzErr != nil {
+			return "", next, false, nil
+		}
+		path += ".gz"
+	} else if err != nil {
+		return "", next, false, err
 	}
-	b, err := os.ReadFile(path)
+	if strings.HasSuffix(path, ".gz") {
+		if f != nil {
+			_ = f.Close()
+		}
+		return readCompressedLog(path)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
 	if err != nil {
-		return nil, err
+		return "", next, false, err
+	}
+	size := info.Size()
+	start := next
+	if next == 0 || size < next || size-next > logTailBytes {
+		start = max(size-logTailBytes, 0)
+		reset = true
+	}
+	buf := make([]byte, size-start)
+	n, err := f.ReadAt(buf, start)
+	if err != nil && err != io.EOF {
+		return "", next, false, err
+	}
+	buf = buf[:n]
+	if reset && start > 0 {
+		// Drop the partial line the read started in.
+		if i := bytes.IndexByte(buf, '\n'); i >= 0 {
+			buf = buf[i+1:]
+		}
 	}
+	return string(buf), start + int64(n), reset, nil
+}
 
-	rows := strings.Split(string(b), "\n")
-	if len(rows) > max {
-		rows = rows[len(rows)-max:]
+func readCompressedLog(path string) (string, int64, bool, error) {
+	f, err := core.OpenJobLog(path)
+	if err != nil {
+		return "", 0, false, err
+	}
+	defer f.Close()
+	b, err := io.ReadAll(f)
+	if err != nil {
+		return "", 0, false, err
+	}
+	if len(b) > logTailBytes {
+		b = b[len(b)-logTailBytes:]
+		if i := bytes.IndexByte(b, '\n'); i >= 0 {
+			b = b[i+1:]
+		}
 	}
-	return rows, nil
+	return string(b), int64(len(b)), true, nil
 }
 
+// pathForJob is the log of job: the path stored when the log was created,
+// or its compressed copy. Runs recorded before log paths were stored fall
+// back to the naming rules of their time.
 func pathForJob(job core.Job) string {
-	msg := job.Msg
-	if msg != "" {
-		if _, err := os.Stat(msg); err == nil {
-			return msg
+	if job.LogPath != "" {
+		if _, err := os.Stat(job.LogPath); err != nil {
+			if _, err := os.Stat(job.LogPath + ".gz"); err == nil {
+				return job.LogPath + ".gz"
+			}
 		}
+		return job.LogPath
+	}
+	dir := filepath.Join(core.Root, "logs", core.ToLocalRepo(job.Repo))
+	p := filepath.Join(dir, core.JobLogName(job.Name, job.Branch, job.SHA, job.ID))
+	if _, err := os.Stat(p); err == nil {
+		return p
 	}
-	repoPart := core.ToLocalRepo(job.Repo)
+	if _, err := os.Stat(p + ".gz"); err == nil {
+		return p + ".gz"
+	}
+
+	// Runs recorded before run IDs existed used one log per name/branch/sha.
 	namePart := sanitizeLogToken(job.Name)
 	branchPart := sanitizeLogToken(job.Branch)
-	shaPart := sanitizeLogToken(shortLogSHA(job.SHA))
-	return filepath.Join(core.Root, "logs", repoPart, fmt.Sprintf("%s-%s-%s.log", namePart, branchPart, shaPart))
+	shaPart := sanitizeLogToken(core.ShortSHA(job.SHA))
+	legacy := filepath.Join(dir, fmt.Sprintf("%s-%s-%s.log", namePart, branchPart, shaPart))
+	if _, err := os.Stat(legacy); err == nil {
+		return legacy
+	}
+	return p
 }
 
 func sanitizeLogToken(s string) string {
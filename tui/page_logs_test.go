@@ -0,0 +1,240 @@
+package tui
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"dexianta/refci/core"
+)
+
+func TestPathForJob(t *testing.T) {
+	oldRoot := core.Root
+	core.Root = t.TempDir()
+	t.Cleanup(func() { core.Root = oldRoot })
+
+	job := core.Job{ID: 7, Repo: "o/app", Name: "build", Branch: "feature/x", SHA: "1a2b3c4d5e6f7a8b9c0d"}
+	stored := filepath.Join(t.TempDir(), "somewhere", "run.log")
+	named := core.JobLogPath(job)
+	legacy := filepath.Join(core.Root, "logs", core.ToLocalRepo(job.Repo), "build-feature--x-1a2b3c4d5e6f.log")
+
+	tests := []struct {
+		name    string
+		logPath string   // stored on the run
+		files   []string // logs on disk
+		want    string
+	}{
+		{"stored", stored, []string{stored, named}, stored},
+		{"stored and compressed", stored, []string{stored + ".gz"}, stored + ".gz"},
+		{"stored and gone", stored, []string{named}, stored},
+		{"not stored", "", []string{named}, named},
+		{"not stored and compressed", "", []string{named + ".gz"}, named + ".gz"},
+		{"before run ids", "", []string{legacy}, legacy},
+		{"not stored and gone", "", nil, named},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, path := range []string{stored, named, legacy} {
+				for _, p := range []string{path, path + ".gz"} {
+					if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+						t.Fatal(err)
+					}
+				}
+			}
+			for _, path := range tt.files {
+				if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte("log\n"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			j := job
+			j.LogPath = tt.logPath
+			if got := pathForJob(j); got != tt.want {
+				t.Errorf("pathForJob = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadLogFrom(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "run.log")
+	long := strings.Repeat("0123456789abcdef\n", logTailBytes/17)
+
+	// Each step changes the log with edit, then reads on from where the
+	// previous step left off.
+	steps := []struct {
+		name      string
+		edit      func() error
+		wantData  string
+		wantReset bool
+	}{
+		{"not created yet", func() error { return nil }, "", false},
+		{"first read", func() error { return os.WriteFile(path, []byte("a\nb"), 0o644) }, "a\nb", true},
+		{"nothing new", func() error { return nil }, "", false},
+		{"appended", func() error { return appendFile(path, "c\n") }, "c\n", false},
+		{"truncated", func() error { return os.WriteFile(path, []byte("x\n"), 0o644) }, "x\n", true},
+		{"grew past the tail", func() error { return appendFile(path, "partial line\n"+long) }, long, true},
+		{"compressed", func() error {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			return writeGzip(path+".gz", "done\n")
+		}, "done\n", true},
+	}
+	var next int64
+	for _, step := range steps {
+		if err := step.edit(); err != nil {
+			t.Fatal(err)
+		}
+		data, newNext, reset, err := readLogFrom(path, next)
+		if err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if data != step.wantData || reset != step.wantReset {
+			t.Errorf("%s: read %d bytes %.20q, reset %v; want %d bytes %.20q, reset %v",
+				step.name, len(data), data, reset, len(step.wantData), step.wantData, step.wantReset)
+		}
+		if info, err := os.Stat(path); err == nil && newNext != info.Size() {
+			t.Errorf("%s: next read from %d, want the end at %d", step.name, newNext, info.Size())
+		}
+		next = newNext
+	}
+}
+
+func appendFile(path, data string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeGzip(path, data string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	if _, err := zw.Write([]byte(data)); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func TestAppendLog(t *testing.T) {
+	lines := func(from, to int) []string {
+		var out []string
+		for i := from; i < to; i++ {
+			out = append(out, fmt.Sprint(i))
+		}
+		return out
+	}
+	tests := []struct {
+		name       string
+		rows       []string
+		tail       string
+		scroll     int
+		data       string
+		reset      bool
+		wantRows   []string
+		wantTail   string
+		wantScroll int
+	}{
+		{name: "first lines", data: "a\nb", wantRows: []string{"a"}, wantTail: "b"},
+		{name: "line finished", rows: []string{"a"}, tail: "b", data: "c\nd\n", wantRows: []string{"a", "bc", "d"}},
+		{name: "reset", rows: []string{"a"}, tail: "b", data: "x\n", reset: true, wantRows: []string{"x"}},
+		{
+			name: "scrolled up stays put", rows: lines(0, 30), scroll: 2, data: "30\n31\n",
+			wantRows: lines(0, 32), wantScroll: 4,
+		},
+		{
+			name: "reset scrolls within what was read", rows: lines(0, 30), scroll: 20, data: "x\n", reset: true,
+			wantRows: []string{"x"},
+		},
+		{
+			name: "kept to logMaxRows", rows: lines(0, logMaxRows), data: "a\nb\n",
+			wantRows: append(lines(2, logMaxRows), "a", "b"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := logsModel{mode: logsModeDetail, height: 20, logRows: tt.rows, logTail: tt.tail, scroll: tt.scroll}
+			m.appendLog(tt.data, tt.reset)
+			if !reflect.DeepEqual(m.logRows, tt.wantRows) || m.logTail != tt.wantTail {
+				t.Errorf("rows %q, tail %q; want %q, %q", m.logRows, m.logTail, tt.wantRows, tt.wantTail)
+			}
+			if m.scroll != tt.wantScroll {
+				t.Errorf("scrolled %d lines up, want %d", m.scroll, tt.wantScroll)
+			}
+		})
+	}
+}
+
+// Following reads on while the run is going and stops once a read made
+// after it ended comes back.
+func TestFollowJobLog(t *testing.T) {
+	running := core.Job{ID: 7, Status: core.StatusRunning, JobExit: core.JobExit{ExitCode: -1}}
+	finished := core.Job{ID: 7, Status: core.StatusFinished, JobExit: core.JobExit{ExitCode: 0}}
+	tests := []struct {
+		name       string
+		job        core.Job // the run as of the last job list reload
+		msg        any
+		wantFollow bool
+		wantCmd    any // type of the message the returned command sends, nil for none
+		wantFinal  bool
+	}{
+		{"read while running", running, loadJobLogMsg{seq: 1, data: "a\n", next: 2}, true, followJobLogMsg{}, false},
+		{"read after the end", finished, loadJobLogMsg{seq: 1, data: "a\n", next: 2, final: true}, false, nil, false},
+		{"read of an earlier log", running, loadJobLogMsg{seq: 0, data: "a\n"}, true, nil, false},
+		{"read failed", running, loadJobLogMsg{seq: 1, err: os.ErrPermission}, false, nil, false},
+		{"tick while running", running, followJobLogMsg{seq: 1}, true, loadJobLogMsg{}, false},
+		{"tick after the end", finished, followJobLogMsg{seq: 1}, true, loadJobLogMsg{}, true},
+		{"tick of an earlier log", running, followJobLogMsg{seq: 0}, true, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := logsModel{
+				repo: "o/app", jobs: []core.Job{tt.job}, mode: logsModeDetail, detailID: 7,
+				logPath: filepath.Join(t.TempDir(), "run.log"), logSeq: 1, follow: true,
+			}
+			m, cmd, handled := m.Update(tt.msg)
+			if !handled {
+				t.Fatal("not handled")
+			}
+			if m.follow != tt.wantFollow {
+				t.Errorf("follow = %v, want %v", m.follow, tt.wantFollow)
+			}
+			if tt.wantCmd == nil {
+				if cmd != nil {
+					t.Errorf("got a command, want none")
+				}
+				return
+			}
+			if cmd == nil {
+				t.Fatalf("got no command, want one sending %T", tt.wantCmd)
+			}
+			got := cmd()
+			if reflect.TypeOf(got) != reflect.TypeOf(tt.wantCmd) {
+				t.Fatalf("command sends %T, want %T", got, tt.wantCmd)
+			}
+			if read, ok := got.(loadJobLogMsg); ok && read.final != tt.wantFinal {
+				t.Errorf("read final = %v, want %v", read.final, tt.wantFinal)
+			}
+		})
+	}
+}
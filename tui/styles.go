@@ -39,6 +39,9 @@ var (
 	successStyle = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("114"))
 
+	warnStyle = lipgloss.NewStyle().
+			Foreground(lipgloss.Color("214"))
+
 	errorStyle = lipgloss.NewStyle().
 			Foreground(lipgloss.Color("203")).
 			Bold(true)
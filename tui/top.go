@@ -18,9 +18,18 @@ type topModel struct {
 	now    time.Time
 	repo   string
 
+	// source is set when serving several repos; repo is then the selected one.
+	source RepoSource
+	repos  []string
+	health map[string]core.RepoHealth
+
 	logsModel logsModel
 }
 
+// RepoSource returns the watched repos, in display order, each time the TUI
+// refreshes.
+type RepoSource func() []string
+
 type tickMsg time.Time
 
 func newModel(repo string, dbRepo core.DbRepo) topModel {
@@ -31,8 +40,30 @@ func newModel(repo string, dbRepo core.DbRepo) topModel {
 	}
 }
 
+func newServeModel(dbRepo core.DbRepo, source RepoSource) topModel {
+	m := topModel{
+		now:    time.Now(),
+		source: source,
+		repos:  source(),
+	}
+	if len(m.repos) > 0 {
+		m.repo = m.repos[0]
+	}
+	m.logsModel = newLogsModel(dbRepo, m.repo)
+	return m
+}
+
 func Run(ctx context.Context, repo string, dbRepo core.DbRepo) error {
-	p := tea.NewProgram(newModel(repo, dbRepo), tea.WithAltScreen(), tea.WithContext(ctx))
+	return runProgram(ctx, newModel(repo, dbRepo))
+}
+
+// RunServe shows the jobs of every repo source reports, one repo at a time.
+func RunServe(ctx context.Context, dbRepo core.DbRepo, source RepoSource) error {
+	return runProgram(ctx, newServeModel(dbRepo, source))
+}
+
+func runProgram(ctx context.Context, m topModel) error {
+	p := tea.NewProgram(m, tea.WithAltScreen(), tea.WithContext(ctx))
 	_, err := p.Run()
 	if errors.Is(err, tea.ErrProgramKilled) && ctx.Err() != nil {
 		return nil
@@ -41,17 +72,40 @@ func Run(ctx context.Context, repo string, dbRepo core.DbRepo) error {
 }
 
 func (m topModel) Init() tea.Cmd {
-	return tea.Batch(tickCmd(), m.logsModel.Init())
+	return tea.Batch(tickCmd(), m.logsModel.Init(), loadRepoHealthCmd(m.logsModel.dbRepo))
+}
+
+func loadRepoHealthCmd(dbRepo core.DbRepo) tea.Cmd {
+	return func() tea.Msg {
+		health, err := dbRepo.ListRepoHealth()
+		return loadRepoHealthMsg{health: health, err: err}
+	}
 }
 
 func (m topModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmd tea.Cmd
 
 	switch msg := msg.(type) {
-	case loadRepoJobsMsg, loadJobLogMsg:
+	case loadRepoJobsMsg, loadJobLogMsg, followJobLogMsg:
 		m.logsModel, cmd, _ = m.logsModel.Update(msg)
 		return m, cmd
+	case loadRepoHealthMsg:
+		if msg.err == nil {
+			m.health = make(map[string]core.RepoHealth, len(msg.health))
+			for _, h := range msg.health {
+				m.health[h.Repo] = h
+			}
+		}
+		return m, nil
 	case tea.KeyMsg:
+		if m.source != nil && m.logsModel.mode == logsModeList {
+			switch msg.String() {
+			case "tab":
+				return m.selectRepo(1)
+			case "shift+tab":
+				return m.selectRepo(-1)
+			}
+		}
 		var handled bool
 		m.logsModel, cmd, handled = m.logsModel.Update(msg)
 		switch msg.String() {
@@ -64,17 +118,57 @@ func (m topModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	case tea.WindowSizeMsg:
 		m.width = msg.Width
 		m.height = msg.Height
+		m.logsModel.height = m.pageHeight()
 		return m, nil
 	case tickMsg:
 		m.now = time.Time(msg)
+		healthCmd := loadRepoHealthCmd(m.logsModel.dbRepo)
+		if m.source != nil {
+			m.repos = m.source()
+			if m.repoIndex() < 0 {
+				// The selected repo is no longer watched.
+				next, cmd := m.selectRepo(0)
+				return next, tea.Batch(tickCmd(), healthCmd, cmd)
+			}
+		}
 		var cmd1 tea.Cmd
 		m.logsModel, cmd1, _ = m.logsModel.Update(msg)
-		return m, tea.Batch(tickCmd(), cmd1)
+		return m, tea.Batch(tickCmd(), healthCmd, cmd1)
 	}
 
 	return m, cmd
 }
 
+// repoIndex is the position of the selected repo in repos, or -1.
+func (m topModel) repoIndex() int {
+	for i, repo := range m.repos {
+		if repo == m.repo {
+			return i
+		}
+	}
+	return -1
+}
+
+// selectRepo moves the repo selection by delta and reloads the job list.
+func (m topModel) selectRepo(delta int) (tea.Model, tea.Cmd) {
+	repo := ""
+	if len(m.repos) > 0 {
+		idx := m.repoIndex()
+		if idx < 0 {
+			idx = 0
+		} else {
+			idx = modIdx(idx, len(m.repos), delta)
+		}
+		repo = m.repos[idx]
+	}
+	if repo == m.repo {
+		return m, nil
+	}
+	m.repo = repo
+	m.logsModel = newLogsModel(m.logsModel.dbRepo, repo)
+	return m, m.logsModel.Init()
+}
+
 func tickCmd() tea.Cmd {
 	return tea.Tick(time.Second, func(t time.Time) tea.Msg {
 		return tickMsg(t)
@@ -90,11 +184,22 @@ func (m topModel) View() string {
 		return "loading..."
 	}
 
+	// The health lines above the page change between ticks.
+	m.logsModel.height = m.pageHeight()
+	return m.layout(m.logsModel.View())
+}
+
+// layout puts the page body between the header and the footer.
+func (m topModel) layout(body string) string {
 	subHeader := mutedStyle.Render(fmt.Sprintf("%s", m.now.Format("2006-01-02 15:04:05 Z07:00")))
 	header := lipgloss.JoinHorizontal(lipgloss.Top, headerStyle.Render("refci  -  zero-overhead CI"), " ", subHeader)
-	body := m.logsModel.View()
 	footer := lipgloss.JoinVertical(lipgloss.Top, m.logsModel.help(), "", globalFooter)
-	repoLabel := sectionTitleStyle.Render(fmt.Sprint("\n", ">> "+m.repo, "\n"))
+	repoLabel := sectionTitleStyle.Render(fmt.Sprint("\n", ">> "+m.repo)) + "\n" + m.renderHealth(m.repo) + "\n"
+	if m.source != nil {
+		repoLabel = "\n" + m.renderRepoBar() + "\n"
+		footer = lipgloss.JoinVertical(lipgloss.Top, m.logsModel.help(), "",
+			footerBarStyle.Render(renderHint("TAB", "next repo"), renderHint("CTRL+C", "quit")))
+	}
 	return appStyle.Render(strings.Join([]string{
 		header,
 		repoLabel,
@@ -104,3 +209,88 @@ func (m topModel) View() string {
 		footer,
 	}, "\n"))
 }
+
+// pageHeight is how many rows the page body can have without pushing the
+// header off the screen.
+func (m topModel) pageHeight() int {
+	if m.height == 0 {
+		return 0
+	}
+	return max(m.height-lipgloss.Height(m.layout(""))+1, 1)
+}
+
+// renderRepoBar lists the watched repos with their poll health and, below,
+// the selected repo's health detail.
+func (m topModel) renderRepoBar() string {
+	if len(m.repos) == 0 {
+		return mutedStyle.Render("No repos to watch. Add one with: refci repo add <git-url>")
+	}
+
+	items := make([]string, 0, len(m.repos))
+	for _, repo := range m.repos {
+		name := mutedStyle.Render(repo)
+		if repo == m.repo {
+			name = sectionTitleStyle.Render(">> " + repo)
+		}
+		items = append(items, healthMark(m.health[repo].State)+" "+name)
+	}
+	return strings.Join(items, "   ") + "\n" + m.renderHealth(m.repo)
+}
+
+func healthMark(state string) string {
+	switch state {
+	case core.HealthOK:
+		return successStyle.Render("✓")
+	case core.HealthStaleConf, core.HealthJobErrors, core.HealthRetrying:
+		return warnStyle.Render("!")
+	case core.HealthFailing:
+		return errorStyle.Render("✗")
+	default:
+		return mutedStyle.Render("·")
+	}
+}
+
+// renderHealth describes the latest polls of repo in one or two lines.
+func (m topModel) renderHealth(repo string) string {
+	h, ok := m.health[repo]
+	if !ok || h.State == "" {
+		return mutedStyle.Render("not polled yet")
+	}
+
+	var lines []string
+	switch h.State {
+	case core.HealthRetrying, core.HealthFailing:
+		line := fmt.Sprintf("%s: %d failed polls in a row, retrying %s: %s",
+			h.State, h.Failures, timeUntil(m.now, h.NextPoll), oneLine(h.LastError))
+		style := warnStyle
+		if h.State == core.HealthFailing {
+			style = errorStyle
+		}
+		lines = append(lines, style.Render(line))
+		if !h.LastPoll.IsZero() {
+			lines = append(lines, mutedStyle.Render("last good poll "+timeAgo(m.now, h.LastPoll)))
+		}
+	default:
+		lines = append(lines, mutedStyle.Render("polled "+timeAgo(m.now, h.LastPoll)))
+	}
+	if h.ConfError != "" {
+		lines = append(lines, warnStyle.Render(fmt.Sprintf("using .refci/conf.yml from %s: %s", core.ShortSHA(h.ConfSHA), oneLine(h.ConfError))))
+	}
+	if h.QueueError != "" {
+		lines = append(lines, warnStyle.Render("not queued: "+oneLine(h.QueueError)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// oneLine collapses the lines of a git or yaml error into one.
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func timeUntil(now, t time.Time) string {
+	if !t.After(now) {
+		return "now"
+	}
+	d := t.Sub(now).Round(time.Second)
+	return "in " + d.String()
+}
@@ -3,13 +3,29 @@ package tui
 import "dexianta/refci/core"
 
 type loadRepoJobsMsg struct {
-	repo string
-	jobs []core.Job
-	err  error
+	repo     string
+	jobs     []core.Job
+	queuePos map[int64]int // run id -> 1-based position among pending runs
+	err      error
 }
 
+// loadJobLogMsg carries what a read of the detail log found past the
+// previous read.
 type loadJobLogMsg struct {
-	path  string
-	lines []string
+	seq   int    // logsModel.logSeq the read was made for
+	data  string // text read
+	next  int64  // offset to read from next time
+	reset bool   // data replaces what was read before
+	final bool   // read after the run ended, so nothing more will be written
 	err   error
 }
+
+// followJobLogMsg asks for the next read of the detail log.
+type followJobLogMsg struct {
+	seq int
+}
+
+type loadRepoHealthMsg struct {
+	health []core.RepoHealth
+	err    error
+}
@@ -1,5 +1,7 @@
 package tui
 
+import "fmt"
+
 func renderHint(key, desc string) string {
 	return keycapStyle.Render(key) + " " + desc
 }
@@ -25,3 +27,16 @@ func modIdx(idx, mod, delta int) int {
 	}
 	return idx + delta
 }
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for v := n / unit; v >= unit; v /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,69 @@
+package tui
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"dexianta/refci/core"
+)
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := formatBytes(tt.n); got != tt.want {
+			t.Errorf("formatBytes(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestRunExitLines(t *testing.T) {
+	sha := "1a2b3c4d5e6f7a8b9c0d1a2b3c4d5e6f7a8b9c0d"
+	run := core.Job{ID: 7, Status: core.StatusFailed, Branch: "main", SHA: sha, Attempt: 2}
+	tests := []struct {
+		name string
+		exit core.JobExit
+		want []string
+	}{
+		{
+			name: "not exited",
+			exit: core.JobExit{ExitCode: -1},
+			want: []string{"run=#7 status=failed ref=main sha=1a2b3c4d5e6f#2"},
+		},
+		{
+			name: "exited",
+			exit: core.JobExit{ExitCode: 1, Duration: 1500 * time.Millisecond, UserCPU: time.Second, SysCPU: 20 * time.Millisecond, MaxRSS: 2 << 20},
+			want: []string{
+				"run=#7 status=failed ref=main sha=1a2b3c4d5e6f#2",
+				"exit=1 duration=1.5s user_cpu=1s sys_cpu=20ms max_rss=2.0 MiB",
+			},
+		},
+		{
+			name: "killed",
+			exit: core.JobExit{ExitCode: -1, Signal: "killed", Duration: time.Minute},
+			want: []string{
+				"run=#7 status=failed ref=main sha=1a2b3c4d5e6f#2",
+				"signal=killed duration=1m0s user_cpu=0s sys_cpu=0s max_rss=0 B",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			j := run
+			j.JobExit = tt.exit
+			if got := runExitLines(j); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("runExitLines =\n%q\nwant\n%q", got, tt.want)
+			}
+		})
+	}
+}